@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/n4d13/mongo_driver_test/stage"
+)
+
+// AnalyzeJournal prints the stage rebuilt from a journal file.
+func AnalyzeJournal(args []string) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	file := flags.String("f", "", "journal file, NDJSON or gzip NDJSON")
+	output := flags.String("o", "", "write the analysis to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "analyze needs a journal file: analyze -f stage.ndjson")
+		return ExitUsage
+	}
+
+	analysis, err := stage.Analyze(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+	if err = writeReport(*output, analysis); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+	return ExitOK
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/n4d13/mongo_driver_test/compare"
+	"github.com/n4d13/mongo_driver_test/config"
+	"github.com/n4d13/mongo_driver_test/http"
+	"github.com/n4d13/mongo_driver_test/store"
+)
+
+// CompareStages diffs stage runs kept in the data directory and prints the
+// comparison, it exits with ExitBreached when a run regressed.
+func CompareStages(args []string) int {
+	flags := flag.NewFlagSet("compare", flag.ContinueOnError)
+	dataDir := flags.String("d", config.LoadConfig().DataDir, "data directory keeping the history of the runs")
+	thresholdPct := flags.Float64("threshold", compare.DefaultThresholdPct, "change in percent flagged as a regression")
+	output := flags.String("o", "", "write the comparison to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	ids := flags.Args()
+	if len(ids) == 1 {
+		ids = http.SplitIds(ids[0])
+	}
+	if len(ids) < 2 || *thresholdPct <= 0 {
+		fmt.Fprintln(os.Stderr, "compare needs two stage ids or more and a positive threshold: compare [-d DIR] ID ID...")
+		return ExitUsage
+	}
+
+	fileStore, err := store.NewFileStore(*dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+	comparison, err := http.CompareStoredStages(fileStore, ids, *thresholdPct)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+
+	if err = writeReport(*output, comparison); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+	if len(comparison.Regressions) > 0 {
+		return ExitBreached
+	}
+	return ExitOK
+}
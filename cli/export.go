@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/n4d13/mongo_driver_test/config"
+	"github.com/n4d13/mongo_driver_test/export"
+	"github.com/n4d13/mongo_driver_test/http"
+	"github.com/n4d13/mongo_driver_test/store"
+)
+
+// ExportStage writes a stage run kept in the data directory in the chosen format.
+func ExportStage(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dataDir := flags.String("d", config.LoadConfig().DataDir, "data directory keeping the history of the runs")
+	format := flags.String("format", export.FormatHTML, "csv for the timeline, jsonl for the records of the journal or html for the report")
+	output := flags.String("o", "", "write the export to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if _, err := export.ContentType(*format); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "export needs a stage id and a known format: export [-d DIR] [-format csv|jsonl|html] ID")
+		return ExitUsage
+	}
+
+	fileStore, err := store.NewFileStore(*dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitFailed
+		}
+		defer file.Close()
+		out = file
+	}
+	if err = http.ExportStoredStage(out, fileStore, flags.Arg(0), *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitFailed
+	}
+	return ExitOK
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/n4d13/mongo_driver_test/http"
+	"gopkg.in/yaml.v2"
+)
+
+// LoadTestConfig reads a stage file, YAML files use the same field names as the
+// JSON payload of the HTTP API.
+func LoadTestConfig(path string) (*http.TestConfig, error) {
+	var testConfig http.TestConfig
+	if err := loadFile(path, &testConfig); err != nil {
+		return nil, err
+	}
+	return &testConfig, nil
+}
+
+// LoadScenarioConfig reads a scenario file, as JSON or YAML.
+func LoadScenarioConfig(path string) (*http.ScenarioConfig, error) {
+	var scenarioConfig http.ScenarioConfig
+	if err := loadFile(path, &scenarioConfig); err != nil {
+		return nil, err
+	}
+	return &scenarioConfig, nil
+}
+
+// LoadSweepConfig reads a sweep file, as JSON or YAML.
+func LoadSweepConfig(path string) (*http.SweepConfig, error) {
+	var sweepConfig http.SweepConfig
+	if err := loadFile(path, &sweepConfig); err != nil {
+		return nil, err
+	}
+	return &sweepConfig, nil
+}
+
+func loadFile(path string, value interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		content, err = yamlToJSON(content)
+		if err != nil {
+			return fmt.Errorf("invalid YAML in %s: %w", path, err)
+		}
+	}
+
+	if err = json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("invalid file %s: %w", path, err)
+	}
+	return nil
+}
+
+func yamlToJSON(content []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(content, &value); err != nil {
+		return nil, err
+	}
+	value, err := jsonValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// jsonValue converts the maps decoded by yaml, keyed by interface{}, to maps
+// encoding/json can marshal.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = converted
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(typed))
+		for i, item := range typed {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	}
+	return value, nil
+}
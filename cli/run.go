@@ -0,0 +1,202 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/n4d13/mongo_driver_test/http"
+	"github.com/n4d13/mongo_driver_test/scenario"
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the commands.
+const (
+	ExitOK       = 0
+	ExitBreached = 1
+	ExitUsage    = 2
+	ExitFailed   = 3
+)
+
+// RunStage runs the stage described by a file in the foreground, prints its result
+// and returns the exit code of the run command.
+func RunStage(args []string) int {
+	file, output, ok := parseFileFlags("run", "stage", args)
+	if !ok {
+		return ExitUsage
+	}
+
+	testConfig, err := LoadTestConfig(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	stageImpl, validations := http.NewStage(testConfig)
+	if testConfig.Journal != nil && testConfig.Journal.Path == "" {
+		validations = append(validations, "journal needs a path when running from the command line")
+	}
+	if testConfig.Record != nil && testConfig.Record.Path == "" {
+		validations = append(validations, "record needs a path when running from the command line")
+	}
+	if len(validations) > 0 {
+		for _, validation := range validations {
+			fmt.Fprintln(os.Stderr, validation)
+		}
+		return ExitUsage
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	result, runErr := stageImpl.Run(ctx)
+	if runErr != nil {
+		logrus.Errorf("Stage failed: %v", runErr)
+	}
+	if result != nil {
+		if err = writeReport(output, result); err != nil {
+			logrus.Errorf("Can't write the report: %v", err)
+			return ExitFailed
+		}
+	}
+	if runErr != nil {
+		return ExitFailed
+	}
+	if !result.Passed() {
+		return ExitBreached
+	}
+	return ExitOK
+}
+
+// RunSweep runs every combination of a sweep file in the foreground and prints the
+// comparison matrix along with the report of every stage.
+func RunSweep(args []string) int {
+	file, output, ok := parseFileFlags("sweep", "sweep", args)
+	if !ok {
+		return ExitUsage
+	}
+
+	sweepConfig, err := LoadSweepConfig(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	scenarioConfig, validations := sweepConfig.ScenarioConfig()
+	var scenarioImpl *scenario.Scenario
+	if len(validations) == 0 {
+		scenarioImpl, validations = http.NewScenario(scenarioConfig, nil)
+	}
+	if len(validations) > 0 {
+		for _, validation := range validations {
+			fmt.Fprintln(os.Stderr, validation)
+		}
+		return ExitUsage
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	report := scenarioImpl.Run(ctx)
+	err = writeReport(output, struct {
+		Matrix *scenario.Matrix `json:"matrix"`
+		Report *scenario.Report `json:"report"`
+	}{scenario.NewMatrix(sweepConfig.Parameters, report), report})
+	if err != nil {
+		logrus.Errorf("Can't write the report: %v", err)
+		return ExitFailed
+	}
+	if report.SetupError != "" {
+		return ExitFailed
+	}
+	return ExitOK
+}
+
+// RunScenario runs the scenario described by a file in the foreground, prints its
+// report and returns the exit code of the scenario command.
+func RunScenario(args []string) int {
+	file, output, ok := parseFileFlags("scenario", "scenario", args)
+	if !ok {
+		return ExitUsage
+	}
+
+	scenarioConfig, err := LoadScenarioConfig(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	scenarioImpl, validations := http.NewScenario(scenarioConfig, nil)
+	if len(validations) > 0 {
+		for _, validation := range validations {
+			fmt.Fprintln(os.Stderr, validation)
+		}
+		return ExitUsage
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	report := scenarioImpl.Run(ctx)
+	if err = writeReport(output, report); err != nil {
+		logrus.Errorf("Can't write the report: %v", err)
+		return ExitFailed
+	}
+	if report.SetupError != "" {
+		return ExitFailed
+	}
+	if !report.Passed() {
+		return ExitBreached
+	}
+	return ExitOK
+}
+
+// parseFileFlags parses the -f and -o flags shared by the commands running a file.
+func parseFileFlags(command string, kind string, args []string) (string, string, bool) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	file := flags.String("f", "", kind+" file, JSON or YAML")
+	output := flags.String("o", "", "write the report to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return "", "", false
+	}
+	if *file == "" {
+		fmt.Fprintf(os.Stderr, "%s needs a %s file: %s -f %s.json\n", command, kind, command, kind)
+		return "", "", false
+	}
+	return *file, *output, true
+}
+
+// interruptContext is canceled on SIGINT or SIGTERM, letting the stage stop and
+// still report what it ran.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			logrus.Warn("Interrupted, stopping the stage")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+func writeReport(path string, report interface{}) error {
+	var out io.Writer = os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,229 @@
+package compare
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/n4d13/mongo_driver_test/stage"
+)
+
+// DefaultThresholdPct is the relative change of a metric considered significant.
+const DefaultThresholdPct = 10
+
+// Run is a stored stage run to compare.
+type Run struct {
+	Id     string
+	Config interface{}
+	Result *stage.Result
+}
+
+// Comparison diffs every run against the first one, the baseline.
+type Comparison struct {
+	Runs         []string     `json:"runs"`
+	ThresholdPct float64      `json:"threshold_pct"`
+	Config       []ConfigDiff `json:"config"`
+	Metrics      []MetricDiff `json:"metrics"`
+	Verdicts     []string     `json:"verdicts"`
+	Regressions  []string     `json:"regressions"`
+}
+
+// ConfigDiff is a configuration field with different values between runs.
+type ConfigDiff struct {
+	Path   string        `json:"path"`
+	Values []interface{} `json:"values"`
+}
+
+type MetricDiff struct {
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+	// DeltaPcts are the changes against the baseline, null when the baseline is zero.
+	DeltaPcts   []*float64 `json:"delta_pcts"`
+	Regressions []bool     `json:"regressions"`
+}
+
+// metric is a value read from a result. Higher values are worse unless
+// higherIsBetter, changes below minChange are never significant.
+type metric struct {
+	name           string
+	value          func(*stage.Result) float64
+	higherIsBetter bool
+	minChange      float64
+}
+
+var metrics = []metric{
+	{name: "queries", value: func(r *stage.Result) float64 { return float64(r.Queries) }, higherIsBetter: true, minChange: 1},
+	{name: "throughput", value: func(r *stage.Result) float64 { return r.Throughput }, higherIsBetter: true, minChange: 1},
+	{name: "errors", value: func(r *stage.Result) float64 { return float64(r.Errors) }, minChange: 1},
+	{name: "error_rate", value: func(r *stage.Result) float64 { return r.ErrorRate }, minChange: 0.001},
+	{name: "latency_ms.min", value: func(r *stage.Result) float64 { return r.Latency.Min }, minChange: 1},
+	{name: "latency_ms.mean", value: func(r *stage.Result) float64 { return r.Latency.Mean }, minChange: 1},
+	{name: "latency_ms.p50", value: func(r *stage.Result) float64 { return r.Latency.P50 }, minChange: 1},
+	{name: "latency_ms.p90", value: func(r *stage.Result) float64 { return r.Latency.P90 }, minChange: 1},
+	{name: "latency_ms.p95", value: func(r *stage.Result) float64 { return r.Latency.P95 }, minChange: 1},
+	{name: "latency_ms.p99", value: func(r *stage.Result) float64 { return r.Latency.P99 }, minChange: 1},
+	{name: "latency_ms.max", value: func(r *stage.Result) float64 { return r.Latency.Max }, minChange: 1},
+	{name: "pool.created", value: func(r *stage.Result) float64 { return float64(r.Pool.Created) }, minChange: 1},
+	{name: "pool.closed", value: func(r *stage.Result) float64 { return float64(r.Pool.Closed) }, minChange: 1},
+	{name: "pool.gets_ok", value: func(r *stage.Result) float64 { return float64(r.Pool.GetsOK) }, higherIsBetter: true, minChange: 1},
+	{name: "pool.gets_failed", value: func(r *stage.Result) float64 { return float64(r.Pool.GetsFailed) }, minChange: 1},
+	{name: "pool.peak_in_use", value: func(r *stage.Result) float64 { return float64(r.Pool.PeakInUse) }, minChange: 1},
+}
+
+// Compare diffs runs, a metric regresses when it gets worse than the baseline by
+// more than thresholdPct percent, and a verdict when the baseline passed.
+func Compare(runs []Run, thresholdPct float64) (*Comparison, error) {
+	if len(runs) < 2 {
+		return nil, fmt.Errorf("at least two runs are needed, got %d", len(runs))
+	}
+	if thresholdPct <= 0 {
+		thresholdPct = DefaultThresholdPct
+	}
+	comparison := &Comparison{ThresholdPct: thresholdPct, Regressions: []string{}}
+	for _, run := range runs {
+		if run.Result == nil {
+			return nil, fmt.Errorf("run %s has no result", run.Id)
+		}
+		comparison.Runs = append(comparison.Runs, run.Id)
+		comparison.Verdicts = append(comparison.Verdicts, run.Result.Verdict)
+	}
+
+	configs, err := configDiffs(runs)
+	if err != nil {
+		return nil, err
+	}
+	comparison.Config = configs
+
+	for _, m := range append(metrics, countMetrics(runs)...) {
+		diff := MetricDiff{Name: m.name}
+		for _, run := range runs {
+			diff.Values = append(diff.Values, m.value(run.Result))
+		}
+		for i, value := range diff.Values {
+			delta, regressed := change(diff.Values[0], value, m, thresholdPct)
+			diff.DeltaPcts = append(diff.DeltaPcts, delta)
+			diff.Regressions = append(diff.Regressions, i > 0 && regressed)
+			if i > 0 && regressed {
+				comparison.Regressions = append(comparison.Regressions,
+					fmt.Sprintf("%s: %s went from %.4g to %.4g", runs[i].Id, m.name, diff.Values[0], value))
+			}
+		}
+		comparison.Metrics = append(comparison.Metrics, diff)
+	}
+
+	for i, verdict := range comparison.Verdicts[1:] {
+		if comparison.Verdicts[0] == stage.VerdictPass && verdict == stage.VerdictFail {
+			comparison.Regressions = append(comparison.Regressions,
+				fmt.Sprintf("%s: verdict went from pass to fail", runs[i+1].Id))
+		}
+	}
+	return comparison, nil
+}
+
+func change(baseline float64, value float64, m metric, thresholdPct float64) (*float64, bool) {
+	worse := value - baseline
+	if m.higherIsBetter {
+		worse = -worse
+	}
+	if baseline == 0 {
+		return nil, worse >= m.minChange
+	}
+	delta := (value - baseline) / math.Abs(baseline) * 100
+	return &delta, worse >= m.minChange && worse/math.Abs(baseline)*100 > thresholdPct
+}
+
+// countMetrics adds a metric for every error kind and pool failure reason seen in
+// any run.
+func countMetrics(runs []Run) []metric {
+	kinds := map[string]struct{}{}
+	reasons := map[string]struct{}{}
+	for _, run := range runs {
+		for kind := range run.Result.ErrorsByKind {
+			kinds[string(kind)] = struct{}{}
+		}
+		for reason := range run.Result.Pool.Reasons {
+			reasons[reason] = struct{}{}
+		}
+	}
+
+	var counts []metric
+	for _, kind := range sortedKeys(kinds) {
+		kind := kind
+		counts = append(counts, metric{name: "errors_by_kind." + kind, minChange: 1,
+			value: func(r *stage.Result) float64 {
+				for errorKind, count := range r.ErrorsByKind {
+					if string(errorKind) == kind {
+						return float64(count)
+					}
+				}
+				return 0
+			}})
+	}
+	for _, reason := range sortedKeys(reasons) {
+		reason := reason
+		counts = append(counts, metric{name: "pool.failures." + reason, minChange: 1,
+			value: func(r *stage.Result) float64 { return float64(r.Pool.Reasons[reason]) }})
+	}
+	return counts
+}
+
+func configDiffs(runs []Run) ([]ConfigDiff, error) {
+	flattened := make([]map[string]interface{}, len(runs))
+	paths := map[string]struct{}{}
+	for i, run := range runs {
+		content, err := json.Marshal(run.Config)
+		if err != nil {
+			return nil, err
+		}
+		var config interface{}
+		if err = json.Unmarshal(content, &config); err != nil {
+			return nil, err
+		}
+		flattened[i] = map[string]interface{}{}
+		flatten("", config, flattened[i])
+		for path := range flattened[i] {
+			paths[path] = struct{}{}
+		}
+	}
+
+	diffs := []ConfigDiff{}
+	for _, path := range sortedKeys(paths) {
+		diff := ConfigDiff{Path: path}
+		same := true
+		for _, config := range flattened {
+			diff.Values = append(diff.Values, config[path])
+			same = same && reflect.DeepEqual(config[path], flattened[0][path])
+		}
+		if !same {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
+
+// flatten keys every leaf of value by its dotted path, arrays are kept as leaves.
+func flatten(prefix string, value interface{}, into map[string]interface{}) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		into[prefix] = value
+		return
+	}
+	for key, item := range object {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		flatten(path, item, into)
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
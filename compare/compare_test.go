@@ -0,0 +1,106 @@
+package compare
+
+import (
+	"testing"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"github.com/n4d13/mongo_driver_test/stage"
+)
+
+func result(throughput float64, p99 float64, timeouts int64, verdict string) *stage.Result {
+	return &stage.Result{
+		Throughput:   throughput,
+		Latency:      stage.LatencySummary{P99: p99},
+		ErrorsByKind: map[repositories.ErrorKind]int64{repositories.KindTimeout: timeouts},
+		Verdict:      verdict,
+	}
+}
+
+func TestCompareThresholds(t *testing.T) {
+	baseline := Run{Id: "baseline", Result: result(1000, 50, 10, stage.VerdictPass)}
+	tests := []struct {
+		name        string
+		run         *stage.Result
+		metric      string
+		deltaPct    float64
+		regressed   bool
+		regressions int
+	}{
+		{"within tolerance", result(950, 54, 10, stage.VerdictPass), "latency_ms.p99", 8, false, 0},
+		{"improved latency", result(1000, 25, 10, stage.VerdictPass), "latency_ms.p99", -50, false, 0},
+		{"improved throughput", result(1500, 50, 10, stage.VerdictPass), "throughput", 50, false, 0},
+		{"regressed latency", result(1000, 60, 10, stage.VerdictPass), "latency_ms.p99", 20, true, 1},
+		{"regressed throughput", result(850, 50, 10, stage.VerdictPass), "throughput", -15, true, 1},
+		{"regressed errors by kind", result(1000, 50, 12, stage.VerdictPass), "errors_by_kind.timeout", 20, true, 1},
+		{"failed verdict", result(1000, 50, 10, stage.VerdictFail), "throughput", 0, false, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			comparison, err := Compare([]Run{baseline, {Id: "candidate", Result: test.run}}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff := metricDiff(t, comparison, test.metric)
+			if diff.DeltaPcts[1] == nil || *diff.DeltaPcts[1] < test.deltaPct-1e-9 || *diff.DeltaPcts[1] > test.deltaPct+1e-9 {
+				t.Errorf("expected %s to change by %.0f%%, got %v", test.metric, test.deltaPct, diff.DeltaPcts[1])
+			}
+			if diff.Regressions[0] || diff.Regressions[1] != test.regressed {
+				t.Errorf("expected %s regressed %t, got %v", test.metric, test.regressed, diff.Regressions)
+			}
+			if len(comparison.Regressions) != test.regressions {
+				t.Errorf("expected %d regressions, got %v", test.regressions, comparison.Regressions)
+			}
+		})
+	}
+}
+
+// TestCompareMinChange keeps changes too small to matter from regressing, whatever
+// their relative size.
+func TestCompareMinChange(t *testing.T) {
+	baseline := Run{Id: "baseline", Result: result(1000, 2, 0, stage.VerdictPass)}
+	candidate := Run{Id: "candidate", Result: result(1000, 2.5, 1, stage.VerdictPass)}
+	comparison, err := Compare([]Run{baseline, candidate}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := metricDiff(t, comparison, "latency_ms.p99"); diff.Regressions[1] {
+		t.Errorf("expected a 0.5ms p99 change not to regress, got %v", diff.DeltaPcts[1])
+	}
+	diff := metricDiff(t, comparison, "errors_by_kind.timeout")
+	if diff.DeltaPcts[1] != nil || !diff.Regressions[1] {
+		t.Errorf("expected a new timeout against none to regress without a delta, got %v", diff.DeltaPcts[1])
+	}
+}
+
+func TestCompareDefaults(t *testing.T) {
+	if _, err := Compare([]Run{{Id: "alone", Result: result(1, 1, 0, "")}}, 0); err == nil {
+		t.Error("expected a single run to be rejected")
+	}
+	if _, err := Compare([]Run{{Id: "a", Result: result(1, 1, 0, "")}, {Id: "b"}}, 0); err == nil {
+		t.Error("expected a run without result to be rejected")
+	}
+	comparison, err := Compare([]Run{
+		{Id: "a", Config: map[string]interface{}{"workers": 2, "seed": 1}, Result: result(1000, 50, 0, "")},
+		{Id: "b", Config: map[string]interface{}{"workers": 4, "seed": 1}, Result: result(910, 50, 0, "")},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comparison.ThresholdPct != DefaultThresholdPct || len(comparison.Regressions) != 0 {
+		t.Errorf("expected a 9%% drop within the default threshold, got %v", comparison.Regressions)
+	}
+	if len(comparison.Config) != 1 || comparison.Config[0].Path != "workers" {
+		t.Errorf("expected only workers to differ, got %+v", comparison.Config)
+	}
+}
+
+func metricDiff(t *testing.T, comparison *Comparison, name string) MetricDiff {
+	t.Helper()
+	for _, diff := range comparison.Metrics {
+		if diff.Name == name {
+			return diff
+		}
+	}
+	t.Fatalf("expected a %s metric", name)
+	return MetricDiff{}
+}
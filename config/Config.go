@@ -5,17 +5,31 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type AppConfig struct {
 	Port     int
 	BasePath string
+	// DataDir keeps the history of the runs.
+	DataDir string
+	// MaxConcurrentStages stages or scenarios run at once, up to MaxQueuedStages
+	// more wait for their turn.
+	MaxConcurrentStages int
+	MaxQueuedStages     int
+	// ShutdownTimeout bounds how long the server waits for the canceled runs to
+	// store their results when it stops.
+	ShutdownTimeout time.Duration
 }
 
 func LoadConfig() AppConfig {
 	return AppConfig{
-		Port:     getIntEnvOrDefault("SERVER_PORT", 8090),
-		BasePath: getEnvOrDefault("SERVER_BASE_PATH", "/api/v1"),
+		Port:                getIntEnvOrDefault("SERVER_PORT", 8090),
+		BasePath:            getEnvOrDefault("SERVER_BASE_PATH", "/api/v1"),
+		DataDir:             getEnvOrDefault("DATA_DIR", "data"),
+		MaxConcurrentStages: getIntEnvOrDefault("MAX_CONCURRENT_STAGES", 1),
+		MaxQueuedStages:     getIntEnvOrDefault("MAX_QUEUED_STAGES", 100),
+		ShutdownTimeout:     time.Duration(getIntEnvOrDefault("SHUTDOWN_TIMEOUT_SECS", 30)) * time.Second,
 	}
 }
 
@@ -0,0 +1,183 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expression is a standard five field cron expression: minute, hour, day of month,
+// month and day of week. Fields take *, values, ranges, lists and steps, months and
+// days of week also take their three letter names.
+type Expression struct {
+	minute, hour, dayOfMonth, month, dayOfWeek field
+	// anyDay is set when day of month or day of week is *, otherwise a day matching
+	// either of them matches.
+	anyDay bool
+}
+
+// field holds a bit per allowed value.
+type field uint64
+
+func (f field) has(value int) bool {
+	return f&(1<<uint(value)) != 0
+}
+
+type bounds struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minutes     = bounds{name: "minute", min: 0, max: 59}
+	hours       = bounds{name: "hour", min: 0, max: 23}
+	daysOfMonth = bounds{name: "day of month", min: 1, max: 31}
+	months      = bounds{name: "month", min: 1, max: 12, names: []string{
+		"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// 7 is also Sunday.
+	daysOfWeek = bounds{name: "day of week", min: 0, max: 7, names: []string{
+		"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse reads an expression or one of the @yearly, @monthly, @weekly, @daily and
+// @hourly macros.
+func Parse(spec string) (*Expression, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := macros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, it has %d", spec, len(fields))
+	}
+
+	expression := &Expression{anyDay: fields[2] == "*" || fields[4] == "*"}
+	var err error
+	for i, target := range []struct {
+		field  *field
+		bounds bounds
+	}{
+		{&expression.minute, minutes},
+		{&expression.hour, hours},
+		{&expression.dayOfMonth, daysOfMonth},
+		{&expression.month, months},
+		{&expression.dayOfWeek, daysOfWeek},
+	} {
+		if *target.field, err = parseField(fields[i], target.bounds); err != nil {
+			return nil, err
+		}
+	}
+	if expression.dayOfWeek.has(7) {
+		expression.dayOfWeek |= 1
+	}
+	return expression, nil
+}
+
+func parseField(value string, fieldBounds bounds) (field, error) {
+	var result field
+	for _, part := range strings.Split(value, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid %s step in %q", fieldBounds.name, part)
+			}
+		}
+
+		low, high := fieldBounds.min, fieldBounds.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = fieldBounds.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = fieldBounds.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				high = fieldBounds.max
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid %s range %q", fieldBounds.name, rangePart)
+			}
+		}
+		for v := low; v <= high; v += step {
+			result |= 1 << uint(v)
+		}
+	}
+	return result, nil
+}
+
+func (b bounds) value(text string) (int, error) {
+	for i, name := range b.names {
+		if name != "" && strings.EqualFold(text, name) {
+			return i, nil
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < b.min || value > b.max {
+		return 0, fmt.Errorf("invalid %s %q, it must be between %d and %d", b.name, text, b.min, b.max)
+	}
+	return value, nil
+}
+
+// Matches tells whether the minute of t, in its location, is one of the expression.
+func (e *Expression) Matches(t time.Time) bool {
+	return e.minute.has(t.Minute()) && e.hour.has(t.Hour()) && e.month.has(int(t.Month())) && e.dayMatches(t)
+}
+
+func (e *Expression) dayMatches(t time.Time) bool {
+	if e.anyDay {
+		return e.dayOfMonth.has(t.Day()) && e.dayOfWeek.has(int(t.Weekday()))
+	}
+	return e.dayOfMonth.has(t.Day()) || e.dayOfWeek.has(int(t.Weekday()))
+}
+
+// Next is the first minute matching the expression after t, in the location of t,
+// or the zero time when none does in the next five years.
+func (e *Expression) Next(t time.Time) time.Time {
+	location := t.Location()
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		year, month, day := next.Date()
+		nextHour := next.Add(time.Duration(60-next.Minute()) * time.Minute)
+		switch {
+		case !e.month.has(int(month)):
+			next = later(time.Date(year, month+1, 1, 0, 0, 0, 0, location), nextHour)
+		case !e.dayMatches(next):
+			next = later(time.Date(year, month, day+1, 0, 0, 0, 0, location), nextHour)
+		case !e.hour.has(next.Hour()):
+			next = later(time.Date(year, month, day, next.Hour()+1, 0, 0, 0, location), nextHour)
+		case !e.minute.has(next.Minute()):
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// later moves on to fallback when candidate was skipped by a daylight saving change,
+// time.Date moving it back to before the current time.
+func later(candidate time.Time, fallback time.Time) time.Time {
+	if candidate.After(fallback) || candidate.Equal(fallback) {
+		return candidate
+	}
+	return fallback
+}
@@ -0,0 +1,126 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"30-10 * * * *",
+		"* * * foo *",
+		"@every",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"*/15 * * * *", at(2026, 1, 1, 10, 30), at(2026, 1, 1, 10, 45)},
+		{"10/20 * * * *", at(2026, 1, 1, 10, 30), at(2026, 1, 1, 10, 50)},
+		{"5-20/5 * * * *", at(2026, 1, 1, 10, 30), at(2026, 1, 1, 11, 5)},
+		{"30 10 * * *", at(2026, 1, 1, 10, 30), at(2026, 1, 2, 10, 30)},
+		{"30 10 * * *", time.Date(2026, 1, 1, 10, 29, 59, 0, time.UTC), at(2026, 1, 1, 10, 30)},
+		{"@hourly", at(2026, 1, 1, 10, 30), at(2026, 1, 1, 11, 0)},
+		{"@monthly", at(2026, 12, 15, 0, 0), at(2027, 1, 1, 0, 0)},
+		// 2026-01-02 is a Friday.
+		{"0 9 * * 1-5", at(2026, 1, 2, 10, 30), at(2026, 1, 5, 9, 0)},
+		{"0 9 * * mon-fri", at(2026, 1, 2, 10, 30), at(2026, 1, 5, 9, 0)},
+		{"0 0 * * 7", at(2026, 1, 1, 10, 30), at(2026, 1, 4, 0, 0)},
+		{"0 0 * * 5", at(2026, 1, 1, 10, 30), at(2026, 1, 2, 0, 0)},
+		{"0 0 13 * *", at(2026, 1, 1, 10, 30), at(2026, 1, 13, 0, 0)},
+		// Day of month and day of week both set match either of them.
+		{"0 0 13 * 5", at(2026, 1, 1, 10, 30), at(2026, 1, 2, 0, 0)},
+		{"0 0 13 * 5", at(2026, 1, 10, 0, 0), at(2026, 1, 13, 0, 0)},
+		{"0 0 13 * fri", at(2026, 1, 13, 0, 0), at(2026, 1, 16, 0, 0)},
+		// Day of month with * in day of week must match both.
+		{"0 0 1-7 * *", at(2026, 1, 7, 0, 0), at(2026, 2, 1, 0, 0)},
+		{"0 0 * * 1", at(2026, 1, 7, 0, 0), at(2026, 1, 12, 0, 0)},
+		{"30 4 1,15 * *", at(2026, 1, 15, 5, 0), at(2026, 2, 1, 4, 30)},
+		{"0 0 1 jan-mar/2 *", at(2026, 1, 2, 0, 0), at(2026, 3, 1, 0, 0)},
+		{"0 12 29 2 *", at(2026, 3, 1, 0, 0), at(2028, 2, 29, 12, 0)},
+		{"0 0 31 4 *", at(2026, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, test := range tests {
+		expression, err := Parse(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", test.spec, err)
+		}
+		if next := expression.Next(test.from); !next.Equal(test.expected) {
+			t.Errorf("%s after %v: expected %v, got %v", test.spec, test.from, test.expected, next)
+		}
+	}
+}
+
+func TestNextAcrossDaylightSavingChanges(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, location)
+	}
+	tests := []struct {
+		spec     string
+		from     time.Time
+		expected time.Time
+	}{
+		// 2:30 doesn't exist on March 8, clocks going from 2:00 to 3:00.
+		{"30 2 * * *", at(3, 8, 0, 0), at(3, 9, 2, 30)},
+		{"0 * * * *", at(3, 8, 1, 30), at(3, 8, 3, 0)},
+		{"0 12 * * *", at(3, 7, 13, 0), at(3, 8, 12, 0)},
+		// 1:00 to 2:00 happens twice on November 1.
+		{"30 1 * * *", at(11, 1, 0, 0), at(11, 1, 1, 30)},
+		{"0 12 * * *", at(10, 31, 13, 0), at(11, 1, 12, 0)},
+	}
+	for _, test := range tests {
+		expression, err := Parse(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", test.spec, err)
+		}
+		if next := expression.Next(test.from); !next.Equal(test.expected) {
+			t.Errorf("%s after %v: expected %v, got %v", test.spec, test.from, test.expected, next)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	expression, err := Parse("*/30 9-17 * * mon-fri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time    time.Time
+		matches bool
+	}{
+		{time.Date(2026, 1, 2, 9, 30, 45, 0, time.UTC), true},
+		{time.Date(2026, 1, 2, 9, 15, 0, 0, time.UTC), false},
+		{time.Date(2026, 1, 2, 18, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 1, 3, 10, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if matches := expression.Matches(test.time); matches != test.matches {
+			t.Errorf("%v: expected matches %t, got %t", test.time, test.matches, matches)
+		}
+	}
+}
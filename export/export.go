@@ -0,0 +1,93 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/n4d13/mongo_driver_test/journal"
+	"github.com/n4d13/mongo_driver_test/stage"
+)
+
+// Export formats of a finished stage.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+	FormatHTML  = "html"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown export format, use csv, jsonl or html")
+	ErrNoJournal     = errors.New("jsonl exports the records of the journal, the stage didn't keep one")
+)
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) (string, error) {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8", nil
+	case FormatJSONL:
+		return "application/x-ndjson", nil
+	case FormatHTML:
+		return "text/html; charset=utf-8", nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// Write exports result in format: the per-second timeline as CSV, the pool, command
+// and operation records of the journal at journalPath as JSON Lines, or a standalone
+// HTML report titled title.
+func Write(out io.Writer, format string, title string, result *stage.Result, journalPath string) error {
+	switch format {
+	case FormatCSV:
+		return TimelineCSV(out, result.Timeline)
+	case FormatJSONL:
+		if journalPath == "" {
+			return ErrNoJournal
+		}
+		return JournalJSONL(out, journalPath)
+	case FormatHTML:
+		return HTMLReport(out, title, result)
+	}
+	return ErrUnknownFormat
+}
+
+// TimelineCSV writes a row per window, violations are joined by semicolons.
+func TimelineCSV(out io.Writer, windows []stage.Window) error {
+	writer := csv.NewWriter(out)
+	_ = writer.Write([]string{"second", "duration_secs", "phase", "queries", "errors", "error_rate", "throughput", "p99_ms",
+		"pool_timeouts", "gets_failed", "peak_in_use", "violations"})
+	for _, window := range windows {
+		_ = writer.Write([]string{
+			strconv.Itoa(window.Second),
+			formatFloat(window.DurationSecs),
+			window.Phase,
+			strconv.FormatInt(window.Queries, 10),
+			strconv.FormatInt(window.Errors, 10),
+			formatFloat(window.ErrorRate),
+			formatFloat(window.Throughput),
+			formatFloat(window.P99Ms),
+			strconv.FormatInt(window.PoolTimeouts, 10),
+			strconv.FormatInt(window.GetsFailed, 10),
+			strconv.FormatInt(window.PeakInUse, 10),
+			strings.Join(window.Violations, "; "),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// JournalJSONL writes the records of the journal at path uncompressed, one per line.
+func JournalJSONL(out io.Writer, path string) error {
+	encoder := json.NewEncoder(out)
+	return journal.Read(path, func(record journal.Record) error {
+		return encoder.Encode(record)
+	})
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,175 @@
+package export
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/stage"
+)
+
+// series is a line of a chart, with a value per window.
+type series struct {
+	name   string
+	color  string
+	values []float64
+}
+
+const (
+	chartWidth   = 760
+	chartHeight  = 220
+	chartPadding = 40
+)
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(value float64) string { return fmt.Sprintf("%.2f%%", value*100) },
+	"decimal": func(value float64) string { return fmt.Sprintf("%.2f", value) },
+	"clock":   func(value time.Time) string { return value.Format("15:04:05.000") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+td, th { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th { background: #f2f2f2; }
+td.text { text-align: left; }
+.pass { color: #1a7f37; } .fail { color: #cf222e; }
+svg { display: block; margin-bottom: 1.5em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{with .Result}}
+<p>Started {{.Started.Format "2006-01-02 15:04:05 MST"}}, ran {{decimal .DurationSecs}} s{{if .Canceled}}, canceled{{end}}{{if .AbortReason}}, aborted: {{.AbortReason}}{{end}}.
+{{if .Verdict}}Verdict: <strong class="{{.Verdict}}">{{.Verdict}}</strong>{{end}}</p>
+{{if .Breaches}}<h2>Breaches</h2><ul>{{range .Breaches}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<h2>Summary</h2>
+<table>
+<tr><th>Queries</th><th>Errors</th><th>Error rate</th><th>Throughput</th><th>Min</th><th>Mean</th><th>P50</th><th>P90</th><th>P95</th><th>P99</th><th>Max</th></tr>
+<tr><td>{{.Queries}}</td><td>{{.Errors}}</td><td>{{percent .ErrorRate}}</td><td>{{decimal .Throughput}}/s</td>
+{{with .Latency}}<td>{{decimal .Min}} ms</td><td>{{decimal .Mean}} ms</td><td>{{decimal .P50}} ms</td><td>{{decimal .P90}} ms</td><td>{{decimal .P95}} ms</td><td>{{decimal .P99}} ms</td><td>{{decimal .Max}} ms</td>{{end}}</tr>
+</table>
+{{if .ErrorsByKind}}<table><tr><th>Error kind</th><th>Count</th></tr>{{range $kind, $count := .ErrorsByKind}}<tr><td class="text">{{$kind}}</td><td>{{$count}}</td></tr>{{end}}</table>{{end}}
+<h2>Pool</h2>
+{{with .Pool}}<table>
+<tr><th>Created</th><th>Closed</th><th>In use</th><th>Peak in use</th><th>Gets ok</th><th>Gets failed</th></tr>
+<tr><td>{{.Created}}</td><td>{{.Closed}}</td><td>{{.InUse}}</td><td>{{.PeakInUse}}</td><td>{{.GetsOK}}</td><td>{{.GetsFailed}}</td></tr>
+</table>
+{{if .Reasons}}<table><tr><th>Failure reason</th><th>Count</th></tr>{{range $reason, $count := .Reasons}}<tr><td class="text">{{$reason}}</td><td>{{$count}}</td></tr>{{end}}</table>{{end}}{{end}}
+{{if .Phases}}<h2>Phases</h2>
+<table>
+<tr><th>Phase</th><th>Seconds</th><th>Queries</th><th>Error rate</th><th>Throughput</th><th>P99</th><th>Pool timeouts</th><th>Peak in use</th></tr>
+{{range .Phases}}<tr><td class="text">{{.Name}}</td><td>{{.FromSecond}}-{{.ToSecond}}</td><td>{{.Queries}}</td><td>{{percent .ErrorRate}}</td><td>{{decimal .Throughput}}/s</td><td>{{decimal .Latency.P99}} ms</td><td>{{.PoolTimeouts}}</td><td>{{.PeakInUse}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{if .Charts}}<h2>Timeline</h2>{{range .Charts}}{{.}}{{end}}{{end}}
+{{with .Result.Events}}<h2>Events</h2>
+<table>{{range .}}<tr><td>{{clock .Time}}</td><td class="text">{{.Message}}</td></tr>{{end}}</table>{{end}}
+</body>
+</html>
+`))
+
+// HTMLReport writes a single file report, its charts are inline SVG so it can be
+// shared without any other file.
+func HTMLReport(out io.Writer, title string, result *stage.Result) error {
+	var charts []template.HTML
+	if len(result.Timeline) > 0 {
+		charts = timelineCharts(result.Timeline)
+	}
+	return reportTemplate.Execute(out, struct {
+		Title  string
+		Result *stage.Result
+		Charts []template.HTML
+	}{title, result, charts})
+}
+
+func timelineCharts(windows []stage.Window) []template.HTML {
+	values := func(value func(stage.Window) float64) []float64 {
+		series := make([]float64, len(windows))
+		for i, window := range windows {
+			series[i] = value(window)
+		}
+		return series
+	}
+	return []template.HTML{
+		chart("Latency p99 (ms)", windows, []series{
+			{"p99", "#0969da", values(func(w stage.Window) float64 { return w.P99Ms })},
+		}),
+		chart("Queries and errors per second", windows, []series{
+			{"queries", "#1a7f37", values(func(w stage.Window) float64 { return float64(w.Queries) })},
+			{"errors", "#cf222e", values(func(w stage.Window) float64 { return float64(w.Errors) })},
+		}),
+		chart("Pool", windows, []series{
+			{"peak in use", "#8250df", values(func(w stage.Window) float64 { return float64(w.PeakInUse) })},
+			{"gets failed", "#cf222e", values(func(w stage.Window) float64 { return float64(w.GetsFailed) })},
+			{"pool timeouts", "#bf8700", values(func(w stage.Window) float64 { return float64(w.PoolTimeouts) })},
+		}),
+	}
+}
+
+// chart draws the series as lines over the windows, shading the ones breaking a
+// threshold.
+func chart(title string, windows []stage.Window, lines []series) template.HTML {
+	max := 0.0
+	for _, line := range lines {
+		for _, value := range line.values {
+			if value > max {
+				max = value
+			}
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	plotWidth := float64(chartWidth - 2*chartPadding)
+	plotHeight := float64(chartHeight - 2*chartPadding)
+	step := plotWidth
+	if len(windows) > 1 {
+		step = plotWidth / float64(len(windows)-1)
+	}
+	x := func(i int) float64 { return chartPadding + float64(i)*step }
+	y := func(value float64) float64 { return chartPadding + plotHeight - value/max*plotHeight }
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="11">`,
+		chartWidth, chartHeight)
+	fmt.Fprintf(&svg, `<text x="%d" y="16" font-size="13" font-weight="bold">%s</text>`,
+		chartPadding, template.HTMLEscapeString(title))
+	for i, window := range windows {
+		if len(window.Violations) > 0 {
+			left := math.Max(x(i)-step/2, chartPadding)
+			right := math.Min(x(i)+step/2, chartWidth-chartPadding)
+			fmt.Fprintf(&svg, `<rect x="%.1f" y="%d" width="%.1f" height="%.0f" fill="#ffebe9"><title>%s</title></rect>`,
+				left, chartPadding, right-left, plotHeight,
+				template.HTMLEscapeString(strings.Join(window.Violations, "; ")))
+		}
+	}
+	fmt.Fprintf(&svg, `<line x1="%d" y1="%.0f" x2="%d" y2="%.0f" stroke="#999"/>`,
+		chartPadding, y(0), chartWidth-chartPadding, y(0))
+	fmt.Fprintf(&svg, `<line x1="%d" y1="%d" x2="%d" y2="%.0f" stroke="#999"/>`,
+		chartPadding, chartPadding, chartPadding, y(0))
+	fmt.Fprintf(&svg, `<text x="%d" y="%d" text-anchor="end">%.4g</text>`, chartPadding-4, chartPadding+4, max)
+	fmt.Fprintf(&svg, `<text x="%d" y="%.0f" text-anchor="end">0</text>`, chartPadding-4, y(0)+4)
+	fmt.Fprintf(&svg, `<text x="%d" y="%.0f">%ds</text>`, chartPadding, y(0)+16, windows[0].Second)
+	fmt.Fprintf(&svg, `<text x="%d" y="%.0f" text-anchor="end">%ds</text>`,
+		chartWidth-chartPadding, y(0)+16, windows[len(windows)-1].Second)
+
+	for i, line := range lines {
+		points := make([]string, len(line.values))
+		for j, value := range line.values {
+			points[j] = fmt.Sprintf("%.1f,%.1f", x(j), y(value))
+		}
+		fmt.Fprintf(&svg, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`,
+			line.color, strings.Join(points, " "))
+		fmt.Fprintf(&svg, `<text x="%d" y="%d" fill="%s">%s</text>`,
+			chartPadding+i*110, chartHeight-6, line.color, template.HTMLEscapeString(line.name))
+	}
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
@@ -0,0 +1,499 @@
+package fakemongo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const (
+	internalErrorCode     = 1
+	badValueCode          = 2
+	namespaceNotFoundCode = 26
+	cursorNotFoundCode    = 43
+	commandNotFoundCode   = 59
+	duplicateKeyCode      = 11000
+)
+
+const (
+	defaultFirstBatchSize = 101
+	maxBatchBytes         = 16 * 1024 * 1024
+	maxWireVersion        = 8
+	maxBsonObjectSize     = 16 * 1024 * 1024
+	maxWriteBatchSize     = 100000
+)
+
+// operations are the commands affected by the configured latency and errors.
+var operations = map[string]struct{}{
+	"find":          {},
+	"getmore":       {},
+	"insert":        {},
+	"count":         {},
+	"update":        {},
+	"aggregate":     {},
+	"listindexes":   {},
+	"createindexes": {},
+	"drop":          {},
+	"killcursors":   {},
+}
+
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
+	if name == "hello" {
+		return "ismaster"
+	}
+	return name
+}
+
+func (s *Server) run(cmd *command, connectionId int32) bson.D {
+	switch cmd.name {
+	case "ismaster":
+		return bson.D{
+			{Key: "ismaster", Value: true},
+			{Key: "maxBsonObjectSize", Value: int32(maxBsonObjectSize)},
+			{Key: "maxMessageSizeBytes", Value: int32(maxMessageSize)},
+			{Key: "maxWriteBatchSize", Value: int32(maxWriteBatchSize)},
+			{Key: "localTime", Value: time.Now()},
+			{Key: "connectionId", Value: connectionId},
+			{Key: "minWireVersion", Value: int32(0)},
+			{Key: "maxWireVersion", Value: int32(maxWireVersion)},
+			{Key: "readOnly", Value: false},
+			{Key: "ok", Value: 1.0},
+		}
+	case "ping", "endsessions", "buildinfo":
+		return ok()
+	case "configurefailpoint":
+		return s.runConfigureFailPoint(cmd)
+	case "find":
+		return s.runFind(cmd)
+	case "getmore":
+		return s.runGetMore(cmd)
+	case "killcursors":
+		return s.runKillCursors(cmd)
+	case "insert":
+		return s.runInsert(cmd)
+	case "count":
+		return s.runCount(cmd)
+	case "update":
+		return s.runUpdate(cmd)
+	case "aggregate":
+		return s.runAggregate(cmd)
+	case "listindexes":
+		return s.runListIndexes(cmd)
+	case "createindexes":
+		return s.runCreateIndexes(cmd)
+	case "drop":
+		if !s.storage.drop(cmd.namespace()) {
+			return commandError(namespaceNotFoundCode, "ns not found")
+		}
+		return append(bson.D{{Key: "ns", Value: cmd.namespace()}}, ok()...)
+	}
+	return commandError(commandNotFoundCode, fmt.Sprintf("no such command: '%s'", cmd.name))
+}
+
+func (c *command) namespace() string {
+	collection, _ := c.body.Index(0).Value().StringValueOK()
+	return c.db + "." + collection
+}
+
+func (c *command) int64Value(key string) int64 {
+	value, err := c.body.LookupErr(key)
+	if err != nil {
+		return 0
+	}
+	number, _ := asNumber(value)
+	return int64(number)
+}
+
+func (c *command) document(key string) bson.Raw {
+	if doc, ok := c.body.Lookup(key).DocumentOK(); ok {
+		return doc
+	}
+	return emptyDocument()
+}
+
+func emptyDocument() bson.Raw {
+	empty, _ := bson.Marshal(bson.D{})
+	return empty
+}
+
+func ok() bson.D {
+	return bson.D{{Key: "ok", Value: 1.0}}
+}
+
+func commandError(code int32, message string) bson.D {
+	return bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: message},
+		{Key: "code", Value: code},
+	}
+}
+
+func cursorReply(id int64, ns string, batchName string, batch []bson.Raw) bson.D {
+	if batch == nil {
+		batch = []bson.Raw{}
+	}
+	return append(bson.D{{Key: "cursor", Value: bson.D{
+		{Key: batchName, Value: batch},
+		{Key: "id", Value: id},
+		{Key: "ns", Value: ns},
+	}}}, ok()...)
+}
+
+func (s *Server) runFind(cmd *command) bson.D {
+	docs, err := s.storage.find(cmd.namespace(), cmd.document("filter"))
+	if err != nil {
+		return commandError(badValueCode, err.Error())
+	}
+
+	if skip := cmd.int64Value("skip"); skip > 0 {
+		if skip > int64(len(docs)) {
+			skip = int64(len(docs))
+		}
+		docs = docs[skip:]
+	}
+	limit := cmd.int64Value("limit")
+	singleBatch := isTrue(cmd.body.Lookup("singleBatch"))
+	if limit < 0 {
+		limit = -limit
+		singleBatch = true
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+
+	projection := cmd.document("projection")
+	projected := make([]bson.Raw, 0, len(docs))
+	for _, doc := range docs {
+		projected = append(projected, project(doc, projection))
+	}
+
+	batchSize := int(cmd.int64Value("batchSize"))
+	if batchSize <= 0 {
+		batchSize = defaultFirstBatchSize
+	}
+	return s.cursors.open(cmd.namespace(), projected, batchSize, singleBatch)
+}
+
+func (s *Server) runGetMore(cmd *command) bson.D {
+	id := cmd.int64Value("getMore")
+	collection, _ := cmd.body.Lookup("collection").StringValueOK()
+	return s.cursors.next(id, cmd.db+"."+collection, int(cmd.int64Value("batchSize")))
+}
+
+func (s *Server) runKillCursors(cmd *command) bson.D {
+	values, _ := arrayValues(cmd.body.Lookup("cursors"))
+	killed := bson.A{}
+	for _, value := range values {
+		id, _ := asNumber(value)
+		if s.cursors.kill(int64(id)) {
+			killed = append(killed, int64(id))
+		}
+	}
+	return append(bson.D{
+		{Key: "cursorsKilled", Value: killed},
+		{Key: "cursorsNotFound", Value: bson.A{}},
+	}, ok()...)
+}
+
+func (s *Server) runInsert(cmd *command) bson.D {
+	ordered := true
+	if value := cmd.body.Lookup("ordered"); value.Type == bsontype.Boolean {
+		ordered = value.Boolean()
+	}
+	inserted, errs := s.storage.insert(cmd.namespace(), cmd.documents("documents"), ordered)
+
+	reply := bson.D{{Key: "n", Value: int32(inserted)}}
+	if len(errs) > 0 {
+		writeErrors := bson.A{}
+		for _, err := range errs {
+			writeErrors = append(writeErrors, bson.D{
+				{Key: "index", Value: int32(err.index)},
+				{Key: "code", Value: err.code},
+				{Key: "errmsg", Value: err.message},
+			})
+		}
+		reply = append(reply, bson.E{Key: "writeErrors", Value: writeErrors})
+	}
+	return append(reply, ok()...)
+}
+
+func (s *Server) runCount(cmd *command) bson.D {
+	docs, err := s.storage.find(cmd.namespace(), cmd.document("query"))
+	if err != nil {
+		return commandError(badValueCode, err.Error())
+	}
+	return append(bson.D{{Key: "n", Value: int32(len(docs))}}, ok()...)
+}
+
+// runUpdate only counts the documents matched by every statement, it never changes
+// them.
+func (s *Server) runUpdate(cmd *command) bson.D {
+	var matched int32
+	for _, statement := range cmd.documents("updates") {
+		filter, _ := statement.Lookup("q").DocumentOK()
+		if filter == nil {
+			filter = emptyDocument()
+		}
+		docs, err := s.storage.find(cmd.namespace(), filter)
+		if err != nil {
+			return commandError(badValueCode, err.Error())
+		}
+		if len(docs) > 0 && !isTrue(statement.Lookup("multi")) {
+			docs = docs[:1]
+		}
+		matched += int32(len(docs))
+	}
+	return append(bson.D{{Key: "n", Value: matched}, {Key: "nModified", Value: int32(0)}}, ok()...)
+}
+
+func (s *Server) runListIndexes(cmd *command) bson.D {
+	indexes, found := s.storage.listIndexes(cmd.namespace())
+	if !found {
+		return commandError(namespaceNotFoundCode, "ns does not exist: "+cmd.namespace())
+	}
+	return cursorReply(0, cmd.namespace(), "firstBatch", indexes)
+}
+
+func (s *Server) runCreateIndexes(cmd *command) bson.D {
+	var before, after int
+	var created bool
+	for _, spec := range cmd.documents("indexes") {
+		name, _ := spec.Lookup("name").StringValueOK()
+		key, _ := spec.Lookup("key").DocumentOK()
+		unique := isTrue(spec.Lookup("unique"))
+
+		var err error
+		var indexBefore int
+		var collectionCreated bool
+		indexBefore, after, collectionCreated, err = s.storage.createIndex(cmd.namespace(), name, key, unique)
+		if err != nil {
+			return commandError(badValueCode, err.Error())
+		}
+		if before == 0 {
+			before = indexBefore
+		}
+		created = created || collectionCreated
+	}
+	return append(bson.D{
+		{Key: "createdCollectionAutomatically", Value: created},
+		{Key: "numIndexesBefore", Value: int32(before)},
+		{Key: "numIndexesAfter", Value: int32(after)},
+	}, ok()...)
+}
+
+func (s *Server) runAggregate(cmd *command) bson.D {
+	stages := arrayDocuments(cmd.body.Lookup("pipeline"))
+	filter := emptyDocument()
+	if len(stages) > 0 {
+		if match, ok := stages[0].Lookup("$match").DocumentOK(); ok {
+			filter = match
+			stages = stages[1:]
+		}
+	}
+	docs, err := s.storage.find(cmd.namespace(), filter)
+	if err != nil {
+		return commandError(badValueCode, err.Error())
+	}
+
+	for _, stage := range stages {
+		docs, err = s.aggregateStage(stage, docs)
+		if err != nil {
+			return commandError(badValueCode, err.Error())
+		}
+	}
+
+	cursorBatchSize, _ := asNumber(cmd.document("cursor").Lookup("batchSize"))
+	batchSize := int(cursorBatchSize)
+	if batchSize <= 0 {
+		batchSize = defaultFirstBatchSize
+	}
+	return s.cursors.open(cmd.namespace(), docs, batchSize, false)
+}
+
+func (s *Server) aggregateStage(stage bson.Raw, docs []bson.Raw) ([]bson.Raw, error) {
+	element := stage.Index(0)
+	value := element.Value()
+	if element.Key() == "$skip" || element.Key() == "$limit" {
+		return slice(element.Key(), value, docs)
+	}
+	if element.Key() == "$count" {
+		field, ok := value.StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("$count needs a field name")
+		}
+		doc, _ := bson.Marshal(bson.D{{Key: field, Value: int32(len(docs))}})
+		return []bson.Raw{doc}, nil
+	}
+
+	spec, err := documentValue(value)
+	if err != nil {
+		return nil, err
+	}
+	switch element.Key() {
+	case "$match":
+		var result []bson.Raw
+		for _, doc := range docs {
+			matched, err := matches(doc, spec)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				result = append(result, doc)
+			}
+		}
+		return result, nil
+	case "$sample":
+		size, _ := asNumber(spec.Lookup("size"))
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.storage.sample(docs, int(size), s.random), nil
+	case "$project":
+		result := make([]bson.Raw, 0, len(docs))
+		for _, doc := range docs {
+			result = append(result, project(doc, spec))
+		}
+		return result, nil
+	case "$group":
+		return group(spec, docs)
+	case "$sort":
+		return sortDocuments(spec, docs), nil
+	}
+	return nil, fmt.Errorf("unsupported aggregation stage %s", element.Key())
+}
+
+// sortDocuments orders docs by the fields of spec, 1 ascending and -1 descending.
+// Values of different types keep their order.
+func sortDocuments(spec bson.Raw, docs []bson.Raw) []bson.Raw {
+	elements, _ := spec.Elements()
+	sorted := append([]bson.Raw(nil), docs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, element := range elements {
+			cmp, _ := compare(sorted[i].Lookup(element.Key()), sorted[j].Lookup(element.Key()))
+			if cmp != 0 {
+				direction, _ := asNumber(element.Value())
+				return cmp < 0 == (direction >= 0)
+			}
+		}
+		return false
+	})
+	return sorted
+}
+
+func slice(stage string, value bson.RawValue, docs []bson.Raw) ([]bson.Raw, error) {
+	amount, ok := asNumber(value)
+	if !ok || amount < 0 {
+		return nil, fmt.Errorf("%s needs a positive number", stage)
+	}
+	n := int(amount)
+	if n > len(docs) {
+		n = len(docs)
+	}
+	if stage == "$skip" {
+		return docs[n:], nil
+	}
+	return docs[:n], nil
+}
+
+// group only supports constant group ids with $sum accumulators, as used to count documents.
+func group(spec bson.Raw, docs []bson.Raw) ([]bson.Raw, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	elements, _ := spec.Elements()
+	result := bson.D{}
+	for _, element := range elements {
+		if element.Key() == "_id" {
+			if id, ok := element.Value().StringValueOK(); ok && strings.HasPrefix(id, "$") {
+				return nil, fmt.Errorf("only constant group ids are supported")
+			}
+			result = append(result, bson.E{Key: "_id", Value: element.Value()})
+			continue
+		}
+		accumulator, ok := element.Value().DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("invalid accumulator for %s", element.Key())
+		}
+		amount, ok := asNumber(accumulator.Lookup("$sum"))
+		if !ok {
+			return nil, fmt.Errorf("only constant $sum accumulators are supported")
+		}
+		result = append(result, bson.E{Key: element.Key(), Value: int32(amount * float64(len(docs)))})
+	}
+	doc, err := bson.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return []bson.Raw{doc}, nil
+}
+
+type cursors struct {
+	mutex   sync.Mutex
+	lastId  int64
+	batches map[int64][]bson.Raw
+}
+
+func newCursors() *cursors {
+	return &cursors{
+		batches: make(map[int64][]bson.Raw),
+	}
+}
+
+// open returns the first batch of docs, keeping the rest for getMore.
+func (c *cursors) open(ns string, docs []bson.Raw, batchSize int, singleBatch bool) bson.D {
+	batch, rest := splitBatch(docs, batchSize)
+	if singleBatch || len(rest) == 0 {
+		return cursorReply(0, ns, "firstBatch", batch)
+	}
+	c.mutex.Lock()
+	c.lastId++
+	id := c.lastId
+	c.batches[id] = rest
+	c.mutex.Unlock()
+	return cursorReply(id, ns, "firstBatch", batch)
+}
+
+func (c *cursors) next(id int64, ns string, batchSize int) bson.D {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	docs, found := c.batches[id]
+	if !found {
+		return commandError(cursorNotFoundCode, fmt.Sprintf("cursor id %d not found", id))
+	}
+	if batchSize <= 0 {
+		batchSize = len(docs)
+	}
+	batch, rest := splitBatch(docs, batchSize)
+	if len(rest) == 0 {
+		delete(c.batches, id)
+		id = 0
+	} else {
+		c.batches[id] = rest
+	}
+	return cursorReply(id, ns, "nextBatch", batch)
+}
+
+func (c *cursors) kill(id int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, found := c.batches[id]
+	delete(c.batches, id)
+	return found
+}
+
+// splitBatch takes up to batchSize docs without going over the maximum batch bytes.
+func splitBatch(docs []bson.Raw, batchSize int) ([]bson.Raw, []bson.Raw) {
+	size := 0
+	for i, doc := range docs {
+		size += len(doc)
+		if i >= batchSize || (i > 0 && size > maxBatchBytes) {
+			return docs[:i], docs[i:]
+		}
+	}
+	return docs, nil
+}
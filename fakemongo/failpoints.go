@@ -0,0 +1,112 @@
+package fakemongo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const failCommandName = "failCommand"
+
+var errCloseConnection = errors.New("connection closed by fail point")
+
+// failCommand mimics mongod's failCommand fail point: it supports the alwaysOn,
+// off, times and activationProbability modes with the failCommands, errorCode,
+// closeConnection, blockConnection and blockTimeMS data fields.
+type failCommand struct {
+	mutex           sync.Mutex
+	enabled         bool
+	times           int64
+	probability     float64
+	commands        map[string]struct{}
+	errorCode       int32
+	closeConnection bool
+	blockTime       time.Duration
+}
+
+func (f *failCommand) configure(cmd *command) bson.D {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	mode := cmd.body.Lookup("mode")
+	f.enabled, f.times, f.probability = true, -1, 1
+	if name, ok := mode.StringValueOK(); ok {
+		switch name {
+		case "alwaysOn":
+		case "off":
+			f.enabled = false
+		default:
+			return commandError(badValueCode, "unknown fail point mode: "+name)
+		}
+	} else if doc, ok := mode.DocumentOK(); ok {
+		if times, ok := asNumber(doc.Lookup("times")); ok {
+			f.times = int64(times)
+		}
+		if probability, ok := asNumber(doc.Lookup("activationProbability")); ok {
+			f.probability = probability
+		}
+	} else {
+		return commandError(badValueCode, "fail point mode is required")
+	}
+
+	data := cmd.document("data")
+	f.commands = make(map[string]struct{})
+	values, _ := arrayValues(data.Lookup("failCommands"))
+	for _, value := range values {
+		if name, ok := value.StringValueOK(); ok {
+			f.commands[normalizeName(name)] = struct{}{}
+		}
+	}
+	errorCode, _ := asNumber(data.Lookup("errorCode"))
+	f.errorCode = int32(errorCode)
+	f.closeConnection = isTrue(data.Lookup("closeConnection"))
+	f.blockTime = 0
+	if isTrue(data.Lookup("blockConnection")) {
+		blockTime, _ := asNumber(data.Lookup("blockTimeMS"))
+		f.blockTime = time.Duration(blockTime) * time.Millisecond
+	}
+	return ok()
+}
+
+// apply returns the reply for a command caught by the fail point, or nil to run it.
+// roll is a random number between 0 and 1 compared with the activation probability.
+func (f *failCommand) apply(name string, roll float64) (bson.D, error) {
+	f.mutex.Lock()
+	_, listed := f.commands[name]
+	if !f.enabled || !listed || f.times == 0 || roll >= f.probability {
+		f.mutex.Unlock()
+		return nil, nil
+	}
+	if f.times > 0 {
+		f.times--
+	}
+	blockTime, closeConnection, errorCode := f.blockTime, f.closeConnection, f.errorCode
+	f.mutex.Unlock()
+
+	if blockTime > 0 {
+		time.Sleep(blockTime)
+	}
+	if closeConnection {
+		return nil, errCloseConnection
+	}
+	if errorCode != 0 {
+		return commandError(errorCode, "Failing command via 'failCommand' failpoint"), nil
+	}
+	return nil, nil
+}
+
+func (s *Server) runConfigureFailPoint(cmd *command) bson.D {
+	name, _ := cmd.body.Lookup("configureFailPoint").StringValueOK()
+	if !strings.EqualFold(name, failCommandName) {
+		return commandError(badValueCode, "unknown fail point: "+name)
+	}
+	return s.failCommand.configure(cmd)
+}
+
+func isTrue(value bson.RawValue) bool {
+	return value.Type == bsontype.Boolean && value.Boolean()
+}
@@ -0,0 +1,365 @@
+package fakemongo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/wiremessage"
+)
+
+const maxMessageSize = 48000000
+
+// Options controls how the server misbehaves. Latency, jitter and errors only
+// affect operations, handshake and ping commands are always answered immediately.
+type Options struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the fraction of operations, between 0 and 1, answered with ErrorCode.
+	ErrorRate float64
+	ErrorCode int32
+}
+
+// Server is an in-memory MongoDB speaking enough of the wire protocol for the
+// repositories to run against it.
+type Server struct {
+	listener     net.Listener
+	storage      *storage
+	cursors      *cursors
+	mutex        sync.Mutex
+	options      Options
+	random       *rand.Rand
+	connectionId int32
+	connections  map[net.Conn]struct{}
+	failCommand  failCommand
+	wg           sync.WaitGroup
+}
+
+func NewServer(options Options) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{
+		listener:    listener,
+		storage:     newStorage(),
+		cursors:     newCursors(),
+		options:     options,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		connections: make(map[net.Conn]struct{}),
+	}
+	server.wg.Add(1)
+	go server.accept()
+
+	logrus.Infof("Fake MongoDB server listening on %s", server.Addr())
+	return server, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// ConnString returns a connection string pointing to the server.
+func (s *Server) ConnString(dbName string) string {
+	return fmt.Sprintf("mongodb://%s/%s?connect=direct", s.Addr(), dbName)
+}
+
+func (s *Server) SetOptions(options Options) {
+	s.mutex.Lock()
+	s.options = options
+	s.mutex.Unlock()
+}
+
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.connections {
+		_ = conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.connections[conn] = struct{}{}
+		s.connectionId++
+		connectionId := s.connectionId
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn, connectionId)
+	}
+}
+
+func (s *Server) serve(conn net.Conn, connectionId int32) {
+	defer s.wg.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			logrus.Errorf("Fake MongoDB connection %d failed: %v", connectionId, err)
+		}
+		s.mutex.Lock()
+		delete(s.connections, conn)
+		s.mutex.Unlock()
+		_ = conn.Close()
+	}()
+
+	for {
+		message, err := readMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				logrus.Debugf("Fake MongoDB connection %d finished: %v", connectionId, err)
+			}
+			return
+		}
+		reply, err := s.handle(message, connectionId)
+		if err == errCloseConnection {
+			return
+		}
+		if err != nil {
+			logrus.Warnf("Fake MongoDB can't handle message: %v", err)
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		if _, err = conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func readMessage(conn net.Conn) ([]byte, error) {
+	var sizeBytes [4]byte
+	if _, err := io.ReadFull(conn, sizeBytes[:]); err != nil {
+		return nil, err
+	}
+	size := int32(binary.LittleEndian.Uint32(sizeBytes[:]))
+	if size < 16 || size > maxMessageSize {
+		return nil, fmt.Errorf("invalid message size %d", size)
+	}
+	message := make([]byte, size)
+	copy(message, sizeBytes[:])
+	if _, err := io.ReadFull(conn, message[4:]); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (s *Server) handle(message []byte, connectionId int32) ([]byte, error) {
+	_, requestId, _, opCode, rem, ok := wiremessage.ReadHeader(message)
+	if !ok {
+		return nil, errors.New("malformed header")
+	}
+
+	switch opCode {
+	case wiremessage.OpQuery:
+		cmd, err := parseQuery(rem)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := s.execute(cmd, connectionId)
+		if err != nil {
+			return nil, err
+		}
+		return replyQuery(requestId, reply), nil
+	case wiremessage.OpMsg:
+		cmd, moreToCome, err := parseMsg(rem)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := s.execute(cmd, connectionId)
+		if err != nil {
+			return nil, err
+		}
+		if moreToCome {
+			return nil, nil
+		}
+		return replyMsg(requestId, reply), nil
+	}
+	return nil, fmt.Errorf("unsupported op code %v", opCode)
+}
+
+// execute runs cmd applying the configured latency, errors and fail points.
+func (s *Server) execute(cmd *command, connectionId int32) (bson.D, error) {
+	if _, ok := operations[cmd.name]; ok {
+		s.mutex.Lock()
+		options := s.options
+		delay := options.Latency
+		if options.Jitter > 0 {
+			delay += time.Duration(s.random.Int63n(int64(2*options.Jitter+1))) - options.Jitter
+		}
+		failed := options.ErrorRate > 0 && s.random.Float64() < options.ErrorRate
+		failPointRoll := s.random.Float64()
+		s.mutex.Unlock()
+
+		if reply, err := s.failCommand.apply(cmd.name, failPointRoll); reply != nil || err != nil {
+			return reply, err
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		if failed {
+			code := options.ErrorCode
+			if code == 0 {
+				code = internalErrorCode
+			}
+			return commandError(code, "error injected by fake server"), nil
+		}
+	}
+	return s.run(cmd, connectionId), nil
+}
+
+// command is a decoded OP_QUERY or OP_MSG command, with the OP_MSG document
+// sequences kept apart from the body.
+type command struct {
+	name      string
+	db        string
+	body      bson.Raw
+	sequences map[string][]bson.Raw
+}
+
+func (c *command) documents(identifier string) []bson.Raw {
+	if docs, ok := c.sequences[identifier]; ok {
+		return docs
+	}
+	return arrayDocuments(c.body.Lookup(identifier))
+}
+
+func newCommand(body bson.Raw, db string) (*command, error) {
+	elements, err := body.Elements()
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 {
+		return nil, errors.New("empty command")
+	}
+	if dbValue, ok := body.Lookup("$db").StringValueOK(); ok {
+		db = dbValue
+	}
+	return &command{
+		name:      normalizeName(elements[0].Key()),
+		db:        db,
+		body:      body,
+		sequences: make(map[string][]bson.Raw),
+	}, nil
+}
+
+func parseQuery(src []byte) (*command, error) {
+	_, rem, ok := wiremessage.ReadQueryFlags(src)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY flags")
+	}
+	collection, rem, ok := wiremessage.ReadQueryFullCollectionName(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY collection name")
+	}
+	if _, rem, ok = wiremessage.ReadQueryNumberToSkip(rem); !ok {
+		return nil, errors.New("malformed OP_QUERY number to skip")
+	}
+	if _, rem, ok = wiremessage.ReadQueryNumberToReturn(rem); !ok {
+		return nil, errors.New("malformed OP_QUERY number to return")
+	}
+	query, _, ok := wiremessage.ReadQueryQuery(rem)
+	if !ok {
+		return nil, errors.New("malformed OP_QUERY query")
+	}
+
+	body := bson.Raw(query)
+	if wrapped, ok := body.Lookup("$query").DocumentOK(); ok {
+		body = wrapped
+	}
+	db := collection
+	for i := range collection {
+		if collection[i] == '.' {
+			db = collection[:i]
+			break
+		}
+	}
+	return newCommand(body, db)
+}
+
+func parseMsg(src []byte) (*command, bool, error) {
+	flags, rem, ok := wiremessage.ReadMsgFlags(src)
+	if !ok {
+		return nil, false, errors.New("malformed OP_MSG flags")
+	}
+	if flags&wiremessage.ChecksumPresent != 0 {
+		rem = rem[:len(rem)-4]
+	}
+
+	var body bson.Raw
+	sequences := make(map[string][]bson.Raw)
+	for len(rem) > 0 {
+		var sectionType wiremessage.SectionType
+		sectionType, rem, ok = wiremessage.ReadMsgSectionType(rem)
+		if !ok {
+			return nil, false, errors.New("malformed OP_MSG section")
+		}
+		switch sectionType {
+		case wiremessage.SingleDocument:
+			var doc bsoncore.Document
+			doc, rem, ok = wiremessage.ReadMsgSectionSingleDocument(rem)
+			if !ok {
+				return nil, false, errors.New("malformed OP_MSG body")
+			}
+			body = bson.Raw(doc)
+		case wiremessage.DocumentSequence:
+			var identifier string
+			var docs []bsoncore.Document
+			identifier, docs, rem, ok = wiremessage.ReadMsgSectionDocumentSequence(rem)
+			if !ok {
+				return nil, false, errors.New("malformed OP_MSG document sequence")
+			}
+			for _, doc := range docs {
+				sequences[identifier] = append(sequences[identifier], bson.Raw(doc))
+			}
+		default:
+			return nil, false, fmt.Errorf("unknown OP_MSG section type %d", sectionType)
+		}
+	}
+	if body == nil {
+		return nil, false, errors.New("OP_MSG without body")
+	}
+
+	cmd, err := newCommand(body, "")
+	if err != nil {
+		return nil, false, err
+	}
+	cmd.sequences = sequences
+	return cmd, flags&wiremessage.MoreToCome != 0, nil
+}
+
+func replyQuery(responseTo int32, reply bson.D) []byte {
+	doc, _ := bson.Marshal(reply)
+	index, dst := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), responseTo, wiremessage.OpReply)
+	dst = wiremessage.AppendReplyFlags(dst, 0)
+	dst = wiremessage.AppendReplyCursorID(dst, 0)
+	dst = wiremessage.AppendReplyStartingFrom(dst, 0)
+	dst = wiremessage.AppendReplyNumberReturned(dst, 1)
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, index, int32(len(dst[index:])))
+}
+
+func replyMsg(responseTo int32, reply bson.D) []byte {
+	doc, _ := bson.Marshal(reply)
+	index, dst := wiremessage.AppendHeaderStart(nil, wiremessage.NextRequestID(), responseTo, wiremessage.OpMsg)
+	dst = wiremessage.AppendMsgFlags(dst, 0)
+	dst = wiremessage.AppendMsgSectionType(dst, wiremessage.SingleDocument)
+	dst = append(dst, doc...)
+	return bsoncore.UpdateLength(dst, index, int32(len(dst[index:])))
+}
@@ -0,0 +1,177 @@
+package fakemongo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/fakemongo"
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func newRepository(t *testing.T, server *fakemongo.Server) (repositories.TestRepository, *repositories.MongoDBConfiguration) {
+	t.Helper()
+	config := &repositories.MongoDBConfiguration{
+		DbName:         "stores",
+		CollectionName: "stores",
+		ConnString:     server.ConnString("stores"),
+		MaxPool:        4,
+		SocketTimeout:  2 * time.Second,
+	}
+	repo, err := repositories.NewMongodbRepository(config, func(*event.PoolEvent) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close(context.Background()) })
+	return repo, config
+}
+
+func TestDriverRoundTrip(t *testing.T) {
+	server, err := fakemongo.NewServer(fakemongo.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	repo, _ := newRepository(t, server)
+	ctx := context.Background()
+
+	stores := make([]repositories.Store, 250)
+	ids := make([]string, len(stores))
+	for i := range stores {
+		// Inserted in reverse alphabetical order to tell both orders apart.
+		ids[i] = fmt.Sprintf("store-%03d", len(stores)-i)
+		stores[i] = repositories.Store{StoreId: ids[i], Name: fmt.Sprintf("name %d", i)}
+	}
+	info, err := repo.Insert(ctx, stores, repositories.InsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Docs != len(stores) {
+		t.Errorf("expected %d inserted docs, got %d", len(stores), info.Docs)
+	}
+
+	count, err := repo.Count(ctx)
+	if err != nil || count != int64(len(stores)) {
+		t.Errorf("expected a count of %d, got %d: %v", len(stores), count, err)
+	}
+
+	// A small cursor batch size makes the driver send getMore commands.
+	queried := append(append([]string(nil), ids[:150]...), "missing")
+	result, err := repo.GetStores(ctx, queried, repositories.QueryOptions{CursorBatchSize: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Docs != 150 || len(result.Stores) != 150 {
+		t.Errorf("expected 150 stores, got %d", result.Docs)
+	}
+	found := make(map[string]bool)
+	for _, store := range result.Stores {
+		found[store.StoreId] = true
+	}
+	for _, id := range ids[:150] {
+		if !found[id] {
+			t.Fatalf("store %s not found", id)
+		}
+	}
+
+	result, err = repo.GetStores(ctx, ids, repositories.QueryOptions{Limit: 10, Projection: []string{"store_id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Docs != 10 || result.Stores[0].Name != "" {
+		t.Errorf("expected 10 projected stores, got %d: %+v", result.Docs, result.Stores[0])
+	}
+
+	_, err = repo.Insert(ctx, stores[:1], repositories.InsertOptions{})
+	if repositories.KindOf(err) != repositories.KindDuplicateKey {
+		t.Errorf("expected a duplicate key error, got %v", err)
+	}
+
+	sampled, err := repo.SampleIds(ctx, 20)
+	if err != nil || len(sampled) != 20 {
+		t.Errorf("expected 20 sampled ids, got %d: %v", len(sampled), err)
+	}
+	inserted := make(map[string]int)
+	for i, id := range ids {
+		inserted[id] = i
+	}
+	for i := 1; i < len(sampled); i++ {
+		if inserted[sampled[i-1]] >= inserted[sampled[i]] {
+			t.Fatalf("expected sampled ids in insertion order, got %v", sampled)
+		}
+	}
+
+	if err = repo.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ = repo.Count(ctx); count != 0 {
+		t.Errorf("expected an empty collection, got %d", count)
+	}
+}
+
+func TestFailCommand(t *testing.T) {
+	server, err := fakemongo.NewServer(fakemongo.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	repo, config := newRepository(t, server)
+	ctx := context.Background()
+	if _, err = repo.Insert(ctx, []repositories.Store{{StoreId: "a"}}, repositories.InsertOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	failPoints, err := repositories.NewFailPointClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failPoints.Close()
+
+	err = failPoints.Configure(repositories.FailPoint{
+		Name: "failCommand",
+		Mode: map[string]interface{}{"times": float64(2)},
+		Data: map[string]interface{}{"failCommands": []interface{}{"find"}, "errorCode": float64(2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = repo.GetStores(ctx, []string{"a"}, repositories.QueryOptions{})
+		var commandError mongo.CommandError
+		if !errors.As(err, &commandError) || commandError.Code != 2 {
+			t.Fatalf("expected find %d to fail with code 2, got %v", i+1, err)
+		}
+		if repositories.KindOf(err) != repositories.KindServer {
+			t.Errorf("expected a server error, got %s", repositories.KindOf(err))
+		}
+	}
+	if _, err = repo.GetStores(ctx, []string{"a"}, repositories.QueryOptions{}); err != nil {
+		t.Errorf("expected the fail point to be exhausted, got %v", err)
+	}
+
+	err = failPoints.Configure(repositories.FailPoint{
+		Name: "failCommand",
+		Mode: "alwaysOn",
+		Data: map[string]interface{}{"failCommands": []interface{}{"aggregate"}, "closeConnection": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.Count(ctx); repositories.KindOf(err) != repositories.KindNetwork {
+		t.Errorf("expected a closed connection to be a network error, got %v", err)
+	}
+	if _, err = repo.GetStores(ctx, []string{"a"}, repositories.QueryOptions{}); err != nil {
+		t.Errorf("expected commands not listed to run, got %v", err)
+	}
+
+	if err = failPoints.Off("failCommand"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := repo.Count(ctx); err != nil || count != 1 {
+		t.Errorf("expected the fail point to be off, got %d: %v", count, err)
+	}
+}
@@ -0,0 +1,538 @@
+package fakemongo
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+const idIndexName = "_id_"
+
+type storage struct {
+	mutex       sync.RWMutex
+	collections map[string]*collection
+}
+
+type collection struct {
+	ns      string
+	docs    []bson.Raw
+	indexes []*index
+}
+
+// index only supports single field keys, which is all the repositories create.
+type index struct {
+	name    string
+	field   string
+	key     bson.Raw
+	unique  bool
+	entries map[string][]int
+}
+
+type writeError struct {
+	index   int
+	code    int32
+	message string
+}
+
+func newStorage() *storage {
+	return &storage{
+		collections: make(map[string]*collection),
+	}
+}
+
+func newCollection(ns string) *collection {
+	c := &collection{ns: ns}
+	idKey, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}})
+	c.indexes = append(c.indexes, &index{
+		name:    idIndexName,
+		field:   "_id",
+		key:     idKey,
+		unique:  true,
+		entries: make(map[string][]int),
+	})
+	return c
+}
+
+func (s *storage) collection(ns string) (*collection, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.collections[ns]
+	return c, ok
+}
+
+// getOrCreate must be called holding the write lock.
+func (s *storage) getOrCreate(ns string) (*collection, bool) {
+	c, ok := s.collections[ns]
+	if !ok {
+		c = newCollection(ns)
+		s.collections[ns] = c
+	}
+	return c, !ok
+}
+
+func (s *storage) drop(ns string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.collections[ns]
+	delete(s.collections, ns)
+	return ok
+}
+
+func (s *storage) insert(ns string, docs []bson.Raw, ordered bool) (int, []writeError) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, _ := s.getOrCreate(ns)
+
+	inserted := 0
+	var errs []writeError
+	for i, doc := range docs {
+		doc = withId(doc)
+		if duplicated := c.duplicatedIndex(doc); duplicated != nil {
+			errs = append(errs, writeError{
+				index: i,
+				code:  duplicateKeyCode,
+				message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: { %s: %v }",
+					ns, duplicated.name, duplicated.field, doc.Lookup(duplicated.field)),
+			})
+			if ordered {
+				break
+			}
+			continue
+		}
+		position := len(c.docs)
+		c.docs = append(c.docs, doc)
+		for _, idx := range c.indexes {
+			idx.add(doc, position)
+		}
+		inserted++
+	}
+	return inserted, errs
+}
+
+func (s *storage) createIndex(ns string, name string, key bson.Raw, unique bool) (int, int, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, created := s.getOrCreate(ns)
+
+	before := len(c.indexes)
+	for _, idx := range c.indexes {
+		if idx.name == name {
+			return before, before, created, nil
+		}
+	}
+	elements, err := key.Elements()
+	if err != nil || len(elements) != 1 {
+		return before, before, created, fmt.Errorf("only single field indexes are supported")
+	}
+	idx := &index{
+		name:    name,
+		field:   elements[0].Key(),
+		key:     key,
+		unique:  unique,
+		entries: make(map[string][]int),
+	}
+	for position, doc := range c.docs {
+		if unique && len(idx.entries[indexKey(doc, idx.field)]) > 0 {
+			return before, before, created, fmt.Errorf("E11000 duplicate key error building index %s", name)
+		}
+		idx.add(doc, position)
+	}
+	c.indexes = append(c.indexes, idx)
+	return before, len(c.indexes), created, nil
+}
+
+func (s *storage) listIndexes(ns string) ([]bson.Raw, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.collections[ns]
+	if !ok {
+		return nil, false
+	}
+	var result []bson.Raw
+	for _, idx := range c.indexes {
+		spec := bson.D{{Key: "v", Value: 2}, {Key: "key", Value: idx.key}, {Key: "name", Value: idx.name}}
+		if idx.unique && idx.name != idIndexName {
+			spec = append(spec, bson.E{Key: "unique", Value: true})
+		}
+		spec = append(spec, bson.E{Key: "ns", Value: ns})
+		doc, _ := bson.Marshal(spec)
+		result = append(result, doc)
+	}
+	return result, true
+}
+
+// find returns the documents matching filter in insertion order.
+func (s *storage) find(ns string, filter bson.Raw) ([]bson.Raw, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	c, ok := s.collections[ns]
+	if !ok {
+		return nil, nil
+	}
+
+	positions := c.candidates(filter)
+	var result []bson.Raw
+	for _, position := range positions {
+		doc := c.docs[position]
+		matched, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			result = append(result, doc)
+		}
+	}
+	return result, nil
+}
+
+func (s *storage) sample(docs []bson.Raw, size int, random *rand.Rand) []bson.Raw {
+	if size >= len(docs) {
+		size = len(docs)
+	}
+	result := make([]bson.Raw, 0, size)
+	for _, i := range random.Perm(len(docs))[:size] {
+		result = append(result, docs[i])
+	}
+	return result
+}
+
+// candidates uses an index on a filtered field to avoid scanning the whole collection.
+func (c *collection) candidates(filter bson.Raw) []int {
+	elements, _ := filter.Elements()
+	for _, element := range elements {
+		idx := c.indexOn(element.Key())
+		if idx == nil {
+			continue
+		}
+		values, ok := indexableValues(element.Value())
+		if !ok {
+			continue
+		}
+		seen := make(map[int]struct{})
+		var positions []int
+		for _, value := range values {
+			for _, position := range idx.entries[valueKey(value)] {
+				if _, ok := seen[position]; !ok {
+					seen[position] = struct{}{}
+					positions = append(positions, position)
+				}
+			}
+		}
+		sort.Ints(positions)
+		return positions
+	}
+
+	positions := make([]int, len(c.docs))
+	for i := range positions {
+		positions[i] = i
+	}
+	return positions
+}
+
+func (c *collection) indexOn(field string) *index {
+	for _, idx := range c.indexes {
+		if idx.field == field {
+			return idx
+		}
+	}
+	return nil
+}
+
+func (c *collection) duplicatedIndex(doc bson.Raw) *index {
+	for _, idx := range c.indexes {
+		if idx.unique && len(idx.entries[indexKey(doc, idx.field)]) > 0 {
+			return idx
+		}
+	}
+	return nil
+}
+
+func (i *index) add(doc bson.Raw, position int) {
+	key := indexKey(doc, i.field)
+	i.entries[key] = append(i.entries[key], position)
+}
+
+// indexableValues returns the values compared by equality or $in.
+func indexableValues(value bson.RawValue) ([]bson.RawValue, bool) {
+	doc, ok := value.DocumentOK()
+	if !ok {
+		return []bson.RawValue{value}, value.Type != bsontype.Array
+	}
+	elements, err := doc.Elements()
+	if err != nil || len(elements) != 1 {
+		return nil, false
+	}
+	switch elements[0].Key() {
+	case "$eq":
+		return []bson.RawValue{elements[0].Value()}, true
+	case "$in":
+		values, err := arrayValues(elements[0].Value())
+		return values, err == nil
+	}
+	return nil, false
+}
+
+func indexKey(doc bson.Raw, field string) string {
+	value, err := doc.LookupErr(strings.Split(field, ".")...)
+	if err != nil {
+		return valueKey(bson.RawValue{Type: bsontype.Null})
+	}
+	return valueKey(value)
+}
+
+func valueKey(value bson.RawValue) string {
+	if number, ok := asNumber(value); ok {
+		return fmt.Sprintf("n%v", number)
+	}
+	return string(value.Type) + string(value.Value)
+}
+
+func withId(doc bson.Raw) bson.Raw {
+	if _, err := doc.LookupErr("_id"); err == nil {
+		return doc
+	}
+	index, dst := bsoncore.AppendDocumentStart(nil)
+	dst = bsoncore.AppendObjectIDElement(dst, "_id", primitive.NewObjectID())
+	elements, _ := doc.Elements()
+	for _, element := range elements {
+		dst = append(dst, element...)
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, index)
+	return dst
+}
+
+func matches(doc bson.Raw, filter bson.Raw) (bool, error) {
+	elements, err := filter.Elements()
+	if err != nil {
+		return false, err
+	}
+	for _, element := range elements {
+		key := element.Key()
+		var matched bool
+		switch key {
+		case "$and", "$or", "$nor":
+			matched, err = matchesLogical(doc, key, element.Value())
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported query operator %s", key)
+			}
+			value, lookupErr := doc.LookupErr(strings.Split(key, ".")...)
+			matched, err = matchesField(value, lookupErr == nil, element.Value())
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchesLogical(doc bson.Raw, operator string, value bson.RawValue) (bool, error) {
+	values, err := arrayValues(value)
+	if err != nil {
+		return false, err
+	}
+	for _, clause := range values {
+		clauseDoc, err := documentValue(clause)
+		if err != nil {
+			return false, err
+		}
+		matched, err := matches(doc, clauseDoc)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case operator == "$and" && !matched:
+			return false, nil
+		case operator == "$or" && matched:
+			return true, nil
+		case operator == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return operator != "$or", nil
+}
+
+func matchesField(value bson.RawValue, exists bool, condition bson.RawValue) (bool, error) {
+	operators, ok := condition.DocumentOK()
+	if !ok || !isOperatorDocument(operators) {
+		return exists && equals(value, condition), nil
+	}
+
+	elements, _ := operators.Elements()
+	for _, element := range elements {
+		operand := element.Value()
+		var matched bool
+		switch element.Key() {
+		case "$eq":
+			matched = exists && equals(value, operand)
+		case "$ne":
+			matched = !exists || !equals(value, operand)
+		case "$in", "$nin":
+			in := false
+			values, err := arrayValues(operand)
+			if err != nil {
+				return false, err
+			}
+			for _, candidate := range values {
+				if exists && equals(value, candidate) {
+					in = true
+					break
+				}
+			}
+			matched = in == (element.Key() == "$in")
+		case "$gt", "$gte", "$lt", "$lte":
+			cmp, comparable := compare(value, operand)
+			matched = exists && comparable && compareMatches(element.Key(), cmp)
+		case "$exists":
+			matched = exists == isTruthy(operand)
+		default:
+			return false, fmt.Errorf("unsupported query operator %s", element.Key())
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isOperatorDocument(doc bson.Raw) bool {
+	elements, err := doc.Elements()
+	return err == nil && len(elements) > 0 && strings.HasPrefix(elements[0].Key(), "$")
+}
+
+func compareMatches(operator string, cmp int) bool {
+	switch operator {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+func equals(a bson.RawValue, b bson.RawValue) bool {
+	if cmp, ok := compare(a, b); ok {
+		return cmp == 0
+	}
+	return a.Type == b.Type && bytes.Equal(a.Value, b.Value)
+}
+
+func compare(a bson.RawValue, b bson.RawValue) (int, bool) {
+	if x, ok := asNumber(a); ok {
+		if y, ok := asNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if a.Type != b.Type {
+		return 0, false
+	}
+	switch a.Type {
+	case bsontype.String:
+		return strings.Compare(a.StringValue(), b.StringValue()), true
+	case bsontype.ObjectID, bsontype.DateTime, bsontype.Boolean:
+		return bytes.Compare(a.Value, b.Value), true
+	}
+	return 0, false
+}
+
+func asNumber(value bson.RawValue) (float64, bool) {
+	switch value.Type {
+	case bsontype.Double:
+		return value.Double(), true
+	case bsontype.Int32:
+		return float64(value.Int32()), true
+	case bsontype.Int64:
+		return float64(value.Int64()), true
+	}
+	return 0, false
+}
+
+// project applies an inclusion or exclusion projection to doc.
+func project(doc bson.Raw, projection bson.Raw) bson.Raw {
+	fields, _ := projection.Elements()
+	if len(fields) == 0 {
+		return doc
+	}
+	included := make(map[string]bool)
+	inclusion := false
+	for _, field := range fields {
+		include := isTruthy(field.Value())
+		included[field.Key()] = include
+		if include && field.Key() != "_id" {
+			inclusion = true
+		}
+	}
+
+	elements, _ := doc.Elements()
+	index, dst := bsoncore.AppendDocumentStart(nil)
+	for _, element := range elements {
+		include, listed := included[element.Key()]
+		keep := include
+		if !listed {
+			keep = !inclusion || element.Key() == "_id"
+		}
+		if keep {
+			dst = append(dst, element...)
+		}
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, index)
+	return dst
+}
+
+func isTruthy(value bson.RawValue) bool {
+	if number, ok := asNumber(value); ok {
+		return number != 0
+	}
+	if value.Type == bsontype.Boolean {
+		return value.Boolean()
+	}
+	return true
+}
+
+func arrayDocuments(value bson.RawValue) []bson.Raw {
+	array, ok := value.ArrayOK()
+	if !ok {
+		return nil
+	}
+	values, _ := array.Values()
+	var docs []bson.Raw
+	for _, v := range values {
+		if doc, ok := v.DocumentOK(); ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+func arrayValues(value bson.RawValue) ([]bson.RawValue, error) {
+	array, ok := value.ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("expected an array, got %v", value.Type)
+	}
+	return array.Values()
+}
+
+func documentValue(value bson.RawValue) (bson.Raw, error) {
+	doc, ok := value.DocumentOK()
+	if !ok {
+		return nil, fmt.Errorf("expected a document, got %v", value.Type)
+	}
+	return doc, nil
+}
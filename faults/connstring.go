@@ -0,0 +1,59 @@
+package faults
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+const defaultMongoPort = "27017"
+
+// Redirect rewrites connString so the driver connects to the address returned by
+// proxyAddr, which receives the original host as upstream. Only single host
+// connection strings are supported, the driver is forced to a direct connection
+// so it doesn't discover and bypass the proxy.
+func Redirect(connString string, proxyAddr func(upstream string) (string, error)) (string, error) {
+	parsed, err := connstring.Parse(connString)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != connstring.SchemeMongoDB {
+		return "", fmt.Errorf("fault injection doesn't support %s connection strings", parsed.Scheme)
+	}
+	if len(parsed.Hosts) != 1 {
+		return "", fmt.Errorf("fault injection needs a single host connection string, got %d hosts", len(parsed.Hosts))
+	}
+
+	host := parsed.Hosts[0]
+	upstream := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		upstream = net.JoinHostPort(host, defaultMongoPort)
+	}
+	addr, err := proxyAddr(upstream)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := connstring.SchemeMongoDB + "://"
+	rest := strings.TrimPrefix(connString, prefix)
+	hostsEnd := strings.IndexAny(rest, "/?")
+	if hostsEnd < 0 {
+		hostsEnd = len(rest)
+	}
+	credentialsEnd := strings.LastIndex(rest[:hostsEnd], "@") + 1
+	options := rest[hostsEnd:]
+
+	switch {
+	case strings.Contains(options, "connect=direct"):
+	case strings.Contains(options, "?"):
+		options += "&connect=direct"
+	case strings.HasPrefix(options, "/"):
+		options += "?connect=direct"
+	default:
+		options = "/?connect=direct"
+	}
+
+	return prefix + rest[:credentialsEnd] + addr + options, nil
+}
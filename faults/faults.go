@@ -0,0 +1,118 @@
+package faults
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	TypeLatency   = "latency"
+	TypeBandwidth = "bandwidth"
+	TypeReset     = "reset"
+	TypeBlackhole = "blackhole"
+	TypeSlowClose = "slow_close"
+)
+
+// Fault is a network problem injected by the proxy between StartSecs and
+// StartSecs+DurationSecs, measured from the moment the stage starts its load.
+// A zero DurationSecs keeps the fault until the stage ends.
+type Fault struct {
+	Type         string
+	StartSecs    uint
+	DurationSecs uint
+	// LatencyMs and JitterMs delay every chunk of data for latency faults.
+	LatencyMs uint
+	JitterMs  uint
+	// RateKBps limits the throughput of every connection for bandwidth faults.
+	RateKBps uint
+	// DelayMs holds connections open before closing them for slow_close faults,
+	// or before resetting new connections for reset faults.
+	DelayMs uint
+}
+
+func (f Fault) String() string {
+	return fmt.Sprintf("%s{start=%ds, duration=%ds}", f.Type, f.StartSecs, f.DurationSecs)
+}
+
+func (f Fault) Validate() error {
+	switch f.Type {
+	case TypeLatency:
+		if f.LatencyMs == 0 && f.JitterMs == 0 {
+			return fmt.Errorf("latency fault needs latency or jitter")
+		}
+	case TypeBandwidth:
+		if f.RateKBps == 0 {
+			return fmt.Errorf("bandwidth fault needs a rate")
+		}
+	case TypeReset, TypeBlackhole, TypeSlowClose:
+	default:
+		return fmt.Errorf("unknown fault type %q", f.Type)
+	}
+	return nil
+}
+
+// activeFaults is the set of faults applied by the proxy at a given moment.
+type activeFaults struct {
+	mutex  sync.RWMutex
+	faults map[int]Fault
+	random *rand.Rand
+}
+
+func newActiveFaults(random *rand.Rand) *activeFaults {
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &activeFaults{
+		faults: make(map[int]Fault),
+		random: random,
+	}
+}
+
+func (a *activeFaults) set(id int, fault Fault) {
+	a.mutex.Lock()
+	a.faults[id] = fault
+	a.mutex.Unlock()
+}
+
+func (a *activeFaults) remove(id int) {
+	a.mutex.Lock()
+	delete(a.faults, id)
+	a.mutex.Unlock()
+}
+
+func (a *activeFaults) has(faultType string) (Fault, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, fault := range a.faults {
+		if fault.Type == faultType {
+			return fault, true
+		}
+	}
+	return Fault{}, false
+}
+
+// delay returns how long a chunk of size bytes must wait before being forwarded.
+func (a *activeFaults) delay(size int) time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var delay time.Duration
+	for _, fault := range a.faults {
+		switch fault.Type {
+		case TypeLatency:
+			delay += time.Duration(fault.LatencyMs) * time.Millisecond
+			if fault.JitterMs > 0 {
+				jitter := a.random.Int63n(int64(2*fault.JitterMs+1)) - int64(fault.JitterMs)
+				delay += time.Duration(jitter) * time.Millisecond
+			}
+		case TypeBandwidth:
+			delay += time.Duration(float64(size) / float64(fault.RateKBps*1024) * float64(time.Second))
+		}
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
@@ -0,0 +1,28 @@
+package faults
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestLatencyJitterIsSeeded(t *testing.T) {
+	fault := Fault{Type: TypeLatency, LatencyMs: 20, JitterMs: 10}
+	var delays [2][]time.Duration
+	for i := range delays {
+		active := newActiveFaults(rand.New(rand.NewSource(42)))
+		active.set(0, fault)
+		for j := 0; j < 20; j++ {
+			delay := active.delay(100)
+			if delay < 10*time.Millisecond || delay > 30*time.Millisecond {
+				t.Fatalf("expected a delay between 10ms and 30ms, got %v", delay)
+			}
+			delays[i] = append(delays[i], delay)
+		}
+	}
+	for j := range delays[0] {
+		if delays[0][j] != delays[1][j] {
+			t.Fatalf("expected the same seed to repeat the jitter, %v and %v differ at %d", delays[0][j], delays[1][j], j)
+		}
+	}
+}
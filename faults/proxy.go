@@ -0,0 +1,201 @@
+package faults
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const bufferSize = 32 * 1024
+
+// Proxy forwards TCP connections to upstream applying the active faults.
+type Proxy struct {
+	upstream    string
+	listener    net.Listener
+	faults      *activeFaults
+	mutex       sync.Mutex
+	connections map[*link]struct{}
+	// closed is set by Close, links dialed after it are closed right away.
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewProxy draws the jitter of latency faults from random, a time seeded source
+// when nil.
+func NewProxy(upstream string, random *rand.Rand) (*Proxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	proxy := &Proxy{
+		upstream:    upstream,
+		listener:    listener,
+		faults:      newActiveFaults(random),
+		connections: make(map[*link]struct{}),
+	}
+	proxy.wg.Add(1)
+	go proxy.accept()
+
+	logrus.Infof("Fault proxy listening on %s, forwarding to %s", proxy.Addr(), upstream)
+	return proxy, nil
+}
+
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Activate starts applying fault until Deactivate is called with the same id.
+func (p *Proxy) Activate(id int, fault Fault) {
+	logrus.Infof("Fault activated: %v", fault)
+	p.faults.set(id, fault)
+	if fault.Type == TypeReset {
+		p.resetAll()
+	}
+}
+
+func (p *Proxy) Deactivate(id int, fault Fault) {
+	logrus.Infof("Fault deactivated: %v", fault)
+	p.faults.remove(id)
+}
+
+func (p *Proxy) Close() {
+	_ = p.listener.Close()
+	p.mutex.Lock()
+	p.closed = true
+	for l := range p.connections {
+		l.close()
+	}
+	p.mutex.Unlock()
+	p.wg.Wait()
+}
+
+func (p *Proxy) accept() {
+	defer p.wg.Done()
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.wg.Add(1)
+		go p.handle(client)
+	}
+}
+
+func (p *Proxy) handle(client net.Conn) {
+	defer p.wg.Done()
+
+	if fault, ok := p.faults.has(TypeReset); ok {
+		time.Sleep(time.Duration(fault.DelayMs) * time.Millisecond)
+		reset(client)
+		return
+	}
+
+	server, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		logrus.Warnf("Fault proxy can't reach %s: %v", p.upstream, err)
+		_ = client.Close()
+		return
+	}
+
+	l := &link{client: client, server: server}
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		l.close()
+		return
+	}
+	p.connections[l] = struct{}{}
+	p.mutex.Unlock()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go p.pipe(l, client, server, wg)
+	go p.pipe(l, server, client, wg)
+	wg.Wait()
+
+	p.mutex.Lock()
+	delete(p.connections, l)
+	p.mutex.Unlock()
+}
+
+// pipe copies from src to dst applying the faults active when each chunk is read.
+func (p *Proxy) pipe(l *link, src net.Conn, dst net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, blackhole := p.faults.has(TypeBlackhole); !blackhole {
+				time.Sleep(p.faults.delay(n))
+				if _, werr := dst.Write(buffer[:n]); werr != nil {
+					err = werr
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF && !l.isClosed() {
+				logrus.Debugf("Fault proxy connection finished: %v", err)
+			}
+			if fault, ok := p.faults.has(TypeSlowClose); ok {
+				time.Sleep(time.Duration(fault.DelayMs) * time.Millisecond)
+			}
+			l.close()
+			return
+		}
+	}
+}
+
+func (p *Proxy) resetAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for l := range p.connections {
+		l.reset()
+	}
+}
+
+type link struct {
+	client net.Conn
+	server net.Conn
+	once   sync.Once
+	mutex  sync.Mutex
+	closed bool
+}
+
+func (l *link) isClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		l.mutex.Lock()
+		l.closed = true
+		l.mutex.Unlock()
+		_ = l.client.Close()
+		_ = l.server.Close()
+	})
+}
+
+func (l *link) reset() {
+	l.once.Do(func() {
+		l.mutex.Lock()
+		l.closed = true
+		l.mutex.Unlock()
+		reset(l.client)
+		reset(l.server)
+	})
+}
+
+// reset closes conn sending a RST instead of a FIN.
+func reset(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+}
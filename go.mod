@@ -10,4 +10,5 @@ require (
 	github.com/sirupsen/logrus v1.5.0
 	go.mongodb.org/mongo-driver v1.3.2
 	golang.org/x/sys v0.0.0-20200428200454-593003d681fa // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -1,22 +1,60 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/n4d13/mongo_driver_test/fakemongo"
+	"github.com/n4d13/mongo_driver_test/faults"
 	"github.com/n4d13/mongo_driver_test/repositories"
 	"github.com/n4d13/mongo_driver_test/stage"
+	"github.com/n4d13/mongo_driver_test/store"
 	"github.com/sirupsen/logrus"
 )
 
 type RequestHandler struct {
+	stages    *stageRegistry
+	scenarios *scenarioRegistry
+	schedules *scheduleRegistry
+	scheduler *stageScheduler
+	// runCtx is the context of every run, canceled on shutdown.
+	runCtx    context.Context
+	cancelRun context.CancelFunc
 }
 
-func NewRequestHandler() *RequestHandler {
-	return &RequestHandler{}
+// NewRequestHandler keeps the history of the runs in fileStore, or only in memory
+// when it is nil. It runs at most maxConcurrent stages or scenarios at once and
+// queues up to maxQueued more.
+func NewRequestHandler(fileStore *store.FileStore, maxConcurrent int, maxQueued int) *RequestHandler {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	return &RequestHandler{
+		stages:    newStageRegistry(fileStore),
+		scenarios: newScenarioRegistry(fileStore),
+		schedules: newScheduleRegistry(fileStore),
+		scheduler: newStageScheduler(maxConcurrent, maxQueued),
+		runCtx:    runCtx,
+		cancelRun: cancelRun,
+	}
+}
+
+// Shutdown rejects new runs, interrupts the queued ones and cancels the running
+// ones, which still store their results, journals and recordings. It waits for them
+// until ctx is done.
+func (r *RequestHandler) Shutdown(ctx context.Context) error {
+	for _, run := range r.scheduler.close() {
+		if run.Kind == KindScenario {
+			r.scenarios.interrupt(run.Id)
+		} else {
+			r.stages.interrupt(run.Id)
+		}
+	}
+	r.cancelRun()
+	return r.scheduler.wait(ctx)
 }
 
 func (r *RequestHandler) RunTest(c *gin.Context) {
@@ -26,23 +64,159 @@ func (r *RequestHandler) RunTest(c *gin.Context) {
 		return
 	}
 
-	if result := validateConfig(&requestBody); len(result) > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"validations": fmt.Sprintf("%+v", result)})
+	stageImpl, validations := NewStage(&requestBody)
+	validations = append(validations, pathValidations(requestBody)...)
+	if len(validations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"validations": fmt.Sprintf("%+v", validations)})
 		return
 	}
 
 	logrus.Infof("Running test stage with: %+v", requestBody)
 
-	stageImpl := stage.New(
-		repositories.MongoDBConfiguration{
-			DbName:         requestBody.DBConfig.DbName,
-			CollectionName: requestBody.DBConfig.CollectionName,
-			ConnString:     requestBody.DBConfig.ConnString,
-			MinPool:        uint64(requestBody.DBConfig.MinPoolSize),
-			MaxPool:        uint64(requestBody.DBConfig.MaxPoolSize),
-			IdleTimeout:    time.Duration(requestBody.DBConfig.IdleTimeout) * time.Second,
-			SocketTimeout:  time.Duration(requestBody.DBConfig.SocketTimeout) * time.Second,
-		}, stage.Config{
+	run, position, err := r.submitStage(requestBody, stageImpl)
+	if err != nil {
+		rejectRun(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, scheduledResponse(run.Id, position))
+}
+
+// submitStage registers the stage and hands it to the scheduler, forgetting it when
+// the scheduler rejects it.
+func (r *RequestHandler) submitStage(config TestConfig, stageImpl *stage.Stage) (StageRun, int, error) {
+	run := r.stages.add(config, StatusQueued)
+	stageImpl.SetJournalPath(run.Journal)
+	stageImpl.SetRecordingPath(run.Recording)
+	position, err := r.scheduler.submit(run.Id, KindStage, stageTargets(config), func() {
+		defer r.scheduler.done(run.Id)
+		r.stages.start(run.Id)
+		result, err := stageImpl.Run(r.runCtx)
+		r.stages.finish(run.Id, result, err)
+	})
+	if err != nil {
+		r.stages.discard(run.Id)
+	}
+	return run, position, err
+}
+
+// scheduledResponse tells whether a submitted run started or where it waits.
+func scheduledResponse(id string, position int) gin.H {
+	if position == 0 {
+		return gin.H{"id": id, "status": StatusRunning}
+	}
+	return gin.H{"id": id, "status": StatusQueued, "queue_position": position}
+}
+
+// rejectRun answers the runs the scheduler refused.
+func rejectRun(c *gin.Context, err error) {
+	var busy *TargetBusyError
+	if errors.As(err, &busy) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "target": busy.Target, "used_by": busy.Id})
+		return
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+}
+
+// GetQueue lists the running and queued stages and scenarios.
+func (r *RequestHandler) GetQueue(c *gin.Context) {
+	c.JSON(http.StatusOK, r.scheduler.status())
+}
+
+// GetStage also serves /stages/compare and /stages/queue, gin can't route a static
+// segment next to the id parameter.
+func (r *RequestHandler) GetStage(c *gin.Context) {
+	switch c.Param("id") {
+	case "compare":
+		r.CompareStages(c)
+		return
+	case "queue":
+		r.GetQueue(c)
+		return
+	}
+	run, ok := r.stages.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stage not found"})
+		return
+	}
+	run.QueuePosition = r.scheduler.queuePosition(run.Id)
+	c.JSON(http.StatusOK, run)
+}
+
+// ListStages returns the stage history, optionally filtered by the from and to
+// start times, as RFC 3339 or dates, and by tag.
+func (r *RequestHandler) ListStages(c *gin.Context) {
+	var filter StageFilter
+	var err error
+	if filter.From, err = parseTime(c.Query("from"), false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+		return
+	}
+	if filter.To, err = parseTime(c.Query("to"), true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+		return
+	}
+	filter.Tag = c.Query("tag")
+
+	summaries, err := r.stages.list(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summaries)
+}
+
+type Annotations struct {
+	Tags  []string `json:"tags"`
+	Notes string   `json:"notes"`
+}
+
+// AnnotateStage replaces the tags and notes of a stage run.
+func (r *RequestHandler) AnnotateStage(c *gin.Context) {
+	var requestBody Annotations
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	run, err := r.stages.annotate(c.Param("id"), requestBody.Tags, requestBody.Notes)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stage not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, run.summary())
+}
+
+// parseTime accepts RFC 3339 times or dates, a date used as end of a range
+// includes its whole day.
+func parseTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return parsed, err
+	}
+	if endOfDay {
+		parsed = parsed.Add(24*time.Hour - time.Nanosecond)
+	}
+	return parsed, nil
+}
+
+// NewStage validates the test configuration and builds its stage.
+func NewStage(requestBody *TestConfig) (*stage.Stage, []string) {
+	if result := validateConfig(requestBody); len(result) > 0 {
+		return nil, result
+	}
+
+	return stage.New(
+		mongoDBConfiguration(requestBody.DBConfig), stage.Config{
 			WorkersCount:     requestBody.StageConfig.WorkersCount,
 			WorkersToAdd:     requestBody.StageConfig.WorkersToAdd,
 			IncrementLoad:    requestBody.StageConfig.IncrementLoad,
@@ -52,13 +226,63 @@ func (r *RequestHandler) RunTest(c *gin.Context) {
 			TimeToFinishSecs: requestBody.StageConfig.TimeToFinishSecs,
 			ContextTimeMs:    requestBody.StageConfig.ContextTimeOutMs,
 			QueryTimeoutMs:   requestBody.StageConfig.QueryTimeoutMs,
-		})
-
-	go func() {
-		stageImpl.Run()
-	}()
+			DataMode:         requestBody.StageConfig.DataMode,
+			DatasetSize:      requestBody.StageConfig.DatasetSize,
+			Loader: stage.LoaderConfig{
+				BatchSize:    requestBody.StageConfig.LoadBatchSize,
+				Writers:      requestBody.StageConfig.LoadWriters,
+				Retries:      requestBody.StageConfig.LoadRetries,
+				Ordered:      requestBody.StageConfig.LoadOrdered,
+				WriteConcern: requestBody.StageConfig.LoadWriteConcern,
+			},
+			KeyDistribution: stage.KeyDistributionConfig{
+				Name:              requestBody.StageConfig.KeyDistribution,
+				ZipfSkew:          requestBody.StageConfig.ZipfSkew,
+				HotspotTrafficPct: requestBody.StageConfig.HotspotTrafficPct,
+				HotspotKeysPct:    requestBody.StageConfig.HotspotKeysPct,
+			},
+			Seed:            requestBody.StageConfig.Seed,
+			MinBatchSize:    requestBody.StageConfig.MinBatchSize,
+			MaxBatchSize:    requestBody.StageConfig.MaxBatchSize,
+			CursorBatchSize: requestBody.StageConfig.CursorBatchSize,
+			Limit:           requestBody.StageConfig.Limit,
+			Projection:      requestBody.StageConfig.Projection,
+			Faults:          toFaults(requestBody.StageConfig.Faults),
+			FakeServer:      toFakeServerOptions(requestBody.DBConfig.FakeServer),
+			FailPoints:      toFailPoints(requestBody.StageConfig.FailPoints),
+			Memory:          toMemoryConfiguration(requestBody.DBConfig.Memory),
+			Thresholds: stage.Thresholds{
+				MaxErrorRate:     requestBody.Thresholds.MaxErrorRate,
+				MaxP99Ms:         requestBody.Thresholds.MaxP99Ms,
+				NoPoolTimeouts:   requestBody.Thresholds.NoPoolTimeouts,
+				InUseWithinPool:  requestBody.Thresholds.InUseWithinPool,
+				MinThroughputPct: requestBody.Thresholds.MinThroughputPct,
+			},
+			Abort: stage.AbortRules{
+				MaxErrorRate:        requestBody.Abort.MaxErrorRate,
+				ErrorRateSecs:       requestBody.Abort.ErrorRateSecs,
+				MaxP99Ms:            requestBody.Abort.MaxP99Ms,
+				P99Secs:             requestBody.Abort.P99Secs,
+				MaxGetsFailedPerSec: requestBody.Abort.MaxGetsFailedPerSec,
+			},
+			Journal: toJournalConfig(requestBody.Journal),
+			Replay:  toReplayConfig(requestBody.StageConfig.Replay),
+			Record:  toRecordConfig(requestBody.Record),
+		}), nil
+}
 
-	c.JSON(http.StatusCreated, gin.H{"status": "running"})
+// pathValidations rejects journal and recording paths, the server only writing and
+// serving them in its data directory, and replays, which would open any file of the
+// server. The command line keeps choosing its paths.
+func pathValidations(config TestConfig) []string {
+	var result []string
+	if config.Journal != nil && config.Journal.Path != "" || config.Record != nil && config.Record.Path != "" {
+		result = append(result, "The server keeps journals and recordings in its data directory, paths can't be set")
+	}
+	if config.StageConfig.Replay != nil {
+		result = append(result, "Replays read files of the server, they only run from the command line")
+	}
+	return result
 }
 
 func validateConfig(requestBody *TestConfig) []string {
@@ -67,7 +291,7 @@ func validateConfig(requestBody *TestConfig) []string {
 	if isEmpty(requestBody.DBConfig.DbName) {
 		result = append(result, "Database' name is required")
 	}
-	if isEmpty(requestBody.DBConfig.ConnString) {
+	if isEmpty(requestBody.DBConfig.ConnString) && requestBody.DBConfig.FakeServer == nil && requestBody.DBConfig.Memory == nil {
 		result = append(result, "Connection string is required")
 	}
 	if isEmpty(requestBody.DBConfig.CollectionName) {
@@ -82,31 +306,117 @@ func validateConfig(requestBody *TestConfig) []string {
 	if isEmptyNumber(requestBody.StageConfig.WorkersCount) {
 		result = append(result, "Workers count is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.WorkersToAdd) {
+	if replay := requestBody.StageConfig.Replay; replay != nil {
+		result = append(result, validateReplay(replay, &requestBody.StageConfig)...)
+		if requestBody.Record != nil {
+			result = append(result, "A replay can't be recorded, only generated queries are")
+		}
+	} else {
+		result = append(result, validateLoad(&requestBody.StageConfig)...)
+	}
+	if isEmptyNumber(requestBody.StageConfig.ContextTimeOutMs) {
+		result = append(result, "Context timeout is required")
+	}
+	if isEmptyNumber(requestBody.StageConfig.QueryTimeoutMs) {
+		result = append(result, "Query' timeout is required")
+	}
+	if !isEmpty(requestBody.StageConfig.DataMode) && !stage.IsValidDataMode(requestBody.StageConfig.DataMode) {
+		result = append(result, "Data mode must be one of regenerate, reuse or append")
+	}
+	if !isEmpty(requestBody.StageConfig.KeyDistribution) &&
+		!stage.IsValidDistribution(requestBody.StageConfig.KeyDistribution) {
+		result = append(result, "Key distribution must be one of uniform, zipfian, hotspot, sequential or latest")
+	}
+	if requestBody.StageConfig.ZipfSkew < 0 || requestBody.StageConfig.ZipfSkew >= 1 {
+		result = append(result, "Zipf skew must be between 0 and 1")
+	}
+	if !isPercentage(requestBody.StageConfig.HotspotTrafficPct) || !isPercentage(requestBody.StageConfig.HotspotKeysPct) {
+		result = append(result, "Hotspot percentages must be between 0 and 100")
+	}
+	if requestBody.StageConfig.MaxBatchSize > 0 && requestBody.StageConfig.MaxBatchSize < requestBody.StageConfig.MinBatchSize {
+		result = append(result, "Max batch size must be greater than min batch size")
+	}
+	if fakeServer := requestBody.DBConfig.FakeServer; fakeServer != nil && (fakeServer.ErrorRate < 0 || fakeServer.ErrorRate > 1) {
+		result = append(result, "Fake server's error rate must be between 0 and 1")
+	}
+	if memory := requestBody.DBConfig.Memory; memory != nil {
+		if requestBody.DBConfig.FakeServer != nil || len(requestBody.StageConfig.Faults) > 0 || len(requestBody.StageConfig.FailPoints) > 0 {
+			result = append(result, "Memory repository can't be used with fake server, faults or fail points")
+		}
+		if memory.ErrorRate < 0 || memory.ErrorRate > 1 {
+			result = append(result, "Memory repository's error rate must be between 0 and 1")
+		}
+		if err := toMemoryConfiguration(memory).Latency.Validate(); err != nil {
+			result = append(result, "Invalid memory repository latency: "+err.Error())
+		}
+	}
+	for _, failPoint := range requestBody.StageConfig.FailPoints {
+		if isEmpty(failPoint.Name) || failPoint.Mode == nil {
+			result = append(result, "Fail points need a name and a mode")
+			break
+		}
+	}
+	if requestBody.Thresholds.MaxErrorRate < 0 || requestBody.Thresholds.MaxErrorRate > 1 {
+		result = append(result, "Max error rate must be between 0 and 1")
+	}
+	if requestBody.Thresholds.MaxP99Ms < 0 {
+		result = append(result, "Max p99 latency can't be negative")
+	}
+	if !isPercentage(requestBody.Thresholds.MinThroughputPct) {
+		result = append(result, "Min throughput percentage must be between 0 and 100")
+	}
+	if requestBody.Abort.MaxErrorRate < 0 || requestBody.Abort.MaxErrorRate > 1 {
+		result = append(result, "Abort error rate must be between 0 and 1")
+	}
+	if requestBody.Abort.MaxP99Ms < 0 || requestBody.Abort.MaxGetsFailedPerSec < 0 {
+		result = append(result, "Abort limits can't be negative")
+	}
+	for _, fault := range toFaults(requestBody.StageConfig.Faults) {
+		if err := fault.Validate(); err != nil {
+			result = append(result, "Invalid fault: "+err.Error())
+		}
+	}
+
+	return result
+}
+
+// validateLoad checks the settings of the generated load.
+func validateLoad(stageConfig *StageConfig) []string {
+	var result []string
+	if isEmptyNumber(stageConfig.WorkersToAdd) {
 		result = append(result, "Workers to add is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.IncrementLoad) {
+	if isEmptyNumber(stageConfig.IncrementLoad) {
 		result = append(result, "Increment load is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.MsgBySec) {
+	if isEmptyNumber(stageConfig.MsgBySec) {
 		result = append(result, "Messages per second is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.ProducersCount) {
+	if isEmptyNumber(stageConfig.ProducersCount) {
 		result = append(result, "Producers' count is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.TimeToSleepSecs) {
+	if isEmptyNumber(stageConfig.TimeToSleepSecs) {
 		result = append(result, "Time to sleep is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.TimeToFinishSecs) {
+	if isEmptyNumber(stageConfig.TimeToFinishSecs) {
 		result = append(result, "Time to finish is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.ContextTimeOutMs) {
-		result = append(result, "Context timeout is required")
+	return result
+}
+
+// validateReplay checks a replay, which lasts as long as its capture and runs on
+// the data already in the collection.
+func validateReplay(replay *ReplayConfig, stageConfig *StageConfig) []string {
+	var result []string
+	if isEmpty(replay.Path) {
+		result = append(result, "Replay path is required")
 	}
-	if isEmptyNumber(requestBody.StageConfig.QueryTimeoutMs) {
-		result = append(result, "Query' timeout is required")
+	if replay.TimeScale < 0 {
+		result = append(result, "Replay time scale can't be negative")
+	}
+	if !isEmpty(stageConfig.DataMode) {
+		result = append(result, "Replay runs on the data already in the collection, data mode can't be set")
 	}
-
 	return result
 }
 
@@ -118,29 +428,223 @@ func isEmptyNumber(value uint) bool {
 	return value == 0
 }
 
+func isPercentage(value float64) bool {
+	return value >= 0 && value <= 100
+}
+
 type TestConfig struct {
-	DBConfig    DBConfig    `json:"db_config"`
-	StageConfig StageConfig `json:"stage_config"`
+	DBConfig    DBConfig         `json:"db_config"`
+	StageConfig StageConfig      `json:"stage_config"`
+	Thresholds  ThresholdsConfig `json:"thresholds"`
+	Abort       AbortConfig      `json:"abort"`
+	Journal     *JournalConfig   `json:"journal,omitempty"`
+	Record      *RecordConfig    `json:"record,omitempty"`
+	Tags        []string         `json:"tags"`
+	Notes       string           `json:"notes"`
+}
+
+// JournalConfig records the raw events of the stage. Without a path, the server
+// keeps the journal in the data directory.
+type JournalConfig struct {
+	Path string `json:"path"`
+	Gzip bool   `json:"gzip"`
+}
+
+// RecordConfig records the generated queries of the stage so they can be replayed.
+// Without a path, the server keeps the recording in the data directory.
+type RecordConfig struct {
+	Path string `json:"path"`
+}
+
+type AbortConfig struct {
+	MaxErrorRate        float64 `json:"max_error_rate"`
+	ErrorRateSecs       uint    `json:"error_rate_secs"`
+	MaxP99Ms            float64 `json:"max_p99_ms"`
+	P99Secs             uint    `json:"p99_secs"`
+	MaxGetsFailedPerSec int64   `json:"max_gets_failed_per_sec"`
+}
+
+type ThresholdsConfig struct {
+	MaxErrorRate     float64 `json:"max_error_rate"`
+	MaxP99Ms         float64 `json:"max_p99_ms"`
+	NoPoolTimeouts   bool    `json:"no_pool_timeouts"`
+	InUseWithinPool  bool    `json:"in_use_within_pool"`
+	MinThroughputPct float64 `json:"min_throughput_pct"`
 }
 
 type DBConfig struct {
-	DbName         string `json:"db_name"`
-	CollectionName string `json:"collection_name"`
-	ConnString     string `json:"conn_string"`
-	MinPoolSize    uint   `json:"min_pool_size"`
-	MaxPoolSize    uint   `json:"max_pool_size"`
-	IdleTimeout    uint   `json:"idle_timeout"`
-	SocketTimeout  uint   `json:"socket_timeout"`
+	DbName         string            `json:"db_name"`
+	CollectionName string            `json:"collection_name"`
+	ConnString     string            `json:"conn_string"`
+	MinPoolSize    uint              `json:"min_pool_size"`
+	MaxPoolSize    uint              `json:"max_pool_size"`
+	IdleTimeout    uint              `json:"idle_timeout"`
+	SocketTimeout  uint              `json:"socket_timeout"`
+	FakeServer     *FakeServerConfig `json:"fake_server"`
+	Memory         *MemoryConfig     `json:"memory"`
+}
+
+type MemoryConfig struct {
+	Latency            LatencyConfig `json:"latency"`
+	ErrorRate          float64       `json:"error_rate"`
+	WaitQueueTimeoutMs uint          `json:"wait_queue_timeout_ms"`
+}
+
+type LatencyConfig struct {
+	Distribution string  `json:"distribution"`
+	MeanMs       float64 `json:"mean_ms"`
+	StdDevMs     float64 `json:"stddev_ms"`
+	MinMs        float64 `json:"min_ms"`
+	MaxMs        float64 `json:"max_ms"`
+}
+
+func toJournalConfig(config *JournalConfig) stage.JournalConfig {
+	if config == nil {
+		return stage.JournalConfig{}
+	}
+	return stage.JournalConfig{Path: config.Path, Gzip: config.Gzip}
+}
+
+func toRecordConfig(config *RecordConfig) stage.RecordConfig {
+	if config == nil {
+		return stage.RecordConfig{}
+	}
+	return stage.RecordConfig{Path: config.Path}
+}
+
+func toMemoryConfiguration(config *MemoryConfig) *repositories.MemoryConfiguration {
+	if config == nil {
+		return nil
+	}
+	return &repositories.MemoryConfiguration{
+		Latency: repositories.LatencyDistribution{
+			Type:   config.Latency.Distribution,
+			Mean:   milliseconds(config.Latency.MeanMs),
+			StdDev: milliseconds(config.Latency.StdDevMs),
+			Min:    milliseconds(config.Latency.MinMs),
+			Max:    milliseconds(config.Latency.MaxMs),
+		},
+		ErrorRate:        config.ErrorRate,
+		WaitQueueTimeout: time.Duration(config.WaitQueueTimeoutMs) * time.Millisecond,
+	}
+}
+
+func milliseconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Millisecond))
+}
+
+type FakeServerConfig struct {
+	LatencyMs uint    `json:"latency_ms"`
+	JitterMs  uint    `json:"jitter_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	ErrorCode int32   `json:"error_code"`
+}
+
+func toFakeServerOptions(config *FakeServerConfig) *fakemongo.Options {
+	if config == nil {
+		return nil
+	}
+	return &fakemongo.Options{
+		Latency:   time.Duration(config.LatencyMs) * time.Millisecond,
+		Jitter:    time.Duration(config.JitterMs) * time.Millisecond,
+		ErrorRate: config.ErrorRate,
+		ErrorCode: config.ErrorCode,
+	}
 }
 
 type StageConfig struct {
-	WorkersCount     uint `json:"workers_count"`
-	WorkersToAdd     uint `json:"workers_to_add"`
-	IncrementLoad    uint `json:"increment_load"`
-	ProducersCount   uint `json:"producers_count"`
-	MsgBySec         uint `json:"msg_by_sec"`
-	TimeToSleepSecs  uint `json:"time_to_sleep_secs"`
-	TimeToFinishSecs uint `json:"time_to_finish_secs"`
-	ContextTimeOutMs uint `json:"context_time_out_ms"`
-	QueryTimeoutMs   uint `json:"query_timeout_ms"`
+	WorkersCount      uint              `json:"workers_count"`
+	WorkersToAdd      uint              `json:"workers_to_add"`
+	IncrementLoad     uint              `json:"increment_load"`
+	ProducersCount    uint              `json:"producers_count"`
+	MsgBySec          uint              `json:"msg_by_sec"`
+	TimeToSleepSecs   uint              `json:"time_to_sleep_secs"`
+	TimeToFinishSecs  uint              `json:"time_to_finish_secs"`
+	ContextTimeOutMs  uint              `json:"context_time_out_ms"`
+	QueryTimeoutMs    uint              `json:"query_timeout_ms"`
+	DataMode          string            `json:"data_mode"`
+	DatasetSize       uint              `json:"dataset_size"`
+	LoadBatchSize     uint              `json:"load_batch_size"`
+	LoadWriters       uint              `json:"load_writers"`
+	LoadRetries       uint              `json:"load_retries"`
+	LoadOrdered       bool              `json:"load_ordered"`
+	LoadWriteConcern  string            `json:"load_write_concern"`
+	KeyDistribution   string            `json:"key_distribution"`
+	ZipfSkew          float64           `json:"zipf_skew"`
+	HotspotTrafficPct float64           `json:"hotspot_traffic_pct"`
+	HotspotKeysPct    float64           `json:"hotspot_keys_pct"`
+	Seed              int64             `json:"seed"`
+	MinBatchSize      uint              `json:"min_batch_size"`
+	MaxBatchSize      uint              `json:"max_batch_size"`
+	CursorBatchSize   uint              `json:"cursor_batch_size"`
+	Limit             uint              `json:"limit"`
+	Projection        []string          `json:"projection"`
+	Faults            []FaultConfig     `json:"faults"`
+	FailPoints        []FailPointConfig `json:"failpoints"`
+	Replay            *ReplayConfig     `json:"replay"`
+}
+
+// ReplayConfig replays a system.profile export or mongod JSON log instead of
+// generating queries.
+type ReplayConfig struct {
+	Path      string  `json:"path"`
+	Namespace string  `json:"namespace"`
+	TimeScale float64 `json:"time_scale"`
+}
+
+func toReplayConfig(config *ReplayConfig) *stage.ReplayConfig {
+	if config == nil {
+		return nil
+	}
+	return &stage.ReplayConfig{Path: config.Path, Namespace: config.Namespace, TimeScale: config.TimeScale}
+}
+
+type FailPointConfig struct {
+	AtSecs       uint                   `json:"at_secs"`
+	DurationSecs uint                   `json:"duration_secs"`
+	Name         string                 `json:"name"`
+	Mode         interface{}            `json:"mode"`
+	Data         map[string]interface{} `json:"data"`
+}
+
+func toFailPoints(configs []FailPointConfig) []stage.ScheduledFailPoint {
+	var result []stage.ScheduledFailPoint
+	for _, config := range configs {
+		result = append(result, stage.ScheduledFailPoint{
+			AtSecs:       config.AtSecs,
+			DurationSecs: config.DurationSecs,
+			FailPoint: repositories.FailPoint{
+				Name: config.Name,
+				Mode: config.Mode,
+				Data: config.Data,
+			},
+		})
+	}
+	return result
+}
+
+type FaultConfig struct {
+	Type         string `json:"type"`
+	StartSecs    uint   `json:"start_secs"`
+	DurationSecs uint   `json:"duration_secs"`
+	LatencyMs    uint   `json:"latency_ms"`
+	JitterMs     uint   `json:"jitter_ms"`
+	RateKBps     uint   `json:"rate_kbps"`
+	DelayMs      uint   `json:"delay_ms"`
+}
+
+func toFaults(configs []FaultConfig) []faults.Fault {
+	var result []faults.Fault
+	for _, config := range configs {
+		result = append(result, faults.Fault{
+			Type:         config.Type,
+			StartSecs:    config.StartSecs,
+			DurationSecs: config.DurationSecs,
+			LatencyMs:    config.LatencyMs,
+			JitterMs:     config.JitterMs,
+			RateKBps:     config.RateKBps,
+			DelayMs:      config.DelayMs,
+		})
+	}
+	return result
 }
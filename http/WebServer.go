@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,11 +10,15 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/n4d13/mongo_driver_test/config"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -25,6 +30,58 @@ var (
 
 var reset = string([]byte{27, 91, 48, 109})
 
+// requestsShutdownTimeout is how long the requests in flight have to finish once the
+// runs are drained, on top of the shutdown timeout.
+const requestsShutdownTimeout = 5 * time.Second
+
+// Serve runs the server and its schedules until SIGINT or SIGTERM, then stops taking
+// runs, cancels the running ones and waits for them and the requests in flight, at
+// most the shutdown timeout for the runs and a few more seconds for the requests.
+func Serve(handler *RequestHandler, appConfig config.AppConfig) error {
+	engine, err := ConfigureRoutes(handler, appConfig)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: ":" + strconv.Itoa(appConfig.Port), Handler: engine}
+
+	schedulesCtx, stopSchedules := context.WithCancel(context.Background())
+	defer stopSchedules()
+	go handler.RunSchedules(schedulesCtx)
+
+	failed := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case err = <-failed:
+		return err
+	case received := <-signals:
+		logrus.Infof("Received %v, shutting down in at most %v", received, appConfig.ShutdownTimeout)
+	}
+
+	stopSchedules()
+	runsCtx, cancelRuns := context.WithTimeout(context.Background(), appConfig.ShutdownTimeout)
+	defer cancelRuns()
+	if err = handler.Shutdown(runsCtx); err != nil {
+		logrus.Errorf("Runs not finished on shutdown: %v", err)
+	}
+
+	requestsCtx, cancelRequests := context.WithTimeout(context.Background(), requestsShutdownTimeout)
+	defer cancelRequests()
+	if err = server.Shutdown(requestsCtx); err != nil {
+		logrus.Errorf("Requests not finished on shutdown, closing their connections: %v", err)
+		_ = server.Close()
+	}
+	logrus.Info("Server stopped")
+	return nil
+}
+
 func ConfigureRoutes(handler *RequestHandler, appConfig config.AppConfig) (*gin.Engine, error) {
 	server := gin.New()
 	server.Use(gin.LoggerWithFormatter(loggerConfig))
@@ -35,6 +92,21 @@ func ConfigureRoutes(handler *RequestHandler, appConfig config.AppConfig) (*gin.
 	})
 
 	server.POST(appConfig.BasePath+"/stages/", handler.RunTest)
+	server.GET(appConfig.BasePath+"/stages", handler.ListStages)
+	server.GET(appConfig.BasePath+"/stages/:id", handler.GetStage)
+	server.PATCH(appConfig.BasePath+"/stages/:id", handler.AnnotateStage)
+	server.GET(appConfig.BasePath+"/stages/:id/export", handler.ExportStage)
+	server.GET(appConfig.BasePath+"/stages/:id/journal", handler.GetJournal)
+	server.GET(appConfig.BasePath+"/stages/:id/recording", handler.GetRecording)
+	server.POST(appConfig.BasePath+"/scenarios/", handler.RunScenario)
+	server.GET(appConfig.BasePath+"/scenarios/:id", handler.GetScenario)
+	server.POST(appConfig.BasePath+"/sweeps/", handler.RunSweep)
+	server.GET(appConfig.BasePath+"/sweeps/:id", handler.GetScenario)
+	server.POST(appConfig.BasePath+"/schedules/", handler.CreateSchedule)
+	server.GET(appConfig.BasePath+"/schedules", handler.ListSchedules)
+	server.GET(appConfig.BasePath+"/schedules/:id", handler.GetSchedule)
+	server.PATCH(appConfig.BasePath+"/schedules/:id", handler.PatchSchedule)
+	server.DELETE(appConfig.BasePath+"/schedules/:id", handler.DeleteSchedule)
 	return server, nil
 }
 
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n4d13/mongo_driver_test/compare"
+	"github.com/n4d13/mongo_driver_test/store"
+)
+
+// CompareStages diffs the stored stage runs in the ids query parameter against the
+// first one, threshold_pct sets the change flagged as a regression.
+func (r *RequestHandler) CompareStages(c *gin.Context) {
+	thresholdPct := float64(compare.DefaultThresholdPct)
+	if value := c.Query("threshold_pct"); value != "" {
+		var err error
+		if thresholdPct, err = strconv.ParseFloat(value, 64); err != nil || thresholdPct <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold_pct must be a positive number"})
+			return
+		}
+	}
+
+	comparison, err := compareStages(r.stages.get, SplitIds(c.Query("ids")), thresholdPct)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, comparison)
+}
+
+// CompareStoredStages diffs stage runs kept in fileStore by a previous server.
+func CompareStoredStages(fileStore *store.FileStore, ids []string, thresholdPct float64) (*compare.Comparison, error) {
+	return compareStages(newStageRegistry(fileStore).get, ids, thresholdPct)
+}
+
+// SplitIds splits a comma separated list of ids, ignoring empty ones.
+func SplitIds(value string) []string {
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func compareStages(get func(string) (StageRun, bool), ids []string, thresholdPct float64) (*compare.Comparison, error) {
+	if len(ids) < 2 {
+		return nil, errors.New("at least two stage ids are needed")
+	}
+	var runs []compare.Run
+	for _, id := range ids {
+		run, ok := get(id)
+		if !ok {
+			return nil, fmt.Errorf("stage %s: %w", id, store.ErrNotFound)
+		}
+		if run.Result == nil || run.Status == StatusFailed {
+			return nil, fmt.Errorf("stage %s has no result, its status is %s", id, run.Status)
+		}
+		// Tags and notes describe the run, not the load it ran.
+		config := run.Config
+		config.Tags, config.Notes = nil, ""
+		runs = append(runs, compare.Run{Id: run.Id, Config: config, Result: run.Result})
+	}
+	return compare.Compare(runs, thresholdPct)
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n4d13/mongo_driver_test/export"
+	"github.com/n4d13/mongo_driver_test/store"
+)
+
+// ExportStage downloads a finished stage as csv, jsonl or html, given by the
+// format query parameter. jsonl needs the stage to keep a journal.
+func (r *RequestHandler) ExportStage(c *gin.Context) {
+	format := c.DefaultQuery("format", export.FormatHTML)
+	contentType, err := export.ContentType(format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	run, ok := r.stages.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stage not found"})
+		return
+	}
+	if run.Result == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "stage has no result, its status is " + run.Status})
+		return
+	}
+	if format == export.FormatJSONL && run.Journal == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": export.ErrNoJournal.Error()})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="stage-%s.%s"`, run.Id, format))
+	c.Status(http.StatusOK)
+	if err = ExportRun(c.Writer, run, format); err != nil {
+		_ = c.Error(err)
+	}
+}
+
+// GetJournal downloads the journal of a stage recording one.
+func (r *RequestHandler) GetJournal(c *gin.Context) {
+	run, ok := r.stages.get(c.Param("id"))
+	if !ok || run.Journal == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stage journal not found"})
+		return
+	}
+	c.FileAttachment(run.Journal, filepath.Base(run.Journal))
+}
+
+// GetRecording downloads the generated queries recorded by a stage.
+func (r *RequestHandler) GetRecording(c *gin.Context) {
+	run, ok := r.stages.get(c.Param("id"))
+	if !ok || run.Recording == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stage recording not found"})
+		return
+	}
+	c.FileAttachment(run.Recording, filepath.Base(run.Recording))
+}
+
+// ExportStoredStage exports a stage run kept in fileStore by a previous server.
+func ExportStoredStage(out io.Writer, fileStore *store.FileStore, id string, format string) error {
+	run, ok := newStageRegistry(fileStore).get(id)
+	if !ok {
+		return fmt.Errorf("stage %s: %w", id, store.ErrNotFound)
+	}
+	if run.Result == nil {
+		return fmt.Errorf("stage %s has no result, its status is %s", id, run.Status)
+	}
+	return ExportRun(out, run, format)
+}
+
+func ExportRun(out io.Writer, run StageRun, format string) error {
+	return export.Write(out, format, "Stage "+run.Id, run.Result, run.Journal)
+}
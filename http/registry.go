@@ -0,0 +1,451 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/journal"
+	"github.com/n4d13/mongo_driver_test/scenario"
+	"github.com/n4d13/mongo_driver_test/stage"
+	"github.com/n4d13/mongo_driver_test/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	StatusQueued   = "queued"
+	StatusRunning  = "running"
+	StatusFinished = "finished"
+	StatusFailed   = "failed"
+	// StatusInterrupted is reported for stored runs left running by a previous process.
+	StatusInterrupted = "interrupted"
+)
+
+const (
+	stagesKind    = "stages"
+	scenariosKind = "scenarios"
+	schedulesKind = "schedules"
+	journalsDir   = "journals"
+	recordingsDir = "recordings"
+)
+
+// StageRun is a stage started through the API.
+type StageRun struct {
+	Id            string        `json:"id"`
+	Status        string        `json:"status"`
+	Started       time.Time     `json:"started"`
+	Finished      *time.Time    `json:"finished,omitempty"`
+	Tags          []string      `json:"tags,omitempty"`
+	Notes         string        `json:"notes,omitempty"`
+	Config        TestConfig    `json:"config"`
+	Journal       string        `json:"journal,omitempty"`
+	Recording     string        `json:"recording,omitempty"`
+	QueuePosition int           `json:"queue_position,omitempty"`
+	Result        *stage.Result `json:"result,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// StageSummary is the part of a stage run listed in its history.
+type StageSummary struct {
+	Id        string     `json:"id"`
+	Status    string     `json:"status"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Notes     string     `json:"notes,omitempty"`
+	Verdict   string     `json:"verdict,omitempty"`
+	Queries   int64      `json:"queries"`
+	ErrorRate float64    `json:"error_rate"`
+	P99Ms     float64    `json:"p99_ms"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func (s *StageRun) summary() StageSummary {
+	summary := StageSummary{
+		Id:       s.Id,
+		Status:   s.Status,
+		Started:  s.Started,
+		Finished: s.Finished,
+		Tags:     s.Tags,
+		Notes:    s.Notes,
+		Error:    s.Error,
+	}
+	if s.Result != nil {
+		summary.Verdict = s.Result.Verdict
+		summary.Queries = s.Result.Queries
+		summary.ErrorRate = s.Result.ErrorRate
+		summary.P99Ms = s.Result.Latency.P99
+	}
+	return summary
+}
+
+func (s *StageRun) hasTag(tag string) bool {
+	for _, runTag := range s.Tags {
+		if runTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// StageFilter selects stored stage runs, zero values match every run.
+type StageFilter struct {
+	From time.Time
+	To   time.Time
+	Tag  string
+}
+
+func (f StageFilter) matches(run *StageRun) bool {
+	if !f.From.IsZero() && run.Started.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && run.Started.After(f.To) {
+		return false
+	}
+	return f.Tag == "" || run.hasTag(f.Tag)
+}
+
+// stageRegistry keeps the stages running in this process and, when it has a store,
+// saves every run on its changes so the history survives restarts.
+type stageRegistry struct {
+	mutex  sync.RWMutex
+	stages map[string]*StageRun
+	store  *store.FileStore
+}
+
+func newStageRegistry(fileStore *store.FileStore) *stageRegistry {
+	return &stageRegistry{
+		stages: make(map[string]*StageRun),
+		store:  fileStore,
+	}
+}
+
+func (r *stageRegistry) add(config TestConfig, status string) StageRun {
+	run := &StageRun{
+		Id:      newStageId(),
+		Status:  status,
+		Started: time.Now(),
+		Tags:    config.Tags,
+		Notes:   config.Notes,
+		Config:  config,
+	}
+	run.Journal = r.journalPath(run.Id, config.Journal)
+	run.Recording = r.recordingPath(run.Id, config.Record)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stages[run.Id] = run
+	r.save(run)
+	return *run
+}
+
+// journalPath keeps the journals next to the stored runs, a server without a store
+// writes none.
+func (r *stageRegistry) journalPath(id string, config *JournalConfig) string {
+	if config == nil || r.store == nil {
+		return ""
+	}
+	return filepath.Join(r.store.Dir(), journalsDir, journal.FileName(id, config.Gzip))
+}
+
+// recordingPath keeps the recordings next to the stored runs, a server without a
+// store writes none.
+func (r *stageRegistry) recordingPath(id string, config *RecordConfig) string {
+	if config == nil || r.store == nil {
+		return ""
+	}
+	return filepath.Join(r.store.Dir(), recordingsDir, id+".ndjson")
+}
+
+// start marks a queued run as running from now on.
+func (r *stageRegistry) start(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if run, ok := r.stages[id]; ok {
+		run.Status = StatusRunning
+		run.Started = time.Now()
+		r.save(run)
+	}
+}
+
+// interrupt ends a queued run that will never start.
+func (r *stageRegistry) interrupt(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if run, ok := r.stages[id]; ok {
+		finished := time.Now()
+		run.Finished = &finished
+		run.Status = StatusInterrupted
+		r.save(run)
+	}
+}
+
+// discard forgets a run the scheduler rejected.
+func (r *stageRegistry) discard(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.stages, id)
+	if r.store != nil {
+		if err := r.store.Delete(stagesKind, id); err != nil {
+			logrus.Errorf("Stage %s can't be deleted: %v", id, err)
+		}
+	}
+}
+
+func (r *stageRegistry) finish(id string, result *stage.Result, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	run, ok := r.stages[id]
+	if !ok {
+		return
+	}
+	finished := time.Now()
+	run.Finished = &finished
+	run.Result = result
+	run.Status = StatusFinished
+	if err != nil {
+		run.Status = StatusFailed
+		run.Error = err.Error()
+	}
+	r.save(run)
+}
+
+// annotate replaces the tags and notes of a run.
+func (r *stageRegistry) annotate(id string, tags []string, notes string) (StageRun, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	run, ok := r.stages[id]
+	if !ok {
+		stored, err := r.load(id)
+		if err != nil {
+			return StageRun{}, err
+		}
+		run = &stored
+	}
+	run.Tags = tags
+	run.Notes = notes
+	if err := r.saveErr(run); err != nil {
+		return StageRun{}, err
+	}
+	return *run, nil
+}
+
+func (r *stageRegistry) get(id string) (StageRun, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if run, ok := r.stages[id]; ok {
+		return *run, true
+	}
+	run, err := r.load(id)
+	return run, err == nil
+}
+
+// list returns the summaries of the stored runs matching filter, most recent first.
+func (r *stageRegistry) list(filter StageFilter) ([]StageSummary, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	summaries := []StageSummary{}
+	add := func(run *StageRun) {
+		if filter.matches(run) {
+			summaries = append(summaries, run.summary())
+		}
+	}
+	if r.store == nil {
+		for _, run := range r.stages {
+			add(run)
+		}
+	} else {
+		err := r.store.Each(stagesKind, func(content []byte) error {
+			var run StageRun
+			if err := json.Unmarshal(content, &run); err != nil {
+				return err
+			}
+			r.checkInterrupted(&run)
+			add(&run)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Started.After(summaries[j].Started)
+	})
+	return summaries, nil
+}
+
+func (r *stageRegistry) load(id string) (StageRun, error) {
+	var run StageRun
+	if r.store == nil {
+		return run, store.ErrNotFound
+	}
+	if err := r.store.Load(stagesKind, id, &run); err != nil {
+		return run, err
+	}
+	r.checkInterrupted(&run)
+	return run, nil
+}
+
+// checkInterrupted marks stored runs still running or queued but unknown to this
+// process.
+func (r *stageRegistry) checkInterrupted(run *StageRun) {
+	if _, ok := r.stages[run.Id]; !ok && (run.Status == StatusRunning || run.Status == StatusQueued) {
+		run.Status = StatusInterrupted
+	}
+}
+
+func (r *stageRegistry) save(run *StageRun) {
+	if err := r.saveErr(run); err != nil {
+		logrus.Errorf("Stage %s can't be stored: %v", run.Id, err)
+	}
+}
+
+func (r *stageRegistry) saveErr(run *StageRun) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Save(stagesKind, run.Id, run)
+}
+
+// ScenarioRun is a scenario or sweep started through the API, its stages are
+// registered as stage runs too.
+type ScenarioRun struct {
+	Id            string           `json:"id"`
+	Status        string           `json:"status"`
+	Started       time.Time        `json:"started"`
+	Finished      *time.Time       `json:"finished,omitempty"`
+	Config        ScenarioConfig   `json:"config"`
+	Sweep         *SweepConfig     `json:"sweep,omitempty"`
+	StageIds      []string         `json:"stage_ids"`
+	Report        *scenario.Report `json:"report,omitempty"`
+	Matrix        *scenario.Matrix `json:"matrix,omitempty"`
+	QueuePosition int              `json:"queue_position,omitempty"`
+}
+
+type scenarioRegistry struct {
+	mutex     sync.RWMutex
+	scenarios map[string]*ScenarioRun
+	store     *store.FileStore
+}
+
+func newScenarioRegistry(fileStore *store.FileStore) *scenarioRegistry {
+	return &scenarioRegistry{
+		scenarios: make(map[string]*ScenarioRun),
+		store:     fileStore,
+	}
+}
+
+func (r *scenarioRegistry) add(config ScenarioConfig, sweep *SweepConfig, status string) ScenarioRun {
+	run := &ScenarioRun{
+		Id:      newStageId(),
+		Status:  status,
+		Started: time.Now(),
+		Config:  config,
+		Sweep:   sweep,
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.scenarios[run.Id] = run
+	r.save(run)
+	return *run
+}
+
+// start marks a queued run as running from now on.
+func (r *scenarioRegistry) start(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if run, ok := r.scenarios[id]; ok {
+		run.Status = StatusRunning
+		run.Started = time.Now()
+		r.save(run)
+	}
+}
+
+// interrupt ends a queued run that will never start.
+func (r *scenarioRegistry) interrupt(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if run, ok := r.scenarios[id]; ok {
+		finished := time.Now()
+		run.Finished = &finished
+		run.Status = StatusInterrupted
+		r.save(run)
+	}
+}
+
+// discard forgets a run the scheduler rejected.
+func (r *scenarioRegistry) discard(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.scenarios, id)
+	if r.store != nil {
+		if err := r.store.Delete(scenariosKind, id); err != nil {
+			logrus.Errorf("Scenario %s can't be deleted: %v", id, err)
+		}
+	}
+}
+
+func (r *scenarioRegistry) addStage(id string, stageId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if run, ok := r.scenarios[id]; ok {
+		run.StageIds = append(run.StageIds, stageId)
+		r.save(run)
+	}
+}
+
+func (r *scenarioRegistry) finish(id string, report *scenario.Report, matrix *scenario.Matrix) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	run, ok := r.scenarios[id]
+	if !ok {
+		return
+	}
+	finished := time.Now()
+	run.Finished = &finished
+	run.Report = report
+	run.Matrix = matrix
+	run.Status = StatusFinished
+	if report.SetupError != "" {
+		run.Status = StatusFailed
+	}
+	r.save(run)
+}
+
+func (r *scenarioRegistry) get(id string) (ScenarioRun, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if run, ok := r.scenarios[id]; ok {
+		copied := *run
+		copied.StageIds = append([]string(nil), run.StageIds...)
+		return copied, true
+	}
+	var run ScenarioRun
+	if r.store == nil || r.store.Load(scenariosKind, id, &run) != nil {
+		return run, false
+	}
+	if run.Status == StatusRunning || run.Status == StatusQueued {
+		run.Status = StatusInterrupted
+	}
+	return run, true
+}
+
+func (r *scenarioRegistry) save(run *ScenarioRun) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Save(scenariosKind, run.Id, run); err != nil {
+		logrus.Errorf("Scenario %s can't be stored: %v", run.Id, err)
+	}
+}
+
+func newStageId() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,238 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"github.com/n4d13/mongo_driver_test/scenario"
+	"github.com/n4d13/mongo_driver_test/stage"
+	"github.com/sirupsen/logrus"
+)
+
+// ScenarioConfig is an ordered list of stages, each one overriding the fields it
+// sets on the base configuration.
+type ScenarioConfig struct {
+	Name   string          `json:"name"`
+	Base   TestConfig      `json:"base"`
+	Setup  *SetupConfig    `json:"setup"`
+	Stages []ScenarioStage `json:"stages"`
+}
+
+// SetupConfig loads a dataset shared by every stage, which reuse it by default.
+type SetupConfig struct {
+	DataMode         string `json:"data_mode"`
+	DatasetSize      uint   `json:"dataset_size"`
+	LoadBatchSize    uint   `json:"load_batch_size"`
+	LoadWriters      uint   `json:"load_writers"`
+	LoadRetries      uint   `json:"load_retries"`
+	LoadOrdered      bool   `json:"load_ordered"`
+	LoadWriteConcern string `json:"load_write_concern"`
+	Seed             int64  `json:"seed"`
+}
+
+type ScenarioStage struct {
+	Name      string          `json:"name"`
+	PauseSecs uint            `json:"pause_secs"`
+	Config    json.RawMessage `json:"config"`
+}
+
+func (r *RequestHandler) RunScenario(c *gin.Context) {
+	var requestBody ScenarioConfig
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var run ScenarioRun
+	scenarioImpl, validations := NewScenario(&requestBody, r.registeredStage(&run))
+	validations = append(validations, requestBody.pathValidations()...)
+	if len(validations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"validations": fmt.Sprintf("%+v", validations)})
+		return
+	}
+
+	logrus.Infof("Running scenario %s with %d stages", scenarioImpl.Name, len(scenarioImpl.Steps))
+
+	run = r.scenarios.add(requestBody, nil, StatusQueued)
+	position, err := r.scheduler.submit(run.Id, KindScenario, requestBody.targets(), func() {
+		defer r.scheduler.done(run.Id)
+		r.scenarios.start(run.Id)
+		r.scenarios.finish(run.Id, scenarioImpl.Run(r.runCtx), nil)
+	})
+	if err != nil {
+		r.scenarios.discard(run.Id)
+		rejectRun(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, scheduledResponse(run.Id, position))
+}
+
+func (r *RequestHandler) GetScenario(c *gin.Context) {
+	run, ok := r.scenarios.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "scenario not found"})
+		return
+	}
+	run.QueuePosition = r.scheduler.queuePosition(run.Id)
+	c.JSON(http.StatusOK, run)
+}
+
+// registeredStage registers every stage of the scenario run as a stage run too. The
+// run is read when the stages start, once it has been added to the registry.
+func (r *RequestHandler) registeredStage(run *ScenarioRun) func(TestConfig, *stage.Stage) func(context.Context) (*stage.Result, error) {
+	return func(config TestConfig, stageImpl *stage.Stage) func(context.Context) (*stage.Result, error) {
+		return func(ctx context.Context) (*stage.Result, error) {
+			stageRun := r.stages.add(config, StatusRunning)
+			stageImpl.SetJournalPath(stageRun.Journal)
+			stageImpl.SetRecordingPath(stageRun.Recording)
+			r.scenarios.addStage(run.Id, stageRun.Id)
+			result, err := stageImpl.Run(ctx)
+			r.stages.finish(stageRun.Id, result, err)
+			return result, err
+		}
+	}
+}
+
+// NewScenario validates every stage of the scenario and builds it. wrap, when not
+// nil, decorates how every stage runs.
+func NewScenario(config *ScenarioConfig,
+	wrap func(TestConfig, *stage.Stage) func(context.Context) (*stage.Result, error)) (*scenario.Scenario, []string) {
+
+	var validations []string
+	if len(config.Stages) == 0 {
+		validations = append(validations, "Scenario needs at least one stage")
+	}
+	if config.Setup != nil {
+		validations = append(validations, validateSetup(config)...)
+	}
+
+	scenarioImpl := &scenario.Scenario{Name: config.Name}
+	if scenarioImpl.Name == "" {
+		scenarioImpl.Name = "scenario"
+	}
+	for i, scenarioStage := range config.Stages {
+		name := scenario.StepName(scenarioStage.Name, i)
+		stageConfig, err := config.stageConfig(scenarioStage)
+		if err != nil {
+			validations = append(validations, fmt.Sprintf("%s: invalid config: %v", name, err))
+			continue
+		}
+		stageImpl, stageValidations := NewStage(&stageConfig)
+		for _, validation := range stageValidations {
+			validations = append(validations, name+": "+validation)
+		}
+		if len(stageValidations) > 0 {
+			continue
+		}
+
+		run := stageImpl.Run
+		if wrap != nil {
+			run = wrap(stageConfig, stageImpl)
+		}
+		scenarioImpl.Steps = append(scenarioImpl.Steps, scenario.Step{
+			Name:  name,
+			Pause: time.Duration(scenarioStage.PauseSecs) * time.Second,
+			Run:   run,
+		})
+	}
+	if len(validations) > 0 {
+		return nil, validations
+	}
+
+	if setup := config.Setup; setup != nil {
+		setupStage := stage.New(mongoDBConfiguration(config.Base.DBConfig), stage.Config{
+			DataMode:    setup.DataMode,
+			DatasetSize: setup.DatasetSize,
+			Loader: stage.LoaderConfig{
+				BatchSize:    setup.LoadBatchSize,
+				Writers:      setup.LoadWriters,
+				Retries:      setup.LoadRetries,
+				Ordered:      setup.LoadOrdered,
+				WriteConcern: setup.LoadWriteConcern,
+			},
+			Seed: setup.Seed,
+		})
+		scenarioImpl.Setup = setupStage.PrepareData
+	}
+	return scenarioImpl, nil
+}
+
+// targets are the collections used by the setup and every stage of the scenario.
+func (c *ScenarioConfig) targets() []string {
+	configs := []TestConfig{c.Base}
+	for _, scenarioStage := range c.Stages {
+		if stageConfig, err := c.stageConfig(scenarioStage); err == nil {
+			configs = append(configs, stageConfig)
+		}
+	}
+	return stageTargets(configs...)
+}
+
+// pathValidations applies the path rule of the API to every stage of the scenario.
+func (c *ScenarioConfig) pathValidations() []string {
+	validations := pathValidations(c.Base)
+	for i, scenarioStage := range c.Stages {
+		if stageConfig, err := c.stageConfig(scenarioStage); err == nil {
+			for _, validation := range pathValidations(stageConfig) {
+				validations = append(validations, scenario.StepName(scenarioStage.Name, i)+": "+validation)
+			}
+		}
+	}
+	return validations
+}
+
+// stageConfig merges the overrides of the stage on a copy of the base configuration.
+// Stages of a scenario with a setup reuse its dataset unless they set a data mode.
+func (c *ScenarioConfig) stageConfig(scenarioStage ScenarioStage) (TestConfig, error) {
+	var stageConfig TestConfig
+	base, err := json.Marshal(c.Base)
+	if err != nil {
+		return stageConfig, err
+	}
+	if err = json.Unmarshal(base, &stageConfig); err != nil {
+		return stageConfig, err
+	}
+	if len(scenarioStage.Config) > 0 {
+		if err = json.Unmarshal(scenarioStage.Config, &stageConfig); err != nil {
+			return stageConfig, err
+		}
+	}
+
+	if c.Setup != nil && stageConfig.StageConfig.DataMode == "" {
+		stageConfig.StageConfig.DataMode = stage.DataModeReuse
+		if stageConfig.StageConfig.DatasetSize == 0 {
+			stageConfig.StageConfig.DatasetSize = c.Setup.DatasetSize
+		}
+	}
+	return stageConfig, nil
+}
+
+func validateSetup(config *ScenarioConfig) []string {
+	var result []string
+	dbConfig := config.Base.DBConfig
+	if isEmpty(dbConfig.ConnString) || dbConfig.FakeServer != nil || dbConfig.Memory != nil {
+		result = append(result, "Scenario setup needs a MongoDB connection string in the base configuration")
+	}
+	if !isEmpty(config.Setup.DataMode) && !stage.IsValidDataMode(config.Setup.DataMode) {
+		result = append(result, "Setup data mode must be one of regenerate, reuse or append")
+	}
+	return result
+}
+
+func mongoDBConfiguration(dbConfig DBConfig) repositories.MongoDBConfiguration {
+	return repositories.MongoDBConfiguration{
+		DbName:         dbConfig.DbName,
+		CollectionName: dbConfig.CollectionName,
+		ConnString:     dbConfig.ConnString,
+		MinPool:        uint64(dbConfig.MinPoolSize),
+		MaxPool:        uint64(dbConfig.MaxPoolSize),
+		IdleTimeout:    time.Duration(dbConfig.IdleTimeout) * time.Second,
+		SocketTimeout:  time.Duration(dbConfig.SocketTimeout) * time.Second,
+	}
+}
@@ -0,0 +1,250 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of the runs taking a slot of the scheduler.
+const (
+	KindStage    = "stage"
+	KindScenario = "scenario"
+)
+
+var (
+	ErrQueueFull    = errors.New("the queue of stages is full")
+	ErrShuttingDown = errors.New("the server is shutting down")
+)
+
+// TargetBusyError rejects a run sharing a collection with a running or queued one.
+type TargetBusyError struct {
+	Target string
+	Id     string
+}
+
+func (e *TargetBusyError) Error() string {
+	return fmt.Sprintf("%s is already used by %s", e.Target, e.Id)
+}
+
+// QueueStatus lists the runs holding a slot and the ones waiting for it, in order.
+type QueueStatus struct {
+	MaxConcurrent int            `json:"max_concurrent"`
+	MaxQueued     int            `json:"max_queued"`
+	Running       []ScheduledRun `json:"running"`
+	Queued        []ScheduledRun `json:"queued"`
+}
+
+type ScheduledRun struct {
+	Id       string   `json:"id"`
+	Kind     string   `json:"kind"`
+	Targets  []string `json:"targets,omitempty"`
+	Position int      `json:"position,omitempty"`
+}
+
+// stageScheduler runs at most maxConcurrent stages and scenarios at once, the
+// others wait in a FIFO queue of at most maxQueued runs. Runs using the same
+// collection of a server are rejected instead of queued, as every stage may drop
+// the data of the others.
+type stageScheduler struct {
+	mutex         sync.Mutex
+	maxConcurrent int
+	maxQueued     int
+	running       []*scheduledRun
+	queue         []*scheduledRun
+	closed        bool
+	// accepted counts the runs queued or running.
+	accepted sync.WaitGroup
+}
+
+type scheduledRun struct {
+	ScheduledRun
+	start func()
+}
+
+func newStageScheduler(maxConcurrent int, maxQueued int) *stageScheduler {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &stageScheduler{maxConcurrent: maxConcurrent, maxQueued: maxQueued}
+}
+
+// submit starts the run when a slot is free or queues it, returning its position in
+// the queue, 0 when it started. start must call done once the run finishes.
+func (s *stageScheduler) submit(id string, kind string, targets []string, start func()) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, ErrShuttingDown
+	}
+	for _, target := range targets {
+		if user := s.user(target); user != "" {
+			return 0, &TargetBusyError{Target: target, Id: user}
+		}
+	}
+	if len(s.running) >= s.maxConcurrent && len(s.queue) >= s.maxQueued {
+		return 0, ErrQueueFull
+	}
+
+	s.accepted.Add(1)
+	s.queue = append(s.queue, &scheduledRun{
+		ScheduledRun: ScheduledRun{Id: id, Kind: kind, Targets: targets},
+		start:        start,
+	})
+	s.dispatch()
+	return s.position(id), nil
+}
+
+// user is the id of the running or queued run using target.
+func (s *stageScheduler) user(target string) string {
+	for _, runs := range [][]*scheduledRun{s.running, s.queue} {
+		for _, run := range runs {
+			if run.uses(target) {
+				return run.Id
+			}
+		}
+	}
+	return ""
+}
+
+// done frees the slot of the run and starts the next queued ones.
+func (s *stageScheduler) done(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, run := range s.running {
+		if run.Id == id {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			s.accepted.Done()
+			break
+		}
+	}
+	s.dispatch()
+}
+
+// close rejects the next runs and drops the queued ones, returning them.
+func (s *stageScheduler) close() []ScheduledRun {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	var dropped []ScheduledRun
+	for _, run := range s.queue {
+		dropped = append(dropped, run.ScheduledRun)
+		s.accepted.Done()
+	}
+	s.queue = nil
+	return dropped
+}
+
+// wait blocks until every running run is done or ctx is, returning the error of ctx
+// along with the runs still running.
+func (s *stageScheduler) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.accepted.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		var ids []string
+		for _, run := range s.status().Running {
+			ids = append(ids, run.Id)
+		}
+		return fmt.Errorf("%v, still running: %s", ctx.Err(), strings.Join(ids, ", "))
+	}
+}
+
+func (s *stageScheduler) dispatch() {
+	for len(s.running) < s.maxConcurrent && len(s.queue) > 0 {
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		s.running = append(s.running, next)
+		go next.start()
+	}
+}
+
+// queuePosition is 0 for runs not waiting in the queue.
+func (s *stageScheduler) queuePosition(id string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.position(id)
+}
+
+func (s *stageScheduler) position(id string) int {
+	for i, run := range s.queue {
+		if run.Id == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (s *stageScheduler) status() QueueStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := QueueStatus{
+		MaxConcurrent: s.maxConcurrent,
+		MaxQueued:     s.maxQueued,
+		Running:       []ScheduledRun{},
+		Queued:        []ScheduledRun{},
+	}
+	for _, run := range s.running {
+		status.Running = append(status.Running, run.ScheduledRun)
+	}
+	for i, run := range s.queue {
+		queued := run.ScheduledRun
+		queued.Position = i + 1
+		status.Queued = append(status.Queued, queued)
+	}
+	return status
+}
+
+func (r *scheduledRun) uses(target string) bool {
+	for _, runTarget := range r.Targets {
+		if runTarget == target {
+			return true
+		}
+	}
+	return false
+}
+
+// stageTargets are the collections of a server a stage uses. Memory repositories and
+// fake servers belong to their stage and are never shared.
+func stageTargets(configs ...TestConfig) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		dbConfig := config.DBConfig
+		if dbConfig.Memory != nil || dbConfig.FakeServer != nil {
+			continue
+		}
+		target := serverName(dbConfig.ConnString) + "/" + dbConfig.DbName + "." + dbConfig.CollectionName
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// serverName identifies a server by its sorted hosts, whatever the credentials and
+// options of the connection string. SRV records aren't resolved.
+func serverName(connString string) string {
+	hosts := connString
+	if i := strings.Index(hosts, "://"); i >= 0 {
+		hosts = hosts[i+3:]
+	}
+	if i := strings.IndexAny(hosts, "/?"); i >= 0 {
+		hosts = hosts[:i]
+	}
+	if i := strings.LastIndex(hosts, "@"); i >= 0 {
+		hosts = hosts[i+1:]
+	}
+	names := strings.Split(strings.ToLower(hosts), ",")
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
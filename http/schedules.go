@@ -0,0 +1,346 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n4d13/mongo_driver_test/cron"
+	"github.com/n4d13/mongo_driver_test/store"
+	"github.com/sirupsen/logrus"
+)
+
+// ScheduleConfig runs a stage every time Cron matches, in Timezone or the local time
+// of the server.
+type ScheduleConfig struct {
+	Name     string     `json:"name"`
+	Cron     string     `json:"cron"`
+	Timezone string     `json:"timezone"`
+	Paused   bool       `json:"paused"`
+	Config   TestConfig `json:"config"`
+}
+
+// Schedule is a schedule created through the API. The stages it triggers are tagged
+// with schedule:<id>.
+type Schedule struct {
+	ScheduleConfig
+	Id      string           `json:"id"`
+	Created time.Time        `json:"created"`
+	NextRun *time.Time       `json:"next_run,omitempty"`
+	LastRun *ScheduleTrigger `json:"last_run,omitempty"`
+
+	expression *cron.Expression
+	location   *time.Location
+}
+
+// ScheduleTrigger is the last time a schedule fired and the stage it started, or why
+// it couldn't.
+type ScheduleTrigger struct {
+	At      time.Time `json:"at"`
+	StageId string    `json:"stage_id,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// ScheduleHistory is a schedule with the summaries of the stages it ran, most recent
+// first.
+type ScheduleHistory struct {
+	Schedule
+	Runs []StageSummary `json:"runs"`
+}
+
+type SchedulePatch struct {
+	Paused *bool `json:"paused"`
+}
+
+func (r *RequestHandler) CreateSchedule(c *gin.Context) {
+	var requestBody ScheduleConfig
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	schedule, validations := newSchedule(requestBody)
+	if len(validations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"validations": fmt.Sprintf("%+v", validations)})
+		return
+	}
+	if err := r.schedules.add(schedule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logrus.Infof("Schedule %s created, running %s next at %v", schedule.Id, schedule.Name, schedule.NextRun)
+	c.JSON(http.StatusCreated, schedule)
+}
+
+func (r *RequestHandler) ListSchedules(c *gin.Context) {
+	c.JSON(http.StatusOK, r.schedules.list())
+}
+
+// GetSchedule returns the schedule with the stages it ran, to follow their trend.
+func (r *RequestHandler) GetSchedule(c *gin.Context) {
+	schedule, ok := r.schedules.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return
+	}
+	runs, err := r.stages.list(StageFilter{Tag: scheduleTag(schedule.Id)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ScheduleHistory{Schedule: schedule, Runs: runs})
+}
+
+// PatchSchedule pauses or resumes a schedule.
+func (r *RequestHandler) PatchSchedule(c *gin.Context) {
+	var requestBody SchedulePatch
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	schedule, err := r.schedules.update(c.Param("id"), func(schedule *Schedule) {
+		if requestBody.Paused != nil {
+			schedule.Paused = *requestBody.Paused
+		}
+	})
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteSchedule stops a schedule, the stages it ran stay in the history.
+func (r *RequestHandler) DeleteSchedule(c *gin.Context) {
+	err := r.schedules.delete(c.Param("id"))
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RunSchedules triggers the due schedules at the start of every minute until ctx is
+// done. Minutes the server was down are not caught up.
+func (r *RequestHandler) RunSchedules(ctx context.Context) {
+	for {
+		minute := time.Now().Truncate(time.Minute).Add(time.Minute)
+		timer := time.NewTimer(time.Until(minute))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		for _, schedule := range r.schedules.due(minute) {
+			r.triggerSchedule(schedule)
+		}
+	}
+}
+
+// triggerSchedule submits the stage of the schedule like a POST would, its thresholds
+// giving the verdict of the run.
+func (r *RequestHandler) triggerSchedule(schedule Schedule) {
+	config := schedule.Config
+	config.Tags = append([]string{scheduleTag(schedule.Id)}, schedule.Config.Tags...)
+	trigger := ScheduleTrigger{At: time.Now()}
+
+	stageImpl, validations := NewStage(&config)
+	if len(validations) > 0 {
+		trigger.Error = strings.Join(validations, ", ")
+	} else if run, _, err := r.submitStage(config, stageImpl); err != nil {
+		trigger.Error = err.Error()
+	} else {
+		trigger.StageId = run.Id
+	}
+
+	if trigger.Error != "" {
+		logrus.Errorf("Schedule %s can't run its stage: %s", schedule.Id, trigger.Error)
+	} else {
+		logrus.Infof("Schedule %s started stage %s", schedule.Id, trigger.StageId)
+	}
+	_, err := r.schedules.update(schedule.Id, func(schedule *Schedule) {
+		schedule.LastRun = &trigger
+	})
+	if err != nil {
+		logrus.Errorf("Schedule %s can't be stored: %v", schedule.Id, err)
+	}
+}
+
+func scheduleTag(id string) string {
+	return "schedule:" + id
+}
+
+// newSchedule validates the expression, the timezone and the stage of the schedule.
+func newSchedule(config ScheduleConfig) (*Schedule, []string) {
+	schedule := &Schedule{ScheduleConfig: config, Id: newStageId(), Created: time.Now()}
+	validations := schedule.compile()
+	if isEmpty(config.Name) {
+		validations = append(validations, "Schedule name is required")
+	}
+	if _, stageValidations := NewStage(&schedule.Config); len(stageValidations) > 0 {
+		validations = append(validations, stageValidations...)
+	}
+	validations = append(validations, pathValidations(schedule.Config)...)
+	if len(validations) > 0 {
+		return nil, validations
+	}
+	schedule.setNextRun()
+	return schedule, nil
+}
+
+// compile parses the expression and loads the timezone of the schedule.
+func (s *Schedule) compile() []string {
+	var validations []string
+	var err error
+	if s.expression, err = cron.Parse(s.Cron); err != nil {
+		validations = append(validations, "Invalid cron expression: "+err.Error())
+	}
+	s.location = time.Local
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			validations = append(validations, "Invalid timezone: "+err.Error())
+		}
+	}
+	return validations
+}
+
+func (s *Schedule) setNextRun() {
+	s.NextRun = nil
+	if s.Paused || s.expression == nil {
+		return
+	}
+	if next := s.expression.Next(time.Now().In(s.location)); !next.IsZero() {
+		s.NextRun = &next
+	}
+}
+
+// scheduleRegistry keeps the schedules, saved in the store when it has one so they
+// survive restarts.
+type scheduleRegistry struct {
+	mutex     sync.RWMutex
+	schedules map[string]*Schedule
+	store     *store.FileStore
+}
+
+func newScheduleRegistry(fileStore *store.FileStore) *scheduleRegistry {
+	registry := &scheduleRegistry{
+		schedules: make(map[string]*Schedule),
+		store:     fileStore,
+	}
+	if fileStore == nil {
+		return registry
+	}
+	err := fileStore.Each(schedulesKind, func(content []byte) error {
+		var schedule Schedule
+		if err := json.Unmarshal(content, &schedule); err != nil {
+			return err
+		}
+		if validations := schedule.compile(); len(validations) > 0 {
+			logrus.Errorf("Schedule %s can't be loaded: %v", schedule.Id, validations)
+			return nil
+		}
+		registry.schedules[schedule.Id] = &schedule
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Schedules can't be loaded: %v", err)
+	}
+	return registry
+}
+
+func (r *scheduleRegistry) add(schedule *Schedule) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.save(schedule); err != nil {
+		return err
+	}
+	r.schedules[schedule.Id] = schedule
+	return nil
+}
+
+func (r *scheduleRegistry) get(id string) (Schedule, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	schedule, ok := r.schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	copied := *schedule
+	copied.setNextRun()
+	return copied, true
+}
+
+// list returns every schedule by creation time.
+func (r *scheduleRegistry) list() []Schedule {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	schedules := []Schedule{}
+	for _, schedule := range r.schedules {
+		copied := *schedule
+		copied.setNextRun()
+		schedules = append(schedules, copied)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Created.Before(schedules[j].Created) })
+	return schedules
+}
+
+func (r *scheduleRegistry) update(id string, change func(*Schedule)) (Schedule, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	schedule, ok := r.schedules[id]
+	if !ok {
+		return Schedule{}, store.ErrNotFound
+	}
+	change(schedule)
+	schedule.setNextRun()
+	return *schedule, r.save(schedule)
+}
+
+func (r *scheduleRegistry) delete(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.schedules[id]; !ok {
+		return store.ErrNotFound
+	}
+	delete(r.schedules, id)
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Delete(schedulesKind, id)
+}
+
+// due returns the active schedules matching minute.
+func (r *scheduleRegistry) due(minute time.Time) []Schedule {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var schedules []Schedule
+	for _, schedule := range r.schedules {
+		if !schedule.Paused && schedule.expression.Matches(minute.In(schedule.location)) {
+			schedules = append(schedules, *schedule)
+		}
+	}
+	return schedules
+}
+
+func (r *scheduleRegistry) save(schedule *Schedule) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Save(schedulesKind, schedule.Id, schedule)
+}
@@ -0,0 +1,172 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/n4d13/mongo_driver_test/scenario"
+	"github.com/sirupsen/logrus"
+)
+
+const maxSweepParameters = 2
+
+// SweepConfig runs a stage for every combination of the values of one or two
+// parameters. Parameters are JSON paths in the base configuration, such as
+// db_config.max_pool_size, or just the field name when it is unique.
+type SweepConfig struct {
+	Name       string               `json:"name"`
+	Base       TestConfig           `json:"base"`
+	Setup      *SetupConfig         `json:"setup"`
+	Parameters []scenario.Parameter `json:"parameters"`
+	PauseSecs  uint                 `json:"pause_secs"`
+}
+
+func (r *RequestHandler) RunSweep(c *gin.Context) {
+	var requestBody SweepConfig
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scenarioConfig, validations := requestBody.ScenarioConfig()
+	if len(validations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"validations": fmt.Sprintf("%+v", validations)})
+		return
+	}
+
+	var run ScenarioRun
+	scenarioImpl, validations := NewScenario(scenarioConfig, r.registeredStage(&run))
+	validations = append(validations, scenarioConfig.pathValidations()...)
+	if len(validations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"validations": fmt.Sprintf("%+v", validations)})
+		return
+	}
+
+	logrus.Infof("Running sweep %s with %d combinations", scenarioImpl.Name, len(scenarioImpl.Steps))
+
+	run = r.scenarios.add(*scenarioConfig, &requestBody, StatusQueued)
+	position, err := r.scheduler.submit(run.Id, KindScenario, scenarioConfig.targets(), func() {
+		defer r.scheduler.done(run.Id)
+		r.scenarios.start(run.Id)
+		report := scenarioImpl.Run(r.runCtx)
+		r.scenarios.finish(run.Id, report, scenario.NewMatrix(requestBody.Parameters, report))
+	})
+	if err != nil {
+		r.scenarios.discard(run.Id)
+		rejectRun(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, scheduledResponse(run.Id, position))
+}
+
+// ScenarioConfig expands the sweep in a scenario running every combination in order.
+func (s *SweepConfig) ScenarioConfig() (*ScenarioConfig, []string) {
+	var validations []string
+	if len(s.Parameters) == 0 || len(s.Parameters) > maxSweepParameters {
+		validations = append(validations, "Sweeps need one or two parameters")
+	}
+
+	base, err := jsonObject(s.Base)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	paths := make([][]string, len(s.Parameters))
+	for i, parameter := range s.Parameters {
+		if len(parameter.Values) == 0 {
+			validations = append(validations, fmt.Sprintf("Parameter %s needs values", parameter.Name))
+		}
+		paths[i], err = resolvePath(base, parameter.Name)
+		if err != nil {
+			validations = append(validations, err.Error())
+		}
+	}
+	if len(validations) > 0 {
+		return nil, validations
+	}
+
+	name := s.Name
+	if name == "" {
+		name = "sweep"
+	}
+	scenarioConfig := &ScenarioConfig{
+		Name:  name,
+		Base:  s.Base,
+		Setup: s.Setup,
+	}
+	for _, values := range scenario.Combinations(s.Parameters) {
+		override := map[string]interface{}{}
+		for i, value := range values {
+			setPath(override, paths[i], value)
+		}
+		config, err := json.Marshal(override)
+		if err != nil {
+			return nil, []string{err.Error()}
+		}
+		scenarioConfig.Stages = append(scenarioConfig.Stages, ScenarioStage{
+			Name:      scenario.CombinationName(s.Parameters, values),
+			PauseSecs: s.PauseSecs,
+			Config:    config,
+		})
+	}
+	return scenarioConfig, nil
+}
+
+// sweepSections are searched, in order, for parameters given by field name.
+var sweepSections = []string{"db_config", "stage_config", "thresholds", "abort"}
+
+// resolvePath splits a parameter in the keys leading to it, checking it exists in
+// the base configuration. Paths going through an unset section are accepted.
+func resolvePath(base map[string]interface{}, name string) ([]string, error) {
+	if !strings.Contains(name, ".") {
+		for _, section := range sweepSections {
+			if fields, ok := base[section].(map[string]interface{}); ok {
+				if _, ok = fields[name]; ok {
+					return []string{section, name}, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("unknown parameter %s", name)
+	}
+
+	path := strings.Split(name, ".")
+	current := base
+	for i, key := range path {
+		value, ok := current[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+		if i == len(path)-1 || value == nil {
+			break
+		}
+		if current, ok = value.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("parameter %s goes through %s, which is not an object", name, key)
+		}
+	}
+	return path, nil
+}
+
+func setPath(object map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := object[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			object[key] = next
+		}
+		object = next
+	}
+	object[path[len(path)-1]] = value
+}
+
+func jsonObject(value interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	err = json.Unmarshal(content, &object)
+	return object, err
+}
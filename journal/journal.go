@@ -0,0 +1,228 @@
+package journal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Record types.
+const (
+	TypePool = "pool"
+	// TypeTopology records the pools of the servers being created, cleared and
+	// closed, the driver doesn't publish other topology changes.
+	TypeTopology  = "topology"
+	TypeCommand   = "command"
+	TypeOperation = "operation"
+	TypePhase     = "phase"
+	TypeEvent     = "event"
+)
+
+// Command record events.
+const (
+	CommandStarted   = "CommandStarted"
+	CommandSucceeded = "CommandSucceeded"
+	CommandFailed    = "CommandFailed"
+)
+
+// Record is a line of the journal, Time is in nanoseconds since the Unix epoch.
+type Record struct {
+	Time         int64  `json:"t"`
+	Type         string `json:"type"`
+	Event        string `json:"event,omitempty"`
+	Address      string `json:"address,omitempty"`
+	ConnectionId uint64 `json:"connection_id,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	Command      string `json:"command,omitempty"`
+	RequestId    int64  `json:"request_id,omitempty"`
+	Connection   string `json:"connection,omitempty"`
+	DurationNs   int64  `json:"duration_ns,omitempty"`
+	Failure      string `json:"failure,omitempty"`
+	ErrorKind    string `json:"error_kind,omitempty"`
+	Docs         int    `json:"docs,omitempty"`
+	Bytes        int64  `json:"bytes,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// PoolEvent rebuilds the driver event of a pool or topology record.
+func (r Record) PoolEvent() *event.PoolEvent {
+	return &event.PoolEvent{
+		Type:         r.Event,
+		Address:      r.Address,
+		ConnectionID: r.ConnectionId,
+		Reason:       r.Reason,
+	}
+}
+
+// Writer appends records to a journal file, its methods do nothing on a nil Writer
+// so callers don't need to check whether the stage keeps a journal.
+type Writer struct {
+	mutex      sync.Mutex
+	file       *os.File
+	compressor *gzip.Writer
+	buffer     *bufio.Writer
+	encoder    *json.Encoder
+	err        error
+}
+
+// Create opens path for appending, compressing with gzip when compress is set.
+func Create(path string, compress bool) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{file: file}
+	var out io.Writer = file
+	if compress {
+		w.compressor = gzip.NewWriter(file)
+		out = w.compressor
+	}
+	w.buffer = bufio.NewWriterSize(out, 64*1024)
+	w.encoder = json.NewEncoder(w.buffer)
+	return w, nil
+}
+
+// Write keeps the first error, returned by Close.
+func (w *Writer) Write(record Record) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = w.encoder.Encode(record)
+	}
+}
+
+func (w *Writer) Pool(poolEvent *event.PoolEvent) {
+	if w == nil {
+		return
+	}
+	recordType := TypePool
+	switch poolEvent.Type {
+	case event.PoolCreated, event.PoolCleared, event.PoolClosedEvent:
+		recordType = TypeTopology
+	}
+	w.Write(Record{
+		Time:         now(),
+		Type:         recordType,
+		Event:        poolEvent.Type,
+		Address:      poolEvent.Address,
+		ConnectionId: poolEvent.ConnectionID,
+		Reason:       poolEvent.Reason,
+	})
+}
+
+// CommandMonitor records the commands sent by a client.
+func (w *Writer) CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, started *event.CommandStartedEvent) {
+			w.Write(Record{Time: now(), Type: TypeCommand, Event: CommandStarted, Command: started.CommandName,
+				RequestId: started.RequestID, Connection: started.ConnectionID})
+		},
+		Succeeded: func(_ context.Context, succeeded *event.CommandSucceededEvent) {
+			w.Write(Record{Time: now(), Type: TypeCommand, Event: CommandSucceeded, Command: succeeded.CommandName,
+				RequestId: succeeded.RequestID, Connection: succeeded.ConnectionID, DurationNs: succeeded.DurationNanos})
+		},
+		Failed: func(_ context.Context, failed *event.CommandFailedEvent) {
+			w.Write(Record{Time: now(), Type: TypeCommand, Event: CommandFailed, Command: failed.CommandName,
+				RequestId: failed.RequestID, Connection: failed.ConnectionID, DurationNs: failed.DurationNanos,
+				Failure: failed.Failure})
+		},
+	}
+}
+
+// Operation records a query of the stage once it finished, errorKind is empty when
+// it succeeded.
+func (w *Writer) Operation(spent time.Duration, docs int, bytes int64, errorKind string, failure string) {
+	w.Write(Record{Time: now(), Type: TypeOperation, DurationNs: int64(spent), Docs: docs, Bytes: bytes,
+		ErrorKind: errorKind, Failure: failure})
+}
+
+func (w *Writer) Phase(phase string) {
+	w.Write(Record{Time: now(), Type: TypePhase, Phase: phase})
+}
+
+func (w *Writer) Event(message string) {
+	w.Write(Record{Time: now(), Type: TypeEvent, Message: message})
+}
+
+// Close flushes the pending records and closes the file.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	errs := []error{w.err, w.buffer.Flush()}
+	if w.compressor != nil {
+		errs = append(errs, w.compressor.Close())
+	}
+	errs = append(errs, w.file.Close())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read calls each with every record of the journal at path, compressed or not. A
+// journal cut by a crash ends at its last complete record.
+func Read(path string, each func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var in io.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		in = decompressor
+	}
+
+	decoder := json.NewDecoder(in)
+	for {
+		var record Record
+		err := decoder.Decode(&record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = each(record); err != nil {
+			return err
+		}
+	}
+}
+
+// FileName names the journal of a stage.
+func FileName(id string, compress bool) string {
+	if compress {
+		return id + ".ndjson.gz"
+	}
+	return id + ".ndjson"
+}
+
+func now() int64 {
+	return time.Now().UnixNano()
+}
@@ -1,26 +1,72 @@
 package main
 
 import (
-	"strconv"
+	"fmt"
+	"os"
 
+	"github.com/n4d13/mongo_driver_test/cli"
 	"github.com/n4d13/mongo_driver_test/config"
 	"github.com/n4d13/mongo_driver_test/http"
+	"github.com/n4d13/mongo_driver_test/store"
 	"github.com/sirupsen/logrus"
 )
 
+const usage = `Usage:
+  mongo_driver_test [serve]           start the HTTP server
+  mongo_driver_test run -f FILE       run the stage in FILE (JSON or YAML) and print its result
+  mongo_driver_test scenario -f FILE  run the scenario in FILE and print its report
+  mongo_driver_test sweep -f FILE     run every combination of the sweep in FILE and print its matrix
+  mongo_driver_test compare ID ID...  diff stored stage runs against the first one
+  mongo_driver_test export ID         write a stored stage as CSV, JSON Lines or an HTML report
+  mongo_driver_test analyze -f FILE   rebuild the pool stats, latencies and timeline from a stage journal`
+
 func main() {
 
-	appConfig := config.LoadConfig()
+	logrus.SetFormatter(&logrus.JSONFormatter{})
 
-	handler := http.NewRequestHandler()
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
 
-	server, err := http.ConfigureRoutes(handler, appConfig)
-	if err != nil {
-		logrus.Fatal(err)
+	switch command {
+	case "serve":
+		serve()
+	case "run":
+		os.Exit(cli.RunStage(args))
+	case "scenario":
+		os.Exit(cli.RunScenario(args))
+	case "sweep":
+		os.Exit(cli.RunSweep(args))
+	case "compare":
+		os.Exit(cli.CompareStages(args))
+	case "export":
+		os.Exit(cli.ExportStage(args))
+	case "analyze":
+		os.Exit(cli.AnalyzeJournal(args))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(cli.ExitUsage)
 	}
+}
 
-	logrus.SetFormatter(&logrus.JSONFormatter{})
+func serve() {
 
-	server.Run(":" + strconv.Itoa(appConfig.Port))
+	appConfig := config.LoadConfig()
+
+	var fileStore *store.FileStore
+	if appConfig.DataDir != "" {
+		var err error
+		if fileStore, err = store.NewFileStore(appConfig.DataDir); err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Keeping the history of the runs in %s", appConfig.DataDir)
+	}
+
+	handler := http.NewRequestHandler(fileStore, appConfig.MaxConcurrentStages, appConfig.MaxQueuedStages)
+
+	if err := http.Serve(handler, appConfig); err != nil {
+		logrus.Fatal(err)
+	}
 
 }
@@ -0,0 +1,120 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recorded operation kinds.
+const (
+	RecordedFind       = "find"
+	RecordedAddWorkers = "add_workers"
+)
+
+// Recorded is a line of a recording: a generated query, with the keys it asked
+// for, the offset it was meant to start at and the worker running it, or workers
+// being added to the stage.
+type Recorded struct {
+	AtNs    int64    `json:"at_ns"`
+	Op      string   `json:"op"`
+	Keys    []string `json:"keys,omitempty"`
+	Worker  int      `json:"worker"`
+	Workers int      `json:"workers,omitempty"`
+}
+
+// WorkersChange adds Count workers At an offset of a recorded workload.
+type WorkersChange struct {
+	At    time.Duration
+	Count int
+}
+
+// Recorder writes a recording, its methods do nothing on a nil Recorder.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	buffer  *bufio.Writer
+	encoder *json.Encoder
+	err     error
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buffer := bufio.NewWriterSize(file, 64*1024)
+	return &Recorder{file: file, buffer: buffer, encoder: json.NewEncoder(buffer)}, nil
+}
+
+// Write keeps the first error, returned by Close.
+func (r *Recorder) Write(recorded Recorded) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = r.encoder.Encode(recorded)
+	}
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, err := range []error{r.err, r.buffer.Flush(), r.file.Close()} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRecording tells whether the first entry of a file comes from a recording.
+func isRecording(raw json.RawMessage) bool {
+	var probe struct {
+		AtNs *int64 `json:"at_ns"`
+	}
+	return json.Unmarshal(raw, &probe) == nil && probe.AtNs != nil
+}
+
+// loadRecording builds the workload of a recording, its finds query the recorded
+// keys.
+func loadRecording(entries []json.RawMessage) (*Workload, error) {
+	workload := &Workload{}
+	for _, raw := range entries {
+		var recorded Recorded
+		if err := json.Unmarshal(raw, &recorded); err != nil {
+			return nil, err
+		}
+		at := time.Duration(recorded.AtNs)
+		switch {
+		case recorded.Op == RecordedFind && len(recorded.Keys) > 0:
+			workload.Operations = append(workload.Operations, Operation{At: at, Kind: KindFind,
+				Keys: recorded.Keys, Worker: recorded.Worker})
+		case recorded.Op == RecordedAddWorkers && recorded.Workers > 0:
+			workload.Workers = append(workload.Workers, WorkersChange{At: at, Count: recorded.Workers})
+		default:
+			workload.Skipped++
+		}
+	}
+	if len(workload.Operations) == 0 {
+		return nil, errors.New("recording has no operation to replay")
+	}
+	sort.SliceStable(workload.Operations, func(i, j int) bool {
+		return workload.Operations[i].At < workload.Operations[j].At
+	})
+	sort.SliceStable(workload.Workers, func(i, j int) bool { return workload.Workers[i].At < workload.Workers[j].At })
+	return workload, nil
+}
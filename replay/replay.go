@@ -0,0 +1,288 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Operation kinds replayed.
+const (
+	KindFind      = "find"
+	KindAggregate = "aggregate"
+	KindUpdate    = "update"
+)
+
+// Operation is a command captured from the server, At is its offset from the
+// first captured operation.
+type Operation struct {
+	At         time.Duration
+	Kind       string
+	Namespace  string
+	Filter     bson.D
+	Projection bson.D
+	Sort       bson.D
+	Skip       int64
+	Limit      int64
+	Pipeline   bson.A
+	// Update is an update document or an aggregation pipeline.
+	Update interface{}
+	Multi  bool
+	Upsert bool
+	// Keys are the store ids of a recorded find, queried like the stage generates
+	// them, and Worker the one that ran it.
+	Keys   []string
+	Worker int
+}
+
+// Workload is the traffic read from a capture, sorted by time.
+type Workload struct {
+	Operations []Operation
+	// Skipped counts the entries that aren't find, aggregate or update commands on
+	// the namespace, or that can't be replayed.
+	Skipped int
+	// Workers are the workers added by a recorded stage.
+	Workers []WorkersChange
+}
+
+// Span is the time between the first and the last operation.
+func (w *Workload) Span() time.Duration {
+	if len(w.Operations) == 0 {
+		return 0
+	}
+	return w.Operations[len(w.Operations)-1].At
+}
+
+// Load reads a system.profile export, as JSON lines or a JSON array, mongod 4.4+
+// JSON log lines or a recording. When namespace is set, only its captured
+// operations are kept.
+func Load(path string, namespace string) (*Workload, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	decoder := json.NewDecoder(reader)
+	if first, err := firstByte(reader); err == nil && first == '[' {
+		if _, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []json.RawMessage
+	for decoder.More() {
+		var raw json.RawMessage
+		if err = decoder.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("entry %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, raw)
+	}
+	if len(entries) > 0 && isRecording(entries[0]) {
+		return loadRecording(entries)
+	}
+
+	workload := &Workload{}
+	var times []time.Time
+	for i, raw := range entries {
+		entry := i + 1
+		at, operations, err := parseEntry(raw)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", entry, err)
+		}
+		for _, operation := range operations {
+			if namespace != "" && operation.Namespace != namespace {
+				operation.Kind = ""
+			}
+			if operation.Kind == "" {
+				workload.Skipped++
+				continue
+			}
+			workload.Operations = append(workload.Operations, operation)
+			times = append(times, at)
+		}
+		if len(operations) == 0 {
+			workload.Skipped++
+		}
+	}
+	if len(workload.Operations) == 0 {
+		return nil, errors.New("no find, aggregate or update operation to replay in " + path)
+	}
+
+	indexes := make([]int, len(times))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool { return times[indexes[i]].Before(times[indexes[j]]) })
+	first := times[indexes[0]]
+	sorted := make([]Operation, len(indexes))
+	for i, index := range indexes {
+		sorted[i] = workload.Operations[index]
+		sorted[i].At = times[index].Sub(first)
+	}
+	workload.Operations = sorted
+	return workload, nil
+}
+
+func firstByte(reader *bufio.Reader) (byte, error) {
+	for {
+		peeked, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(peeked[0])) {
+			return peeked[0], nil
+		}
+		_, _ = reader.ReadByte()
+	}
+}
+
+// parseEntry returns the time of an entry and its operations, with an empty kind
+// for the commands that aren't replayed.
+func parseEntry(raw json.RawMessage) (time.Time, []Operation, error) {
+	var entry bson.Raw
+	if err := bson.UnmarshalExtJSON(bytes.TrimSpace(raw), false, &entry); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	// mongod logs keep the command under attr, the profiler at the top level.
+	if attr, ok := entry.Lookup("attr").DocumentOK(); ok {
+		at, err := timeOf(entry.Lookup("t"))
+		if err != nil {
+			return at, nil, err
+		}
+		operationType, _ := attr.Lookup("type").StringValueOK()
+		namespace, _ := attr.Lookup("ns").StringValueOK()
+		command, ok := attr.Lookup("command").DocumentOK()
+		if !ok {
+			return at, nil, nil
+		}
+		return at, operations(operationType, namespace, command), nil
+	}
+
+	at, err := timeOf(entry.Lookup("ts"))
+	if err != nil {
+		return at, nil, err
+	}
+	operationType, _ := entry.Lookup("op").StringValueOK()
+	namespace, _ := entry.Lookup("ns").StringValueOK()
+	command, ok := entry.Lookup("command").DocumentOK()
+	if !ok {
+		return at, nil, nil
+	}
+	return at, operations(operationType, namespace, command), nil
+}
+
+func timeOf(value bson.RawValue) (time.Time, error) {
+	if dateTime, ok := value.DateTimeOK(); ok {
+		return time.Unix(0, dateTime*int64(time.Millisecond)), nil
+	}
+	return time.Time{}, errors.New("entry has no date")
+}
+
+// operations reads a command. Updates logged on their own have the q and u fields
+// of an update statement, update commands may hold several statements.
+func operations(operationType string, namespace string, command bson.Raw) []Operation {
+	if operationType == "update" {
+		return []Operation{updateStatement(namespace, command)}
+	}
+
+	var document bson.D
+	if err := bson.Unmarshal(command, &document); err != nil || len(document) == 0 {
+		return nil
+	}
+	fields := document.Map()
+	if collection, ok := document[0].Value.(string); ok && namespace != "" {
+		namespace = namespace[:strings.Index(namespace+".", ".")] + "." + collection
+	}
+
+	switch document[0].Key {
+	case KindFind:
+		return []Operation{{
+			Kind:       KindFind,
+			Namespace:  namespace,
+			Filter:     asDocument(fields["filter"]),
+			Projection: asDocument(fields["projection"]),
+			Sort:       asDocument(fields["sort"]),
+			Skip:       asInt(fields["skip"]),
+			Limit:      asInt(fields["limit"]),
+		}}
+	case KindAggregate:
+		pipeline, _ := fields["pipeline"].(bson.A)
+		operation := Operation{Kind: KindAggregate, Namespace: namespace, Pipeline: pipeline}
+		if writesOutput(pipeline) {
+			operation.Kind = ""
+		}
+		return []Operation{operation}
+	case KindUpdate:
+		statements, _ := fields["updates"].(bson.A)
+		var updates []Operation
+		for _, statement := range statements {
+			raw, err := bson.Marshal(statement)
+			if err != nil {
+				continue
+			}
+			updates = append(updates, updateStatement(namespace, raw))
+		}
+		return updates
+	}
+	return []Operation{{}}
+}
+
+func updateStatement(namespace string, statement bson.Raw) Operation {
+	var document bson.D
+	if err := bson.Unmarshal(statement, &document); err != nil {
+		return Operation{}
+	}
+	fields := document.Map()
+	operation := Operation{
+		Kind:      KindUpdate,
+		Namespace: namespace,
+		Filter:    asDocument(fields["q"]),
+		Update:    fields["u"],
+	}
+	operation.Multi, _ = fields["multi"].(bool)
+	operation.Upsert, _ = fields["upsert"].(bool)
+	if operation.Update == nil {
+		operation.Kind = ""
+	}
+	return operation
+}
+
+// writesOutput tells whether a pipeline writes to another collection, those are
+// never replayed.
+func writesOutput(pipeline bson.A) bool {
+	for _, stage := range pipeline {
+		document, ok := stage.(bson.D)
+		if ok && len(document) > 0 && (document[0].Key == "$out" || document[0].Key == "$merge") {
+			return true
+		}
+	}
+	return false
+}
+
+func asDocument(value interface{}) bson.D {
+	document, _ := value.(bson.D)
+	return document
+}
+
+func asInt(value interface{}) int64 {
+	switch number := value.(type) {
+	case int32:
+		return int64(number)
+	case int64:
+		return number
+	case float64:
+		return int64(number)
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+type ErrorKind string
+
+const (
+	KindTimeout      ErrorKind = "timeout"
+	KindPoolTimeout  ErrorKind = "pool_timeout"
+	KindPool         ErrorKind = "pool"
+	KindNetwork      ErrorKind = "network"
+	KindCanceled     ErrorKind = "canceled"
+	KindDuplicateKey ErrorKind = "duplicate_key"
+	KindServer       ErrorKind = "server"
+	KindUnknown      ErrorKind = "unknown"
+)
+
+const maxTimeMSExpiredCode = 50
+
+// OperationError is returned by every TestRepository operation.
+type OperationError struct {
+	Op     string
+	Kind   ErrorKind
+	Server string
+	Err    error
+}
+
+func (e *OperationError) Error() string {
+	if e.Server != "" {
+		return fmt.Sprintf("%s on %s failed (%s): %v", e.Op, e.Server, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s failed (%s): %v", e.Op, e.Kind, e.Err)
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of an error returned by a TestRepository.
+func KindOf(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+	var operationError *OperationError
+	if errors.As(err, &operationError) {
+		return operationError.Kind
+	}
+	return classify(err)
+}
+
+func newOperationError(op string, server string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OperationError{
+		Op:     op,
+		Kind:   classify(err),
+		Server: server,
+		Err:    err,
+	}
+}
+
+func classify(err error) ErrorKind {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return KindCanceled
+	case errors.Is(err, errPoolTimeout), errors.Is(err, topology.ErrWaitQueueTimeout):
+		return KindPoolTimeout
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrExceededTimeLimit):
+		return KindTimeout
+	case errors.Is(err, ErrInjected):
+		return KindServer
+	}
+
+	switch e := err.(type) {
+	case topology.PoolError:
+		// checking out from a closed pool, a connection returned to the wrong pool...
+		return KindPool
+	case topology.ConnectionError:
+		return KindNetwork
+	case mongo.CommandError:
+		switch {
+		case e.Code == maxTimeMSExpiredCode:
+			return KindTimeout
+		case e.Code == duplicateKeyCode:
+			return KindDuplicateKey
+		case e.HasErrorLabel("NetworkError"):
+			return KindNetwork
+		}
+		return KindServer
+	case mongo.BulkWriteException:
+		if onlyDuplicateKeyErrors(e) {
+			return KindDuplicateKey
+		}
+		return KindServer
+	case mongo.WriteException:
+		return KindServer
+	}
+
+	if strings.Contains(err.Error(), "context deadline exceeded") {
+		return KindTimeout
+	}
+	return KindUnknown
+}
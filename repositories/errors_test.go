@@ -0,0 +1,35 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{topology.ErrWaitQueueTimeout, KindPoolTimeout},
+		{fmt.Errorf("%w: %v", errPoolTimeout, context.DeadlineExceeded), KindPoolTimeout},
+		{topology.ErrPoolDisconnected, KindPool},
+		{topology.ErrPoolConnected, KindPool},
+		{topology.ErrWrongPool, KindPool},
+		{topology.ConnectionError{ConnectionID: "memory[-1]"}, KindNetwork},
+		{mongo.CommandError{Code: maxTimeMSExpiredCode}, KindTimeout},
+		{mongo.CommandError{Code: duplicateKeyCode}, KindDuplicateKey},
+		{mongo.CommandError{Code: 2}, KindServer},
+		{context.Canceled, KindCanceled},
+		{context.DeadlineExceeded, KindTimeout},
+		{&OperationError{Op: "find", Kind: KindNetwork}, KindNetwork},
+	}
+	for _, test := range tests {
+		if kind := KindOf(test.err); kind != test.kind {
+			t.Errorf("%v: expected %s, got %s", test.err, test.kind, kind)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package repositories
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const failPointTimeout = 5 * time.Second
+
+// FailPoint is a configureFailPoint command. Mode is either a string such as
+// "alwaysOn" or a document such as {"times": 3}. The server must run with test
+// commands enabled.
+type FailPoint struct {
+	Name string
+	Mode interface{}
+	Data map[string]interface{}
+}
+
+// FailPointClient configures fail points using its own connections, outside of
+// the pool being tested. On a replica set it connects to every member, as the
+// stages read from the secondaries.
+type FailPointClient struct {
+	clients []*mongo.Client
+}
+
+func NewFailPointClient(config *MongoDBConfiguration) (*FailPointClient, error) {
+	client, err := connectAdmin(options.Client().ApplyURI(config.ConnString))
+	if err != nil {
+		return nil, err
+	}
+	members, err := replicaSetMembers(client)
+	if err != nil {
+		_ = client.Disconnect(context.TODO())
+		return nil, err
+	}
+	if len(members) == 0 {
+		return &FailPointClient{clients: []*mongo.Client{client}}, nil
+	}
+	_ = client.Disconnect(context.TODO())
+
+	failPoints := &FailPointClient{}
+	for _, member := range members {
+		client, err := connectAdmin(options.Client().ApplyURI(config.ConnString).
+			SetHosts([]string{member}).
+			SetDirect(true))
+		if err != nil {
+			failPoints.Close()
+			return nil, err
+		}
+		failPoints.clients = append(failPoints.clients, client)
+	}
+	return failPoints, nil
+}
+
+// connectAdmin connects without the pool settings of the stage nor its index.
+func connectAdmin(clientOptions *options.ClientOptions) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), failPointTimeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, clientOptions.SetMaxPoolSize(1))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.TODO())
+		return nil, err
+	}
+	return client, nil
+}
+
+// replicaSetMembers lists the data bearing members of the replica set, none for a
+// standalone server or a mongos.
+func replicaSetMembers(client *mongo.Client) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), failPointTimeout)
+	defer cancel()
+	var isMaster struct {
+		Hosts    []string `bson:"hosts"`
+		Passives []string `bson:"passives"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&isMaster)
+	if err != nil {
+		return nil, err
+	}
+	return append(isMaster.Hosts, isMaster.Passives...), nil
+}
+
+func (f *FailPointClient) Configure(failPoint FailPoint) error {
+	command := bson.D{
+		{Key: "configureFailPoint", Value: failPoint.Name},
+		{Key: "mode", Value: normalizeNumbers(failPoint.Mode)},
+	}
+	if len(failPoint.Data) > 0 {
+		command = append(command, bson.E{Key: "data", Value: normalizeNumbers(failPoint.Data)})
+	}
+	return f.run(command)
+}
+
+func (f *FailPointClient) Off(name string) error {
+	return f.run(bson.D{
+		{Key: "configureFailPoint", Value: name},
+		{Key: "mode", Value: "off"},
+	})
+}
+
+func (f *FailPointClient) Close() {
+	for _, client := range f.clients {
+		_ = client.Disconnect(context.TODO())
+	}
+}
+
+// run sends the command to every member, stopping on the first one failing.
+func (f *FailPointClient) run(command bson.D) error {
+	ctx, cancel := context.WithTimeout(context.Background(), failPointTimeout)
+	defer cancel()
+	for _, client := range f.clients {
+		if err := client.Database("admin").RunCommand(ctx, command).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeNumbers turns whole floats decoded from JSON into integers, the server
+// rejects doubles for fields such as errorCode.
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return int32(v)
+		}
+		return v
+	case map[string]interface{}:
+		result := make(bson.M, len(v))
+		for key, item := range v {
+			result[key] = normalizeNumbers(item)
+		}
+		return result
+	case []interface{}:
+		result := make(bson.A, 0, len(v))
+		for _, item := range v {
+			result = append(result, normalizeNumbers(item))
+		}
+		return result
+	}
+	return value
+}
@@ -0,0 +1,40 @@
+package repositories
+
+import (
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+const duplicateKeyCode = 11000
+
+type InsertOptions struct {
+	Ordered      bool
+	WriteConcern string
+	// IgnoreDuplicates makes retried batches succeed when their documents were already written.
+	IgnoreDuplicates bool
+}
+
+func parseWriteConcern(w string) *writeconcern.WriteConcern {
+	if w == "majority" {
+		return writeconcern.New(writeconcern.WMajority())
+	}
+	if n, err := strconv.Atoi(w); err == nil {
+		return writeconcern.New(writeconcern.W(n))
+	}
+	return writeconcern.New(writeconcern.WTagSet(w))
+}
+
+func onlyDuplicateKeyErrors(err error) bool {
+	bulkErr, ok := err.(mongo.BulkWriteException)
+	if !ok || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != duplicateKeyCode {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,348 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	LatencyFixed       = "fixed"
+	LatencyUniform     = "uniform"
+	LatencyNormal      = "normal"
+	LatencyExponential = "exponential"
+)
+
+const memoryAddress = "memory"
+
+var (
+	ErrInjected          = errors.New("error injected by memory repository")
+	ErrExceededTimeLimit = errors.New("operation exceeded time limit")
+	errPoolTimeout       = errors.New("timed out while checking out a connection from connection pool")
+)
+
+type LatencyDistribution struct {
+	Type   string
+	Mean   time.Duration
+	StdDev time.Duration
+	Min    time.Duration
+	Max    time.Duration
+}
+
+func (l LatencyDistribution) Validate() error {
+	switch l.Type {
+	case "", LatencyFixed, LatencyNormal, LatencyExponential:
+	case LatencyUniform:
+		if l.Max < l.Min {
+			return fmt.Errorf("uniform latency needs max greater than min")
+		}
+	default:
+		return fmt.Errorf("unknown latency distribution %q", l.Type)
+	}
+	return nil
+}
+
+func (l LatencyDistribution) sample(random *rand.Rand) time.Duration {
+	var latency time.Duration
+	switch l.Type {
+	case LatencyUniform:
+		latency = l.Min
+		if l.Max > l.Min {
+			latency += time.Duration(random.Int63n(int64(l.Max - l.Min)))
+		}
+	case LatencyNormal:
+		latency = l.Mean + time.Duration(random.NormFloat64()*float64(l.StdDev))
+	case LatencyExponential:
+		latency = time.Duration(random.ExpFloat64() * float64(l.Mean))
+	default:
+		latency = l.Mean
+	}
+	if latency < 0 {
+		return 0
+	}
+	return latency
+}
+
+type MemoryConfiguration struct {
+	Latency   LatencyDistribution
+	ErrorRate float64
+	MaxPool   uint64
+	// WaitQueueTimeout bounds how long a query waits for a connection, besides its context timeout.
+	WaitQueueTimeout time.Duration
+}
+
+// memoryRepository keeps stores in memory and simulates the latency, errors and
+// connection pool of a real database, publishing the same pool events as the driver.
+type memoryRepository struct {
+	config     MemoryConfiguration
+	mutex      sync.RWMutex
+	stores     map[string]Store
+	storeIds   []string
+	queryCount int64
+	pool       *simulatedPool
+	randMutex  sync.Mutex
+	random     *rand.Rand
+}
+
+// NewMemoryRepository samples latencies, injected errors and store ids from random,
+// a time seeded source when nil.
+func NewMemoryRepository(config MemoryConfiguration, random *rand.Rand, monitorFunc func(*event.PoolEvent)) TestRepository {
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	logrus.Info("A MemoryRepository was initialized")
+	return &memoryRepository{
+		config: config,
+		stores: make(map[string]Store),
+		pool:   newSimulatedPool(config.MaxPool, monitorFunc),
+		random: random,
+	}
+}
+
+func (m *memoryRepository) GetStores(ctx context.Context, ids []string, queryOptions QueryOptions) (QueryResult, error) {
+	atomic.AddInt64(&m.queryCount, 1)
+
+	result := QueryResult{OperationInfo: OperationInfo{Server: memoryAddress}}
+	start := time.Now()
+	err := m.find(ctx, ids, queryOptions, &result)
+	result.Duration = time.Since(start)
+	return result, newOperationError("find", memoryAddress, err)
+}
+
+func (m *memoryRepository) find(ctx context.Context, ids []string, queryOptions QueryOptions, result *QueryResult) error {
+	if err := m.simulate(ctx, queryOptions); err != nil {
+		return err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if store, ok := m.stores[id]; ok {
+			result.Stores = append(result.Stores, store)
+			result.Docs++
+			result.Bytes += int64(len(store.Id) + len(store.StoreId) + len(store.Name) + len(store.HugeValue))
+			if queryOptions.Limit > 0 && result.Docs == int(queryOptions.Limit) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// simulate holds a connection for the sampled latency and fails like the
+// configuration says.
+func (m *memoryRepository) simulate(ctx context.Context, queryOptions QueryOptions) error {
+	release, err := m.pool.checkOut(ctx, m.config.WaitQueueTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	latency, failed := m.roll()
+	maxTime := time.Duration(queryOptions.QueryTimeoutMs) * time.Millisecond
+	exceeded := maxTime > 0 && latency > maxTime
+	if exceeded {
+		latency = maxTime
+	}
+	select {
+	case <-time.After(latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if exceeded {
+		return ErrExceededTimeLimit
+	}
+	if failed {
+		return ErrInjected
+	}
+	return nil
+}
+
+func (m *memoryRepository) roll() (time.Duration, bool) {
+	m.randMutex.Lock()
+	defer m.randMutex.Unlock()
+	return m.config.Latency.sample(m.random), m.config.ErrorRate > 0 && m.random.Float64() < m.config.ErrorRate
+}
+
+func (m *memoryRepository) Insert(_ context.Context, stores []Store, insertOptions InsertOptions) (OperationInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	info := OperationInfo{Server: memoryAddress}
+	start := time.Now()
+	for _, store := range stores {
+		if _, ok := m.stores[store.StoreId]; ok {
+			if insertOptions.IgnoreDuplicates {
+				continue
+			}
+			info.Duration = time.Since(start)
+			return info, &OperationError{
+				Op:     "insert",
+				Kind:   KindDuplicateKey,
+				Server: memoryAddress,
+				Err:    fmt.Errorf("duplicate store_id %s", store.StoreId),
+			}
+		}
+		m.stores[store.StoreId] = store
+		m.storeIds = append(m.storeIds, store.StoreId)
+		info.Docs++
+	}
+	info.Duration = time.Since(start)
+	return info, nil
+}
+
+func (m *memoryRepository) Count(_ context.Context) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return int64(len(m.stores)), nil
+}
+
+func (m *memoryRepository) QueryCount() int64 {
+	return atomic.LoadInt64(&m.queryCount)
+}
+
+func (m *memoryRepository) Close(ctx context.Context) error {
+	m.pool.close(ctx)
+	return nil
+}
+
+func (m *memoryRepository) Clear(_ context.Context) error {
+	m.mutex.Lock()
+	m.stores = make(map[string]Store)
+	m.storeIds = nil
+	m.mutex.Unlock()
+	return nil
+}
+
+// SampleIds returns size random store ids in insertion order.
+func (m *memoryRepository) SampleIds(_ context.Context, size int) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	m.randMutex.Lock()
+	defer m.randMutex.Unlock()
+
+	if size > len(m.storeIds) {
+		size = len(m.storeIds)
+	}
+	positions := m.random.Perm(len(m.storeIds))[:size]
+	sort.Ints(positions)
+	ids := make([]string, 0, size)
+	for _, i := range positions {
+		ids = append(ids, m.storeIds[i])
+	}
+	return ids, nil
+}
+
+// simulatedPool hands out up to maxSize connections, queuing requests when all
+// of them are in use like the driver's pool does.
+type simulatedPool struct {
+	monitorFunc func(*event.PoolEvent)
+	slots       chan uint64
+	mutex       sync.Mutex
+	created     uint64
+	maxSize     uint64
+	closed      bool
+}
+
+func newSimulatedPool(maxSize uint64, monitorFunc func(*event.PoolEvent)) *simulatedPool {
+	if maxSize == 0 {
+		maxSize = 100
+	}
+	pool := &simulatedPool{
+		monitorFunc: monitorFunc,
+		slots:       make(chan uint64, maxSize),
+		maxSize:     maxSize,
+	}
+	pool.publish(event.PoolCreated, 0, "")
+	return pool
+}
+
+func (p *simulatedPool) checkOut(ctx context.Context, waitQueueTimeout time.Duration) (func(), error) {
+	if waitQueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, waitQueueTimeout)
+		defer cancel()
+	}
+
+	connectionId, ok := p.idleOrNew()
+	if !ok {
+		select {
+		case connectionId = <-p.slots:
+		case <-ctx.Done():
+			p.publish(event.GetFailed, 0, event.ReasonTimedOut)
+			return nil, fmt.Errorf("%w: %v", errPoolTimeout, ctx.Err())
+		}
+	}
+
+	p.publish(event.GetSucceeded, connectionId, "")
+	return func() {
+		p.publish(event.ConnectionReturned, connectionId, "")
+		p.slots <- connectionId
+	}, nil
+}
+
+// idleOrNew returns an idle connection or creates a new one while the pool isn't full.
+func (p *simulatedPool) idleOrNew() (uint64, bool) {
+	select {
+	case connectionId := <-p.slots:
+		return connectionId, true
+	default:
+	}
+
+	p.mutex.Lock()
+	if p.created >= p.maxSize {
+		p.mutex.Unlock()
+		return 0, false
+	}
+	p.created++
+	connectionId := p.created
+	p.mutex.Unlock()
+
+	p.publish(event.ConnectionCreated, connectionId, "")
+	return connectionId, true
+}
+
+// close waits for the connections in use until ctx is done.
+func (p *simulatedPool) close(ctx context.Context) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	created := p.created
+	p.mutex.Unlock()
+
+	for i := uint64(0); i < created; i++ {
+		select {
+		case connectionId := <-p.slots:
+			p.publish(event.ConnectionClosed, connectionId, event.ReasonPoolClosed)
+		case <-ctx.Done():
+			logrus.Warnf("Memory repository closed with %d connections in use", created-i)
+			i = created
+		}
+	}
+	p.publish(event.PoolClosedEvent, 0, "")
+}
+
+func (p *simulatedPool) publish(eventType string, connectionId uint64, reason string) {
+	p.monitorFunc(&event.PoolEvent{
+		Type:         eventType,
+		Address:      memoryAddress,
+		ConnectionID: connectionId,
+		Reason:       reason,
+	})
+}
@@ -0,0 +1,272 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// poolEvents counts the pool events published by a repository.
+type poolEvents struct {
+	mutex   sync.Mutex
+	counts  map[string]int
+	reasons map[string]int
+}
+
+func newPoolEvents() *poolEvents {
+	return &poolEvents{counts: make(map[string]int), reasons: make(map[string]int)}
+}
+
+func (p *poolEvents) monitor(poolEvent *event.PoolEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.counts[poolEvent.Type]++
+	if poolEvent.Reason != "" {
+		p.reasons[poolEvent.Reason]++
+	}
+}
+
+func (p *poolEvents) count(eventType string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.counts[eventType]
+}
+
+func insertStores(t *testing.T, repo TestRepository, ids ...string) {
+	t.Helper()
+	stores := make([]Store, len(ids))
+	for i, id := range ids {
+		stores[i] = Store{StoreId: id, Name: "name " + id}
+	}
+	if _, err := repo.Insert(context.Background(), stores, InsertOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRepositoryFind(t *testing.T) {
+	repo := NewMemoryRepository(MemoryConfiguration{MaxPool: 2}, nil, func(*event.PoolEvent) {})
+	insertStores(t, repo, "a", "b", "c")
+
+	result, err := repo.GetStores(context.Background(), []string{"a", "b", "b", "missing"}, QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Docs != 2 || len(result.Stores) != 2 || result.Server != memoryAddress {
+		t.Errorf("expected 2 docs from %s, got %d from %s", memoryAddress, result.Docs, result.Server)
+	}
+
+	result, err = repo.GetStores(context.Background(), []string{"a", "b", "c"}, QueryOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Docs != 1 {
+		t.Errorf("expected the limit to return 1 doc, got %d", result.Docs)
+	}
+
+	if count, _ := repo.Count(context.Background()); count != 3 {
+		t.Errorf("expected 3 stores, got %d", count)
+	}
+	if repo.QueryCount() != 2 {
+		t.Errorf("expected 2 queries, got %d", repo.QueryCount())
+	}
+}
+
+func TestMemoryRepositoryErrorKinds(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		config  MemoryConfiguration
+		ctx     context.Context
+		options QueryOptions
+		kind    ErrorKind
+		err     error
+	}{
+		{
+			name:   "injected",
+			config: MemoryConfiguration{ErrorRate: 1},
+			ctx:    context.Background(),
+			kind:   KindServer,
+			err:    ErrInjected,
+		},
+		{
+			name:    "exceeded time limit",
+			config:  MemoryConfiguration{Latency: LatencyDistribution{Mean: 50 * time.Millisecond}},
+			ctx:     context.Background(),
+			options: QueryOptions{QueryTimeoutMs: 5},
+			kind:    KindTimeout,
+			err:     ErrExceededTimeLimit,
+		},
+		{
+			name:   "canceled",
+			config: MemoryConfiguration{Latency: LatencyDistribution{Mean: 50 * time.Millisecond}},
+			ctx:    canceled,
+			kind:   KindCanceled,
+			err:    context.Canceled,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := NewMemoryRepository(test.config, nil, func(*event.PoolEvent) {})
+			insertStores(t, repo, "a")
+
+			_, err := repo.GetStores(test.ctx, []string{"a"}, test.options)
+			var operationError *OperationError
+			if !errors.As(err, &operationError) {
+				t.Fatalf("expected an OperationError, got %v", err)
+			}
+			if operationError.Op != "find" || operationError.Server != memoryAddress {
+				t.Errorf("expected find on %s, got %s on %s", memoryAddress, operationError.Op, operationError.Server)
+			}
+			if KindOf(err) != test.kind || !errors.Is(err, test.err) {
+				t.Errorf("expected %s wrapping %v, got %s: %v", test.kind, test.err, KindOf(err), err)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositorySampleIds(t *testing.T) {
+	repo := NewMemoryRepository(MemoryConfiguration{}, nil, func(*event.PoolEvent) {})
+	insertStores(t, repo, "e", "d", "c", "b", "a")
+
+	sampled, err := repo.SampleIds(context.Background(), 3)
+	if err != nil || len(sampled) != 3 {
+		t.Fatalf("expected 3 sampled ids, got %v: %v", sampled, err)
+	}
+	for i := 1; i < len(sampled); i++ {
+		if sampled[i-1] <= sampled[i] {
+			t.Fatalf("expected sampled ids in insertion order, got %v", sampled)
+		}
+	}
+}
+
+func TestMemoryRepositoryDuplicateKey(t *testing.T) {
+	repo := NewMemoryRepository(MemoryConfiguration{}, nil, func(*event.PoolEvent) {})
+	insertStores(t, repo, "a")
+
+	_, err := repo.Insert(context.Background(), []Store{{StoreId: "a"}}, InsertOptions{})
+	if KindOf(err) != KindDuplicateKey {
+		t.Errorf("expected %s, got %v", KindDuplicateKey, err)
+	}
+	info, err := repo.Insert(context.Background(), []Store{{StoreId: "a"}, {StoreId: "b"}},
+		InsertOptions{IgnoreDuplicates: true})
+	if err != nil || info.Docs != 1 {
+		t.Errorf("expected duplicates to be skipped, got %d docs: %v", info.Docs, err)
+	}
+}
+
+// TestMemoryRepositoryPoolWaits runs more concurrent queries than connections, the
+// queued ones waiting for a connection to be returned.
+func TestMemoryRepositoryPoolWaits(t *testing.T) {
+	latency := 40 * time.Millisecond
+	events := newPoolEvents()
+	repo := NewMemoryRepository(MemoryConfiguration{
+		Latency: LatencyDistribution{Mean: latency},
+		MaxPool: 2,
+	}, nil, events.monitor)
+	insertStores(t, repo, "a")
+
+	start := time.Now()
+	errs := runConcurrently(repo, 4)
+	elapsed := time.Since(start)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed < 2*latency {
+		t.Errorf("expected 4 queries on 2 connections to take at least %v, took %v", 2*latency, elapsed)
+	}
+	if created := events.count(event.ConnectionCreated); created != 2 {
+		t.Errorf("expected 2 connections, got %d", created)
+	}
+	if gets := events.count(event.GetSucceeded); gets != 4 {
+		t.Errorf("expected 4 check outs, got %d", gets)
+	}
+	if returned := events.count(event.ConnectionReturned); returned != 4 {
+		t.Errorf("expected 4 returned connections, got %d", returned)
+	}
+
+	repo.Close(context.Background())
+	if closed := events.count(event.ConnectionClosed); closed != 2 {
+		t.Errorf("expected 2 closed connections, got %d", closed)
+	}
+}
+
+func TestMemoryRepositoryWaitQueueTimeout(t *testing.T) {
+	events := newPoolEvents()
+	repo := NewMemoryRepository(MemoryConfiguration{
+		Latency:          LatencyDistribution{Mean: 100 * time.Millisecond},
+		MaxPool:          1,
+		WaitQueueTimeout: 10 * time.Millisecond,
+	}, nil, events.monitor)
+	insertStores(t, repo, "a")
+
+	timeouts := 0
+	for _, err := range runConcurrently(repo, 3) {
+		switch KindOf(err) {
+		case "":
+		case KindPoolTimeout:
+			timeouts++
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if timeouts != 2 {
+		t.Errorf("expected 2 pool timeouts, got %d", timeouts)
+	}
+	if failed := events.count(event.GetFailed); failed != 2 || events.reasons[event.ReasonTimedOut] != 2 {
+		t.Errorf("expected 2 check outs timed out, got %d: %v", failed, events.reasons)
+	}
+}
+
+func runConcurrently(repo TestRepository, queries int) []error {
+	errs := make([]error, queries)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = repo.GetStores(context.Background(), []string{"a"}, QueryOptions{})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// TestMemoryRepositoryIsSeeded checks the same source injects the same errors and
+// samples the same ids.
+func TestMemoryRepositoryIsSeeded(t *testing.T) {
+	var failures [2][]bool
+	var sampled [2][]string
+	for i := range failures {
+		repo := NewMemoryRepository(MemoryConfiguration{ErrorRate: 0.5}, rand.New(rand.NewSource(42)),
+			func(*event.PoolEvent) {})
+		insertStores(t, repo, "a", "b", "c", "d", "e", "f")
+		for j := 0; j < 20; j++ {
+			_, err := repo.GetStores(context.Background(), []string{"a"}, QueryOptions{})
+			failures[i] = append(failures[i], err != nil)
+		}
+		ids, err := repo.SampleIds(context.Background(), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sampled[i] = ids
+	}
+	for j := range failures[0] {
+		if failures[0][j] != failures[1][j] {
+			t.Fatalf("expected the same seed to fail the same queries, query %d differs", j)
+		}
+	}
+	for j := range sampled[0] {
+		if sampled[0][j] != sampled[1][j] {
+			t.Fatalf("expected the same seed to sample the same ids, got %v and %v", sampled[0], sampled[1])
+		}
+	}
+}
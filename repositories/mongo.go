@@ -3,10 +3,10 @@ package repositories
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"sync/atomic"
 	"time"
 
+	"github.com/n4d13/mongo_driver_test/replay"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/event"
@@ -23,23 +23,26 @@ type MongoDBConfiguration struct {
 	MaxPool        uint64
 	IdleTimeout    time.Duration
 	SocketTimeout  time.Duration
+	// CommandMonitor, when set, also receives the command events of the client.
+	CommandMonitor *event.CommandMonitor
 }
 
 type mongoRepository struct {
 	client           *mongo.Client
 	storesCollection *mongo.Collection
 	queryCount       int64
-	validIds         []string
 }
 
+// TestRepository operations fail with an *OperationError.
 type TestRepository interface {
-	GetStores(uint, uint, uint) ([]Store, error)
-	Insert([]Store) error
-	Count() (int64, error)
+	GetStores(context.Context, []string, QueryOptions) (QueryResult, error)
+	Insert(context.Context, []Store, InsertOptions) (OperationInfo, error)
+	Count(context.Context) (int64, error)
 	QueryCount() int64
-	Close()
-	Clear()
-	SetValidIds([]string)
+	Close(context.Context) error
+	Clear(context.Context) error
+	SampleIds(context.Context, int) ([]string, error)
+	Replay(context.Context, replay.Operation, QueryOptions) (OperationInfo, error)
 }
 
 func NewMongodbRepository(config *MongoDBConfiguration, monitorFunc func(*event.PoolEvent)) (TestRepository, error) {
@@ -61,6 +64,10 @@ func NewMongodbRepository(config *MongoDBConfiguration, monitorFunc func(*event.
 	return repository, nil
 }
 
+// indexTimeout bounds the creation of the store_id index, which can take a while on a
+// large collection.
+const indexTimeout = 30 * time.Second
+
 func CreateClient(config *MongoDBConfiguration, monitorFunc func(*event.PoolEvent)) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
 	defer cancel()
@@ -73,7 +80,8 @@ func CreateClient(config *MongoDBConfiguration, monitorFunc func(*event.PoolEven
 		SetPoolMonitor(
 			&event.PoolMonitor{
 				Event: monitorFunc,
-			})
+			}).
+		SetMonitor(commandMonitor(config.CommandMonitor))
 
 	db, err := mongo.Connect(ctx, clientOptions)
 
@@ -93,26 +101,48 @@ func CreateClient(config *MongoDBConfiguration, monitorFunc func(*event.PoolEven
 
 	logrus.Info(fmt.Sprintf("Database's connection done. URL: %v - Database: %v", config.ConnString, config.DbName))
 
-	_ = ensureIndex(db.Database(config.DbName).Collection(config.CollectionName))
+	indexCtx, cancelIndex := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancelIndex()
+	if err := ensureIndex(indexCtx, db.Database(config.DbName).Collection(config.CollectionName)); err != nil {
+		logrus.Errorf("Can't create the unique store_id index of %s.%s, duplicates won't be rejected: %v",
+			config.DbName, config.CollectionName, err)
+	}
 
 	return db, nil
 }
 
-func ensureIndex(col *mongo.Collection) error {
-	idxs, err := col.Indexes().List(context.TODO())
+// commandMonitor traces the server of every operation before calling monitor.
+func commandMonitor(monitor *event.CommandMonitor) *event.CommandMonitor {
+	if monitor == nil {
+		return &event.CommandMonitor{Started: traceCommand}
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, started *event.CommandStartedEvent) {
+			traceCommand(ctx, started)
+			if monitor.Started != nil {
+				monitor.Started(ctx, started)
+			}
+		},
+		Succeeded: monitor.Succeeded,
+		Failed:    monitor.Failed,
+	}
+}
+
+func ensureIndex(ctx context.Context, col *mongo.Collection) error {
+	idxs, err := col.Indexes().List(ctx)
 	idxName := "store_id_ux"
 	if err != nil {
 		return err
 	}
 	var exists = false
-	for idxs.Next(context.Background()) {
+	for idxs.Next(ctx) {
 		name := idxs.Current.Lookup("name")
 		if name.String() == idxName {
 			exists = true
 		}
 	}
 	if !exists {
-		_, err = col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		_, err = col.Indexes().CreateOne(ctx, mongo.IndexModel{
 			Keys:    bson.M{"store_id": 1},
 			Options: options.Index().SetName(idxName).SetUnique(true),
 		})
@@ -123,46 +153,67 @@ func ensureIndex(col *mongo.Collection) error {
 	return nil
 }
 
-func (m *mongoRepository) GetStores(size uint, queryTimeout uint, contextTimeout uint) ([]Store, error) {
+func (m *mongoRepository) GetStores(ctx context.Context, ids []string, queryOptions QueryOptions) (QueryResult, error) {
 
 	idsList := bson.A{}
-	maxPosition := len(m.validIds)
-
-	for i := 0; i < int(size); i++ {
-		var random = rand.New(rand.NewSource(time.Now().UnixNano()))
-		current := random.Intn(maxPosition)
-		idsList = append(idsList, m.validIds[current])
+	for _, id := range ids {
+		idsList = append(idsList, id)
 	}
 
 	filter := bson.M{"store_id": bson.M{"$in": idsList}}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(contextTimeout)*time.Millisecond)
-	defer cancel()
+	ctx, trace := withTrace(ctx)
+	start := time.Now()
 
 	atomic.AddInt64(&m.queryCount, 1)
 
+	batchSize := int32(queryOptions.CursorBatchSize)
+	if batchSize == 0 {
+		batchSize = int32(len(idsList))
+	}
 	fOptions := options.Find().
-		SetMaxTime(time.Duration(queryTimeout) * time.Millisecond).
-		SetBatchSize(int32(len(idsList)))
+		SetMaxTime(time.Duration(queryOptions.QueryTimeoutMs) * time.Millisecond).
+		SetBatchSize(batchSize)
+	if queryOptions.Limit > 0 {
+		fOptions.SetLimit(int64(queryOptions.Limit))
+	}
+	if len(queryOptions.Projection) > 0 {
+		projection := bson.M{}
+		for _, field := range queryOptions.Projection {
+			projection[field] = 1
+		}
+		fOptions.SetProjection(projection)
+	}
+
+	var result QueryResult
+	err := m.find(ctx, filter, fOptions, &result)
+	result.Server = trace.getServer()
+	result.Duration = time.Since(start)
+	return result, newOperationError("find", result.Server, err)
+}
 
+func (m *mongoRepository) find(ctx context.Context, filter bson.M, fOptions *options.FindOptions, result *QueryResult) error {
 	records, err := m.storesCollection.Find(ctx, filter, fOptions)
 	if records != nil {
 		defer records.Close(ctx)
 	}
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var stores []Store
-	err = records.All(ctx, &stores)
-	if err != nil {
-		return nil, err
+	for records.Next(ctx) {
+		var store Store
+		if err = records.Decode(&store); err != nil {
+			return err
+		}
+		result.Stores = append(result.Stores, store)
+		result.Docs++
+		result.Bytes += int64(len(records.Current))
 	}
-
-	return stores, nil
+	return records.Err()
 }
 
-func (m *mongoRepository) Insert(stores []Store) error {
+func (m *mongoRepository) Insert(ctx context.Context, stores []Store, insertOptions InsertOptions) (OperationInfo, error) {
 
 	var operations []mongo.WriteModel
 
@@ -172,26 +223,77 @@ func (m *mongoRepository) Insert(stores []Store) error {
 		})
 	}
 
-	_, err := m.storesCollection.BulkWrite(context.Background(), operations)
-	return err
+	info := OperationInfo{Docs: len(stores)}
+	collection := m.storesCollection
+	if insertOptions.WriteConcern != "" {
+		var err error
+		collection, err = collection.Clone(
+			options.Collection().SetWriteConcern(parseWriteConcern(insertOptions.WriteConcern)))
+		if err != nil {
+			return info, newOperationError("insert", "", err)
+		}
+	}
+
+	ctx, trace := withTrace(ctx)
+	start := time.Now()
+	_, err := collection.BulkWrite(ctx, operations,
+		options.BulkWrite().SetOrdered(insertOptions.Ordered))
+	info.Server = trace.getServer()
+	info.Duration = time.Since(start)
+	if err != nil && insertOptions.IgnoreDuplicates && onlyDuplicateKeyErrors(err) {
+		return info, nil
+	}
+	return info, newOperationError("insert", info.Server, err)
 }
 
-func (m *mongoRepository) Count() (int64, error) {
-	return m.storesCollection.CountDocuments(context.TODO(), bson.M{})
+func (m *mongoRepository) Count(ctx context.Context) (int64, error) {
+	ctx, trace := withTrace(ctx)
+	count, err := m.storesCollection.CountDocuments(ctx, bson.M{})
+	return count, newOperationError("count", trace.getServer(), err)
 }
 
 func (m *mongoRepository) QueryCount() int64 {
-	return m.queryCount
+	return atomic.LoadInt64(&m.queryCount)
 }
-func (m *mongoRepository) Close() {
-	_ = m.client.Disconnect(context.TODO())
+
+func (m *mongoRepository) Close(ctx context.Context) error {
+	return newOperationError("close", "", m.client.Disconnect(ctx))
 }
 
-func (m *mongoRepository) Clear() {
-	_ = m.storesCollection.Drop(context.Background())
-	_ = ensureIndex(m.storesCollection)
+func (m *mongoRepository) Clear(ctx context.Context) error {
+	ctx, trace := withTrace(ctx)
+	if err := m.storesCollection.Drop(ctx); err != nil {
+		return newOperationError("drop", trace.getServer(), err)
+	}
+	return newOperationError("createIndexes", trace.getServer(), ensureIndex(ctx, m.storesCollection))
 }
 
-func (m *mongoRepository) SetValidIds(ids []string) {
-	m.validIds = ids
+// SampleIds returns size random store ids in insertion order, given by their
+// generated _id, so the latest key distribution favours the newest documents.
+func (m *mongoRepository) SampleIds(ctx context.Context, size int) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sample", Value: bson.M{"size": size}}},
+		// Projecting first keeps the blocking sort small, _id stays for the sort.
+		{{Key: "$project", Value: bson.M{"store_id": 1}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+
+	ctx, trace := withTrace(ctx)
+	records, err := m.storesCollection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, newOperationError("aggregate", trace.getServer(), err)
+	}
+	defer records.Close(ctx)
+
+	var stores []Store
+	err = records.All(ctx, &stores)
+	if err != nil {
+		return nil, newOperationError("aggregate", trace.getServer(), err)
+	}
+
+	var ids []string
+	for _, store := range stores {
+		ids = append(ids, store.StoreId)
+	}
+	return ids, nil
 }
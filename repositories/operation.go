@@ -0,0 +1,51 @@
+package repositories
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// OperationInfo describes how an operation was served.
+type OperationInfo struct {
+	Docs     int
+	Bytes    int64
+	Server   string
+	Duration time.Duration
+}
+
+type traceKey struct{}
+
+// operationTrace collects, through the command monitor, the server used by an operation.
+type operationTrace struct {
+	mutex  sync.Mutex
+	server string
+}
+
+func withTrace(ctx context.Context) (context.Context, *operationTrace) {
+	trace := &operationTrace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+func (t *operationTrace) getServer() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.server
+}
+
+func traceCommand(ctx context.Context, started *event.CommandStartedEvent) {
+	trace, ok := ctx.Value(traceKey{}).(*operationTrace)
+	if !ok {
+		return
+	}
+	server := started.ConnectionID
+	if i := strings.Index(server, "["); i >= 0 {
+		server = server[:i]
+	}
+	trace.mutex.Lock()
+	trace.server = server
+	trace.mutex.Unlock()
+}
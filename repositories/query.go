@@ -0,0 +1,15 @@
+package repositories
+
+type QueryOptions struct {
+	QueryTimeoutMs uint
+	// CursorBatchSize defaults to the number of queried ids.
+	CursorBatchSize uint
+	Limit           uint
+	Projection      []string
+}
+
+// QueryResult's Bytes is the BSON size of the returned documents.
+type QueryResult struct {
+	Stores []Store
+	OperationInfo
+}
@@ -0,0 +1,91 @@
+package repositories
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/replay"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Replay runs a captured operation against the stores collection, whatever
+// collection it was captured on. Docs are the returned or matched documents.
+func (m *mongoRepository) Replay(ctx context.Context, operation replay.Operation, queryOptions QueryOptions) (OperationInfo, error) {
+	ctx, trace := withTrace(ctx)
+	start := time.Now()
+	atomic.AddInt64(&m.queryCount, 1)
+
+	var info OperationInfo
+	err := m.replay(ctx, operation, time.Duration(queryOptions.QueryTimeoutMs)*time.Millisecond, &info)
+	info.Server = trace.getServer()
+	info.Duration = time.Since(start)
+	return info, newOperationError(operation.Kind, info.Server, err)
+}
+
+func (m *mongoRepository) replay(ctx context.Context, operation replay.Operation, maxTime time.Duration, info *OperationInfo) error {
+	var records *mongo.Cursor
+	var err error
+	switch operation.Kind {
+	case replay.KindFind:
+		fOptions := options.Find().SetMaxTime(maxTime)
+		if operation.Projection != nil {
+			fOptions.SetProjection(operation.Projection)
+		}
+		if operation.Sort != nil {
+			fOptions.SetSort(operation.Sort)
+		}
+		if operation.Skip > 0 {
+			fOptions.SetSkip(operation.Skip)
+		}
+		if operation.Limit != 0 {
+			fOptions.SetLimit(operation.Limit)
+		}
+		records, err = m.storesCollection.Find(ctx, filterOf(operation), fOptions)
+	case replay.KindAggregate:
+		records, err = m.storesCollection.Aggregate(ctx, operation.Pipeline, options.Aggregate().SetMaxTime(maxTime))
+	case replay.KindUpdate:
+		uOptions := options.Update().SetUpsert(operation.Upsert)
+		var updated *mongo.UpdateResult
+		if operation.Multi {
+			updated, err = m.storesCollection.UpdateMany(ctx, filterOf(operation), operation.Update, uOptions)
+		} else {
+			updated, err = m.storesCollection.UpdateOne(ctx, filterOf(operation), operation.Update, uOptions)
+		}
+		if updated != nil {
+			info.Docs = int(updated.MatchedCount)
+		}
+		return err
+	}
+	if records != nil {
+		defer records.Close(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for records.Next(ctx) {
+		info.Docs++
+		info.Bytes += int64(len(records.Current))
+	}
+	return records.Err()
+}
+
+func filterOf(operation replay.Operation) interface{} {
+	if operation.Filter == nil {
+		return bson.D{}
+	}
+	return operation.Filter
+}
+
+// Replay only simulates the latency, errors and pool usage of the operation.
+func (m *memoryRepository) Replay(ctx context.Context, operation replay.Operation, queryOptions QueryOptions) (OperationInfo, error) {
+	atomic.AddInt64(&m.queryCount, 1)
+
+	info := OperationInfo{Server: memoryAddress}
+	start := time.Now()
+	err := m.simulate(ctx, queryOptions)
+	info.Duration = time.Since(start)
+	return info, newOperationError(operation.Kind, memoryAddress, err)
+}
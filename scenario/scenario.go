@@ -0,0 +1,128 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/stage"
+	"github.com/sirupsen/logrus"
+)
+
+// Step is one stage of a scenario, started Pause after the previous one finished.
+type Step struct {
+	Name  string
+	Pause time.Duration
+	Run   func(context.Context) (*stage.Result, error)
+}
+
+// Scenario runs its steps back to back, after the optional setup.
+type Scenario struct {
+	Name  string
+	Setup func(context.Context) error
+	Steps []Step
+}
+
+// Report aggregates the results of every step of a scenario.
+type Report struct {
+	Name       string       `json:"name"`
+	Started    time.Time    `json:"started"`
+	Finished   time.Time    `json:"finished"`
+	Canceled   bool         `json:"canceled"`
+	Stages     []StepReport `json:"stages"`
+	Queries    int64        `json:"queries"`
+	Errors     int64        `json:"errors"`
+	ErrorRate  float64      `json:"error_rate"`
+	MaxP99Ms   float64      `json:"max_p99_ms"`
+	Verdict    string       `json:"verdict"`
+	SetupError string       `json:"setup_error,omitempty"`
+}
+
+type StepReport struct {
+	Name   string        `json:"name"`
+	Result *stage.Result `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Passed tells whether the setup and every step ran and passed.
+func (r *Report) Passed() bool {
+	return r.Verdict == stage.VerdictPass
+}
+
+// Run executes the scenario, stopping at the first failed setup or when ctx is
+// canceled. Failed steps don't stop the scenario.
+func (s *Scenario) Run(ctx context.Context) *Report {
+	report := &Report{
+		Name:    s.Name,
+		Started: time.Now(),
+		Verdict: stage.VerdictPass,
+	}
+	defer func() {
+		report.Finished = time.Now()
+	}()
+
+	if s.Setup != nil {
+		logrus.Infof("Preparing data of scenario %s", s.Name)
+		if err := s.Setup(ctx); err != nil {
+			logrus.Errorf("Scenario %s setup failed: %v", s.Name, err)
+			report.SetupError = err.Error()
+			report.Verdict = stage.VerdictFail
+			return report
+		}
+	}
+
+	for i, step := range s.Steps {
+		if i > 0 && step.Pause > 0 {
+			logrus.Infof("Pausing %v before stage %s", step.Pause, step.Name)
+			select {
+			case <-ctx.Done():
+			case <-time.After(step.Pause):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		logrus.Infof("Running stage %d/%d of scenario %s: %s", i+1, len(s.Steps), s.Name, step.Name)
+		result, err := step.Run(ctx)
+		report.add(step.Name, result, err)
+	}
+
+	if ctx.Err() != nil {
+		report.Canceled = true
+		report.Verdict = stage.VerdictFail
+	}
+	if report.Queries > 0 {
+		report.ErrorRate = float64(report.Errors) / float64(report.Queries)
+	}
+	logrus.Infof("Scenario %s finished: %d stages, %d queries, %d errors, max p99 %.1fms, verdict %s",
+		s.Name, len(report.Stages), report.Queries, report.Errors, report.MaxP99Ms, report.Verdict)
+	return report
+}
+
+func (r *Report) add(name string, result *stage.Result, err error) {
+	step := StepReport{Name: name, Result: result}
+	if err != nil {
+		step.Error = err.Error()
+		r.Verdict = stage.VerdictFail
+	}
+	if result != nil {
+		r.Queries += result.Queries
+		r.Errors += result.Errors
+		if result.Latency.P99 > r.MaxP99Ms {
+			r.MaxP99Ms = result.Latency.P99
+		}
+		if !result.Passed() {
+			r.Verdict = stage.VerdictFail
+		}
+	}
+	r.Stages = append(r.Stages, step)
+}
+
+// StepName names unnamed steps after their position.
+func StepName(name string, index int) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("stage-%d", index+1)
+}
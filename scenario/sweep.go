@@ -0,0 +1,107 @@
+package scenario
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Parameter is a setting swept over its values.
+type Parameter struct {
+	Name   string        `json:"name"`
+	Values []interface{} `json:"values"`
+}
+
+// Combinations lists the values of every combination of one or two parameters,
+// the last parameter changing first.
+func Combinations(parameters []Parameter) [][]interface{} {
+	combinations := [][]interface{}{nil}
+	for _, parameter := range parameters {
+		var next [][]interface{}
+		for _, combination := range combinations {
+			for _, value := range parameter.Values {
+				next = append(next, append(append([]interface{}(nil), combination...), value))
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// CombinationName names the stage running a combination.
+func CombinationName(parameters []Parameter, values []interface{}) string {
+	var names []string
+	for i, parameter := range parameters {
+		names = append(names, fmt.Sprintf("%s=%v", parameter.Name, values[i]))
+	}
+	return strings.Join(names, ",")
+}
+
+// Matrix compares the stages of a sweep, with a row for every value of the first
+// parameter and a column for every value of the second one.
+type Matrix struct {
+	Parameters []Parameter `json:"parameters"`
+	Cells      [][]Cell    `json:"cells"`
+	// Best is the combination with the lowest error rate, then pool failures, then p99.
+	Best *Cell `json:"best,omitempty"`
+}
+
+type Cell struct {
+	Values       []interface{} `json:"values"`
+	Stage        string        `json:"stage"`
+	ErrorRate    float64       `json:"error_rate"`
+	P99Ms        float64       `json:"p99_ms"`
+	GetsFailed   int64         `json:"gets_failed"`
+	PoolTimeouts int64         `json:"pool_timeouts"`
+	Verdict      string        `json:"verdict,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// NewMatrix builds the matrix of a sweep from the report of the scenario running
+// its combinations in order.
+func NewMatrix(parameters []Parameter, report *Report) *Matrix {
+	matrix := &Matrix{Parameters: parameters}
+	columns := 1
+	if len(parameters) > 1 {
+		columns = len(parameters[1].Values)
+	}
+
+	for i, values := range Combinations(parameters) {
+		if i%columns == 0 {
+			matrix.Cells = append(matrix.Cells, nil)
+		}
+		cell := Cell{Values: values, Stage: CombinationName(parameters, values)}
+		if i < len(report.Stages) {
+			step := report.Stages[i]
+			cell.Error = step.Error
+			if result := step.Result; result != nil {
+				cell.ErrorRate = result.ErrorRate
+				cell.P99Ms = result.Latency.P99
+				cell.GetsFailed = result.Pool.GetsFailed
+				cell.PoolTimeouts = result.Pool.Reasons[event.ReasonTimedOut]
+				cell.Verdict = result.Verdict
+			}
+		} else {
+			cell.Error = "not run"
+		}
+		row := len(matrix.Cells) - 1
+		matrix.Cells[row] = append(matrix.Cells[row], cell)
+
+		if cell.Error == "" && (matrix.Best == nil || cell.betterThan(matrix.Best)) {
+			best := cell
+			matrix.Best = &best
+		}
+	}
+	return matrix
+}
+
+func (c *Cell) betterThan(other *Cell) bool {
+	if c.ErrorRate != other.ErrorRate {
+		return c.ErrorRate < other.ErrorRate
+	}
+	if c.GetsFailed != other.GetsFailed {
+		return c.GetsFailed < other.GetsFailed
+	}
+	return c.P99Ms < other.P99Ms
+}
@@ -0,0 +1,95 @@
+package stage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// AbortRules stop a collapsing stage early, zero values are not checked.
+type AbortRules struct {
+	// MaxErrorRate aborts when the error rate stays above it for ErrorRateSecs seconds.
+	MaxErrorRate  float64
+	ErrorRateSecs uint
+	// MaxP99Ms aborts when the p99 latency stays above it for P99Secs seconds.
+	MaxP99Ms float64
+	P99Secs  uint
+	// MaxGetsFailedPerSec aborts when more pool checkouts fail in a single second.
+	MaxGetsFailedPerSec int64
+}
+
+func (a AbortRules) enabled() bool {
+	return a.MaxErrorRate > 0 || a.MaxP99Ms > 0 || a.MaxGetsFailedPerSec > 0
+}
+
+// aborter checks the abort rules on every window of the timeline, calling abort
+// once with the reason of the first rule firing.
+type aborter struct {
+	rules      AbortRules
+	abort      func()
+	mutex      sync.Mutex
+	errorSecs  float64
+	latentSecs float64
+	reason     string
+}
+
+func newAborter(rules AbortRules, abort func()) *aborter {
+	if rules.ErrorRateSecs == 0 {
+		rules.ErrorRateSecs = 1
+	}
+	if rules.P99Secs == 0 {
+		rules.P99Secs = 1
+	}
+	return &aborter{
+		rules: rules,
+		abort: abort,
+	}
+}
+
+func (a *aborter) observe(window Window) {
+	if !a.rules.enabled() || window.Phase == phaseDrain {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.reason != "" {
+		return
+	}
+
+	a.errorSecs = streak(a.errorSecs, window, a.rules.MaxErrorRate > 0 && window.ErrorRate > a.rules.MaxErrorRate)
+	a.latentSecs = streak(a.latentSecs, window, a.rules.MaxP99Ms > 0 && window.P99Ms > a.rules.MaxP99Ms)
+
+	switch {
+	case lasted(a.errorSecs, a.rules.ErrorRateSecs):
+		a.reason = fmt.Sprintf("error rate above %.4f for %.1f seconds", a.rules.MaxErrorRate, a.errorSecs)
+	case lasted(a.latentSecs, a.rules.P99Secs):
+		a.reason = fmt.Sprintf("p99 latency above %.1fms for %.1f seconds", a.rules.MaxP99Ms, a.latentSecs)
+	case a.rules.MaxGetsFailedPerSec > 0 && window.GetsFailed > a.rules.MaxGetsFailedPerSec:
+		a.reason = fmt.Sprintf("%d pool checkouts failed in second %d, above %d",
+			window.GetsFailed, window.Second, a.rules.MaxGetsFailedPerSec)
+	default:
+		return
+	}
+	a.abort()
+}
+
+func (a *aborter) abortReason() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.reason
+}
+
+// streak adds up the duration of the consecutive windows breaking a rule, windows
+// cut by a phase change counting for the time they lasted.
+func streak(secs float64, window Window, breached bool) float64 {
+	if breached {
+		return secs + window.DurationSecs
+	}
+	return 0
+}
+
+// tickerJitter keeps windows ticking a bit early from delaying a rule by a window.
+const tickerJitter = 0.05
+
+func lasted(secs float64, limit uint) bool {
+	return secs > 0 && secs+tickerJitter >= float64(limit)
+}
@@ -0,0 +1,41 @@
+package stage
+
+import "testing"
+
+// TestAborterAddsUpWindowDurations breaks the error rate rule in windows cut by a
+// phase change, the rule firing once the windows last the configured seconds.
+func TestAborterAddsUpWindowDurations(t *testing.T) {
+	tests := []struct {
+		name      string
+		durations []float64
+		aborted   bool
+	}{
+		{"full windows", []float64{1, 1}, true},
+		{"partial window", []float64{1, 0.3}, false},
+		{"partial window then full", []float64{0.3, 1, 1}, true},
+		{"early ticks", []float64{0.99, 0.99}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aborted := false
+			aborter := newAborter(AbortRules{MaxErrorRate: 0.1, ErrorRateSecs: 2}, func() { aborted = true })
+			for _, duration := range test.durations {
+				aborter.observe(Window{Phase: phaseSteady, DurationSecs: duration, ErrorRate: 0.5})
+			}
+			if aborted != test.aborted {
+				t.Errorf("expected aborted %t, got %t: %q", test.aborted, aborted, aborter.abortReason())
+			}
+		})
+	}
+}
+
+func TestAborterResetsStreak(t *testing.T) {
+	aborted := false
+	aborter := newAborter(AbortRules{MaxP99Ms: 100, P99Secs: 2}, func() { aborted = true })
+	for _, p99 := range []float64{200, 50, 200} {
+		aborter.observe(Window{Phase: phaseSteady, DurationSecs: 1, P99Ms: p99})
+	}
+	if aborted {
+		t.Errorf("expected a window below the limit to reset the streak, got %q", aborter.abortReason())
+	}
+}
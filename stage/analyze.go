@@ -0,0 +1,262 @@
+package stage
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/journal"
+	"github.com/n4d13/mongo_driver_test/stats"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Analysis is the stage rebuilt from its journal.
+type Analysis struct {
+	Records      int64              `json:"records"`
+	Started      time.Time          `json:"started"`
+	DurationSecs float64            `json:"duration_secs"`
+	Queries      int64              `json:"queries"`
+	Errors       int64              `json:"errors"`
+	ErrorRate    float64            `json:"error_rate"`
+	ErrorsByKind map[string]int64   `json:"errors_by_kind,omitempty"`
+	Throughput   float64            `json:"throughput"`
+	Latency      LatencySummary     `json:"latency_ms"`
+	Histogram    []Bucket           `json:"latency_histogram"`
+	Commands     []CommandStats     `json:"commands,omitempty"`
+	Pool         stats.PoolSnapshot `json:"pool"`
+	Topology     []TopologyChange   `json:"topology,omitempty"`
+	Phases       []PhaseResult      `json:"phases,omitempty"`
+	Timeline     []Window           `json:"timeline,omitempty"`
+	Events       []Event            `json:"events,omitempty"`
+}
+
+// Bucket counts the queries up to UpToMs and above the previous bucket, the last
+// bucket has no upper bound.
+type Bucket struct {
+	UpToMs float64 `json:"up_to_ms,omitempty"`
+	Count  int64   `json:"count"`
+}
+
+type CommandStats struct {
+	Name    string         `json:"name"`
+	Count   int64          `json:"count"`
+	Failed  int64          `json:"failed"`
+	Latency LatencySummary `json:"latency_ms"`
+}
+
+type TopologyChange struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Address string    `json:"address"`
+}
+
+var histogramBoundsMs = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// Analyze rebuilds the pool counters, latencies and timeline of a stage from the
+// journal at path. Windows are cut like the ones of a running stage: every second
+// and on every phase change.
+func Analyze(path string) (*Analysis, error) {
+	var records []journal.Record
+	err := journal.Read(path, func(record journal.Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("journal " + path + " has no records")
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+
+	analysis := &Analysis{
+		Records:      int64(len(records)),
+		ErrorsByKind: make(map[string]int64),
+	}
+	pool := stats.NewPoolStats()
+	rebuilt := &rebuiltTimeline{pool: pool, phase: phaseSteady}
+	commands := make(map[string]*commandSamples)
+	var samples []time.Duration
+
+	for _, record := range records {
+		if record.Type == journal.TypePhase && rebuilt.start == 0 {
+			rebuilt.begin(record.Time, record.Phase)
+			analysis.Started = time.Unix(0, record.Time)
+			continue
+		}
+		rebuilt.advance(record.Time)
+
+		switch record.Type {
+		case journal.TypePool, journal.TypeTopology:
+			pool.MonitorFunc(record.PoolEvent())
+			if record.Type == journal.TypeTopology {
+				analysis.Topology = append(analysis.Topology, TopologyChange{
+					Time:    time.Unix(0, record.Time),
+					Event:   record.Event,
+					Address: record.Address,
+				})
+			}
+		case journal.TypeCommand:
+			if record.Event == journal.CommandStarted {
+				continue
+			}
+			command, ok := commands[record.Command]
+			if !ok {
+				command = &commandSamples{}
+				commands[record.Command] = command
+			}
+			command.samples = append(command.samples, time.Duration(record.DurationNs))
+			if record.Event == journal.CommandFailed {
+				command.failed++
+			}
+		case journal.TypeOperation:
+			samples = append(samples, time.Duration(record.DurationNs))
+			if record.ErrorKind != "" {
+				analysis.Errors++
+				analysis.ErrorsByKind[record.ErrorKind]++
+			}
+			rebuilt.operation(record.ErrorKind != "")
+		case journal.TypePhase:
+			rebuilt.setPhase(record.Time, record.Phase)
+		case journal.TypeEvent:
+			analysis.Events = append(analysis.Events, Event{Time: time.Unix(0, record.Time), Message: record.Message})
+		}
+	}
+
+	last := records[len(records)-1].Time
+	if rebuilt.start != 0 {
+		rebuilt.close(last)
+		analysis.DurationSecs = float64(last-rebuilt.start) / float64(time.Second)
+	}
+	analysis.Queries = int64(len(samples))
+	if analysis.Queries > 0 {
+		analysis.ErrorRate = float64(analysis.Errors) / float64(analysis.Queries)
+	}
+	if analysis.DurationSecs > 0 {
+		analysis.Throughput = float64(analysis.Queries) / analysis.DurationSecs
+	}
+	analysis.Timeline = rebuilt.windows(samples)
+	if len(analysis.Timeline) > 0 {
+		analysis.Phases = phases(analysis.Timeline, samples)
+	}
+	analysis.Histogram = histogram(samples)
+	analysis.Latency = summarize(append([]time.Duration(nil), samples...))
+	analysis.Commands = commandStats(commands)
+	analysis.Pool = pool.Snapshot()
+	return analysis, nil
+}
+
+type commandSamples struct {
+	samples []time.Duration
+	failed  int64
+}
+
+func commandStats(commands map[string]*commandSamples) []CommandStats {
+	var result []CommandStats
+	for name, command := range commands {
+		result = append(result, CommandStats{
+			Name:    name,
+			Count:   int64(len(command.samples)),
+			Failed:  command.failed,
+			Latency: summarize(command.samples),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func histogram(samples []time.Duration) []Bucket {
+	buckets := make([]Bucket, len(histogramBoundsMs)+1)
+	for i, bound := range histogramBoundsMs {
+		buckets[i].UpToMs = bound
+	}
+	for _, sample := range samples {
+		ms := milliseconds(sample)
+		i := sort.SearchFloat64s(histogramBoundsMs, ms)
+		buckets[i].Count++
+	}
+	return buckets
+}
+
+// rebuiltTimeline cuts the journal records in windows, queries are counted in the
+// window they finished in, as the running stage does.
+type rebuiltTimeline struct {
+	pool        *stats.PoolStats
+	phase       string
+	start       int64
+	windowStart int64
+	closed      []Window
+	queries     int
+	errors      int64
+	poolTO      int64
+	failed      int64
+}
+
+func (t *rebuiltTimeline) begin(at int64, phase string) {
+	t.start, t.windowStart, t.phase = at, at, phase
+	t.pool.TakeWindowPeak()
+}
+
+// advance closes the full seconds elapsed before at.
+func (t *rebuiltTimeline) advance(at int64) {
+	if t.start == 0 {
+		return
+	}
+	for at-t.windowStart >= int64(time.Second) {
+		t.close(t.windowStart + int64(time.Second))
+	}
+}
+
+func (t *rebuiltTimeline) setPhase(at int64, phase string) {
+	if t.start == 0 {
+		t.begin(at, phase)
+		return
+	}
+	if at-t.windowStart >= int64(minWindow) {
+		t.close(at)
+	}
+	t.phase = phase
+}
+
+func (t *rebuiltTimeline) operation(failed bool) {
+	t.queries++
+	if failed {
+		t.errors++
+	}
+}
+
+func (t *rebuiltTimeline) close(at int64) {
+	snapshot := t.pool.Snapshot()
+	poolTO := snapshot.Reasons[event.ReasonTimedOut]
+	window := Window{
+		Second:       int((t.windowStart - t.start) / int64(time.Second)),
+		DurationSecs: float64(at-t.windowStart) / float64(time.Second),
+		Phase:        t.phase,
+		Queries:      int64(t.queries),
+		Errors:       t.errors,
+		PoolTimeouts: poolTO - t.poolTO,
+		GetsFailed:   snapshot.GetsFailed - t.failed,
+		PeakInUse:    t.pool.TakeWindowPeak(),
+	}
+	t.closed = append(t.closed, window)
+	t.windowStart, t.queries, t.errors, t.poolTO, t.failed = at, 0, 0, poolTO, snapshot.GetsFailed
+}
+
+// windows fills the sample ranges, rates and p99 of the closed windows.
+func (t *rebuiltTimeline) windows(samples []time.Duration) []Window {
+	next := 0
+	for i := range t.closed {
+		window := &t.closed[i]
+		window.firstSample = next
+		window.lastSample = next + int(window.Queries)
+		next = window.lastSample
+		if window.Queries > 0 {
+			window.ErrorRate = float64(window.Errors) / float64(window.Queries)
+			window.P99Ms = summarize(append([]time.Duration(nil), samples[window.firstSample:window.lastSample]...)).P99
+		}
+		if window.DurationSecs > 0 {
+			window.Throughput = float64(window.Queries) / window.DurationSecs
+		}
+	}
+	return t.closed
+}
@@ -0,0 +1,149 @@
+package stage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	DataModeRegenerate = "regenerate"
+	DataModeReuse      = "reuse"
+	DataModeAppend     = "append"
+)
+
+const defaultDatasetSize = 10000
+
+const loremp = "Lorem ipsum dolor sit amet, consectetur adipiscing elit. " +
+	"Praesent in lacinia magna. Aenean vitae maximus sem. " +
+	"Quisque pharetra augue et mollis sollicitudin. " +
+	"Mauris vehicula eros lorem. Donec non sodales neque. " +
+	"Nullam malesuada ligula vel enim mattis tincidunt. " +
+	"Praesent non ornare nunc, at vehicula leo. " +
+	"Aenean et placerat orci. Nullam faucibus sodales diam vel volutpat. " +
+	"Nulla tempor quis quam in ullamcorper."
+
+func IsValidDataMode(mode string) bool {
+	switch mode {
+	case DataModeRegenerate, DataModeReuse, DataModeAppend:
+		return true
+	}
+	return false
+}
+
+// PrepareData loads the dataset of the stage without running it, so the stages
+// following it can reuse the data. Only MongoDB collections keep the data.
+func (s *Stage) PrepareData(ctx context.Context) error {
+	config := s.dbConfig
+	repo, err := repositories.NewMongodbRepository(&config, func(*event.PoolEvent) {})
+	if err != nil {
+		return err
+	}
+	defer closeRepository(repo)
+
+	_, err = ensureData(ctx, repo, s.stageConfig.DataMode, int(s.stageConfig.DatasetSize),
+		s.stageConfig.Loader, newSeeds(s.stageConfig.Seed).newRand())
+	return err
+}
+
+// ensureData leaves the collection ready for the stage according to the data mode
+// and returns the store ids the consumers will query.
+func ensureData(ctx context.Context, repository repositories.TestRepository, mode string, datasetSize int,
+	loaderConfig LoaderConfig, random *rand.Rand) ([]string, error) {
+
+	count, err := repository.Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var storeIds []string
+
+	switch mode {
+	case DataModeReuse:
+		if count < int64(datasetSize) {
+			return nil, fmt.Errorf("data mode %q needs at least %d documents but collection has %d",
+				mode, datasetSize, count)
+		}
+		storeIds, err = repository.SampleIds(ctx, datasetSize)
+		if err != nil {
+			return nil, err
+		}
+	case DataModeAppend:
+		if count > 0 {
+			storeIds, err = repository.SampleIds(ctx, datasetSize)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Mixing the count in keeps a seeded append from generating the store ids it
+		// appended in a previous run.
+		appendRandom := rand.New(rand.NewSource(random.Int63() ^ count))
+		newIds, err := generateData(ctx, repository, loaderConfig, appendRandom, datasetSize, int(count))
+		if err != nil {
+			return nil, err
+		}
+		total, err := repository.Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if appended := total - count; appended < int64(datasetSize) {
+			return nil, fmt.Errorf("data mode %q appended %d of %d documents, the others reused existing store ids",
+				mode, appended, datasetSize)
+		}
+		storeIds = append(storeIds, newIds...)
+	default:
+		if count > 0 {
+			if err = repository.Clear(ctx); err != nil {
+				return nil, err
+			}
+		}
+		storeIds, err = generateData(ctx, repository, loaderConfig, random, datasetSize, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	storeIds = uniqueIds(storeIds)
+	if len(storeIds) < datasetSize {
+		return nil, fmt.Errorf("data mode %q found %d distinct store ids, %d are required",
+			mode, len(storeIds), datasetSize)
+	}
+
+	logrus.Infof("Data ready using mode %q: %d store ids available", mode, len(storeIds))
+	return storeIds, nil
+}
+
+func generateData(ctx context.Context, repository repositories.TestRepository, loaderConfig LoaderConfig, random *rand.Rand,
+	size int, firstName int) ([]string, error) {
+	storeIds := make([]string, size)
+	for i := range storeIds {
+		storeIds[i] = GenerateId(random)
+	}
+
+	err := newDataLoader(repository, loaderConfig).load(ctx, size, func(i int) repositories.Store {
+		return repositories.Store{
+			StoreId:   storeIds[i],
+			Name:      "name: " + strconv.Itoa(firstName+i),
+			HugeValue: loremp,
+		}
+	})
+	return storeIds, err
+}
+
+func uniqueIds(ids []string) []string {
+	seen := make(map[string]struct{}, len(ids))
+	var result []string
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		result = append(result, id)
+	}
+	return result
+}
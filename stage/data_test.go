@@ -0,0 +1,71 @@
+package stage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func newMemoryRepository() repositories.TestRepository {
+	return repositories.NewMemoryRepository(repositories.MemoryConfiguration{}, nil, func(*event.PoolEvent) {})
+}
+
+func TestEnsureDataRegenerateIsSeeded(t *testing.T) {
+	var generated [][]string
+	for i := 0; i < 2; i++ {
+		ids, err := ensureData(context.Background(), newMemoryRepository(), DataModeRegenerate, 50, LoaderConfig{},
+			newSeeds(42).newRand())
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated = append(generated, ids)
+	}
+	for i := range generated[0] {
+		if generated[0][i] != generated[1][i] {
+			t.Fatalf("expected the same seed to generate the same store ids, %s and %s differ at %d",
+				generated[0][i], generated[1][i], i)
+		}
+	}
+}
+
+// TestEnsureDataAppendIsSeeded appends twice with the same seed, the second run
+// generating new store ids instead of the ones already in the collection.
+func TestEnsureDataAppendIsSeeded(t *testing.T) {
+	repo := newMemoryRepository()
+	ctx := context.Background()
+
+	first, err := ensureData(ctx, repo, DataModeAppend, 50, LoaderConfig{}, newSeeds(42).newRand())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ensureData(ctx, repo, DataModeAppend, 50, LoaderConfig{}, newSeeds(42).newRand())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count, _ := repo.Count(ctx); count != 100 {
+		t.Errorf("expected 100 documents after two appends, got %d", count)
+	}
+	existing := make(map[string]bool)
+	for _, id := range first {
+		existing[id] = true
+	}
+	appended := second[len(second)-50:]
+	for _, id := range appended {
+		if existing[id] {
+			t.Fatalf("expected the second append to generate new store ids, %s was already there", id)
+		}
+	}
+
+	again, err := ensureData(ctx, newMemoryRepository(), DataModeAppend, 50, LoaderConfig{}, newSeeds(42).newRand())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range again {
+		if again[i] != first[i] {
+			t.Fatalf("expected appending to the same collection size to repeat the store ids")
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package stage
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	DistributionUniform    = "uniform"
+	DistributionZipfian    = "zipfian"
+	DistributionHotspot    = "hotspot"
+	DistributionSequential = "sequential"
+	DistributionLatest     = "latest"
+)
+
+const (
+	defaultZipfSkew          = 0.99
+	defaultHotspotKeysPct    = 20
+	defaultHotspotTrafficPct = 80
+)
+
+type KeyDistributionConfig struct {
+	Name string
+	// ZipfSkew is the zipfian constant (theta), between 0 and 1 excluded.
+	ZipfSkew float64
+	// HotspotTrafficPct percent of the queried keys goes to HotspotKeysPct percent of the keys.
+	HotspotTrafficPct float64
+	HotspotKeysPct    float64
+}
+
+// keyDistribution picks positions between 0 and the number of keys it was built for.
+// Implementations must be safe for concurrent use, randomness comes from the caller.
+type keyDistribution interface {
+	next(random *rand.Rand) int
+}
+
+func IsValidDistribution(name string) bool {
+	switch name {
+	case DistributionUniform, DistributionZipfian, DistributionHotspot, DistributionSequential, DistributionLatest:
+		return true
+	}
+	return false
+}
+
+func newKeyDistribution(config KeyDistributionConfig, keys int) (keyDistribution, error) {
+	if keys <= 0 {
+		return nil, fmt.Errorf("key distribution needs at least one key")
+	}
+	switch config.Name {
+	case "", DistributionUniform:
+		return &uniformDistribution{keys: keys}, nil
+	case DistributionZipfian:
+		return newZipfianDistribution(keys, config.ZipfSkew)
+	case DistributionLatest:
+		zipfian, err := newZipfianDistribution(keys, config.ZipfSkew)
+		if err != nil {
+			return nil, err
+		}
+		return &latestDistribution{zipfian: zipfian}, nil
+	case DistributionHotspot:
+		return newHotspotDistribution(keys, config.HotspotKeysPct, config.HotspotTrafficPct)
+	case DistributionSequential:
+		return &sequentialDistribution{keys: int64(keys)}, nil
+	}
+	return nil, fmt.Errorf("unknown key distribution %q", config.Name)
+}
+
+type keyChooser struct {
+	storeIds     []string
+	distribution keyDistribution
+}
+
+func (k *keyChooser) choose(random *rand.Rand, size int) []string {
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = k.storeIds[k.distribution.next(random)]
+	}
+	return ids
+}
+
+type uniformDistribution struct {
+	keys int
+}
+
+func (u *uniformDistribution) next(random *rand.Rand) int {
+	return random.Intn(u.keys)
+}
+
+// zipfianDistribution follows the generator described in "Quickly Generating
+// Billion-Record Synthetic Databases" (Gray et al.), the same one used by YCSB.
+// Position 0 is the most popular key.
+type zipfianDistribution struct {
+	keys  int
+	theta float64
+	alpha float64
+	zetan float64
+	eta   float64
+}
+
+func newZipfianDistribution(keys int, theta float64) (*zipfianDistribution, error) {
+	if theta == 0 {
+		theta = defaultZipfSkew
+	}
+	if theta <= 0 || theta >= 1 {
+		return nil, fmt.Errorf("zipfian skew must be between 0 and 1 excluded, got %v", theta)
+	}
+	zeta2 := zeta(2, theta)
+	zetan := zeta(keys, theta)
+	return &zipfianDistribution{
+		keys:  keys,
+		theta: theta,
+		alpha: 1 / (1 - theta),
+		zetan: zetan,
+		eta:   (1 - math.Pow(2/float64(keys), 1-theta)) / (1 - zeta2/zetan),
+	}, nil
+}
+
+func zeta(n int, theta float64) float64 {
+	var sum float64
+	for i := 1; i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+func (z *zipfianDistribution) next(random *rand.Rand) int {
+	u := random.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) && z.keys > 1 {
+		return 1
+	}
+	position := int(float64(z.keys) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if position >= z.keys {
+		position = z.keys - 1
+	}
+	return position
+}
+
+// latestDistribution favours the most recently generated keys, which are the last ones.
+type latestDistribution struct {
+	zipfian *zipfianDistribution
+}
+
+func (l *latestDistribution) next(random *rand.Rand) int {
+	return l.zipfian.keys - 1 - l.zipfian.next(random)
+}
+
+type hotspotDistribution struct {
+	keys       int
+	hotKeys    int
+	hotTraffic float64
+}
+
+func newHotspotDistribution(keys int, keysPct float64, trafficPct float64) (*hotspotDistribution, error) {
+	if keysPct == 0 {
+		keysPct = defaultHotspotKeysPct
+	}
+	if trafficPct == 0 {
+		trafficPct = defaultHotspotTrafficPct
+	}
+	if keysPct < 0 || keysPct > 100 || trafficPct < 0 || trafficPct > 100 {
+		return nil, fmt.Errorf("hotspot percentages must be between 0 and 100")
+	}
+	hotKeys := int(float64(keys) * keysPct / 100)
+	if hotKeys < 1 {
+		hotKeys = 1
+	}
+	return &hotspotDistribution{
+		keys:       keys,
+		hotKeys:    hotKeys,
+		hotTraffic: trafficPct / 100,
+	}, nil
+}
+
+func (h *hotspotDistribution) next(random *rand.Rand) int {
+	if h.hotKeys == h.keys || random.Float64() < h.hotTraffic {
+		return random.Intn(h.hotKeys)
+	}
+	return h.hotKeys + random.Intn(h.keys-h.hotKeys)
+}
+
+// sequentialDistribution walks the keys in order, shared between all the workers.
+type sequentialDistribution struct {
+	keys    int64
+	counter int64
+}
+
+func (s *sequentialDistribution) next(_ *rand.Rand) int {
+	return int((atomic.AddInt64(&s.counter, 1) - 1) % s.keys)
+}
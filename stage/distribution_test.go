@@ -0,0 +1,137 @@
+package stage
+
+import (
+	"testing"
+)
+
+const distributionKeys = 1000
+
+// TestKeyDistributions draws keys from every distribution, checking they stay in
+// range and the share of the traffic going to the keys expected to be hot.
+func TestKeyDistributions(t *testing.T) {
+	tests := []struct {
+		config KeyDistributionConfig
+		// hot tells if a position is expected to get between minShare and maxShare
+		// of the traffic.
+		hot      func(position int) bool
+		minShare float64
+		maxShare float64
+	}{
+		{
+			config:   KeyDistributionConfig{Name: DistributionUniform},
+			hot:      func(position int) bool { return position < distributionKeys/10 },
+			minShare: 0.08,
+			maxShare: 0.12,
+		},
+		{
+			config:   KeyDistributionConfig{Name: DistributionZipfian},
+			hot:      func(position int) bool { return position < distributionKeys/10 },
+			minShare: 0.6,
+			maxShare: 0.8,
+		},
+		{
+			config:   KeyDistributionConfig{Name: DistributionZipfian, ZipfSkew: 0.5},
+			hot:      func(position int) bool { return position < distributionKeys/10 },
+			minShare: 0.25,
+			maxShare: 0.4,
+		},
+		{
+			config:   KeyDistributionConfig{Name: DistributionLatest},
+			hot:      func(position int) bool { return position >= distributionKeys-distributionKeys/10 },
+			minShare: 0.6,
+			maxShare: 0.8,
+		},
+		{
+			config:   KeyDistributionConfig{Name: DistributionHotspot},
+			hot:      func(position int) bool { return position < distributionKeys/5 },
+			minShare: 0.77,
+			maxShare: 0.83,
+		},
+		{
+			config:   KeyDistributionConfig{Name: DistributionHotspot, HotspotKeysPct: 10, HotspotTrafficPct: 50},
+			hot:      func(position int) bool { return position < distributionKeys/10 },
+			minShare: 0.47,
+			maxShare: 0.53,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.config.Name, func(t *testing.T) {
+			distribution, err := newKeyDistribution(test.config, distributionKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			random := newSeeds(42).newRand()
+			draws, hot := 20000, 0
+			for i := 0; i < draws; i++ {
+				position := distribution.next(random)
+				if position < 0 || position >= distributionKeys {
+					t.Fatalf("expected a position between 0 and %d, got %d", distributionKeys-1, position)
+				}
+				if test.hot(position) {
+					hot++
+				}
+			}
+			share := float64(hot) / float64(draws)
+			if share < test.minShare || share > test.maxShare {
+				t.Errorf("expected the hot keys to get between %.2f and %.2f of the traffic, got %.3f",
+					test.minShare, test.maxShare, share)
+			}
+		})
+	}
+}
+
+func TestSequentialDistributionWraps(t *testing.T) {
+	distribution, err := newKeyDistribution(KeyDistributionConfig{Name: DistributionSequential}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{0, 1, 2, 0, 1} {
+		if position := distribution.next(nil); position != expected {
+			t.Fatalf("draw %d: expected %d, got %d", i, expected, position)
+		}
+	}
+}
+
+func TestKeyDistributionsAreSeeded(t *testing.T) {
+	for _, name := range []string{DistributionUniform, DistributionZipfian, DistributionHotspot, DistributionLatest} {
+		t.Run(name, func(t *testing.T) {
+			var drawn [2][]int
+			for i := range drawn {
+				distribution, err := newKeyDistribution(KeyDistributionConfig{Name: name}, distributionKeys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				random := newSeeds(42).newRand()
+				for j := 0; j < 100; j++ {
+					drawn[i] = append(drawn[i], distribution.next(random))
+				}
+			}
+			for j := range drawn[0] {
+				if drawn[0][j] != drawn[1][j] {
+					t.Fatalf("expected the same seed to draw the same keys, %d and %d differ at %d",
+						drawn[0][j], drawn[1][j], j)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyDistributionValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config KeyDistributionConfig
+		keys   int
+	}{
+		{"no keys", KeyDistributionConfig{Name: DistributionUniform}, 0},
+		{"unknown", KeyDistributionConfig{Name: "pareto"}, 10},
+		{"zipfian skew", KeyDistributionConfig{Name: DistributionZipfian, ZipfSkew: 1}, 10},
+		{"latest skew", KeyDistributionConfig{Name: DistributionLatest, ZipfSkew: -0.5}, 10},
+		{"hotspot keys", KeyDistributionConfig{Name: DistributionHotspot, HotspotKeysPct: 120}, 10},
+		{"hotspot traffic", KeyDistributionConfig{Name: DistributionHotspot, HotspotTrafficPct: -1}, 10},
+	}
+	for _, test := range tests {
+		if _, err := newKeyDistribution(test.config, test.keys); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
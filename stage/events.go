@@ -0,0 +1,39 @@
+package stage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/journal"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Event is a milestone of the stage, such as workers being added or a fault starting.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type eventLog struct {
+	mutex   sync.Mutex
+	events  []Event
+	journal *journal.Writer
+}
+
+// record logs the event and keeps it for the result.
+func (e *eventLog) record(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logrus.Info(message)
+	e.mutex.Lock()
+	e.events = append(e.events, Event{Time: time.Now(), Message: message})
+	e.journal.Event(message)
+	e.mutex.Unlock()
+}
+
+func (e *eventLog) snapshot() []Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]Event(nil), e.events...)
+}
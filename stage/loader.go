@@ -0,0 +1,167 @@
+package stage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLoadBatchSize = 1000
+	defaultLoadWriters   = 4
+	defaultLoadRetries   = 3
+)
+
+type LoaderConfig struct {
+	BatchSize    uint
+	Writers      uint
+	Retries      uint
+	Ordered      bool
+	WriteConcern string
+}
+
+type dataLoader struct {
+	repository repositories.TestRepository
+	config     LoaderConfig
+	loaded     int64
+}
+
+func newDataLoader(repository repositories.TestRepository, config LoaderConfig) *dataLoader {
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultLoadBatchSize
+	}
+	if config.Writers == 0 {
+		config.Writers = defaultLoadWriters
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultLoadRetries
+	}
+	return &dataLoader{
+		repository: repository,
+		config:     config,
+	}
+}
+
+// load inserts total documents built by generate, splitting them in chunks written
+// by parallel writers. A failed chunk is retried up to the configured retries.
+func (l *dataLoader) load(ctx context.Context, total int, generate func(int) repositories.Store) error {
+	chunks := make(chan []repositories.Store, l.config.Writers)
+	done := make(chan struct{})
+	errs := make(chan error, l.config.Writers)
+
+	start := time.Now()
+	go l.reportProgress(total, start, done)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(int(l.config.Writers))
+	for i := 0; i < int(l.config.Writers); i++ {
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				if err := l.write(ctx, chunk); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(chunks)
+		batchSize := int(l.config.BatchSize)
+		for from := 0; from < total; from += batchSize {
+			to := from + batchSize
+			if to > total {
+				to = total
+			}
+			chunk := make([]repositories.Store, 0, to-from)
+			for i := from; i < to; i++ {
+				chunk = append(chunk, generate(i))
+			}
+			select {
+			case chunks <- chunk:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	err := <-errs
+	close(done)
+	for range errs {
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	spent := time.Since(start)
+	loaded := atomic.LoadInt64(&l.loaded)
+	logrus.Infof("Data load finished: %d documents in %v (%.0f docs/sec)",
+		loaded, spent.Truncate(time.Millisecond), rate(loaded, spent))
+	return nil
+}
+
+func (l *dataLoader) write(ctx context.Context, chunk []repositories.Store) error {
+	insertOptions := repositories.InsertOptions{
+		Ordered:      l.config.Ordered,
+		WriteConcern: l.config.WriteConcern,
+	}
+
+	var err error
+	for attempt := 0; attempt <= int(l.config.Retries); attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt > 0 {
+			logrus.Warnf("Retrying chunk of %d documents (attempt %d): %v", len(chunk), attempt, err)
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			insertOptions.IgnoreDuplicates = true
+		}
+		_, err = l.repository.Insert(ctx, chunk, insertOptions)
+		if err == nil {
+			atomic.AddInt64(&l.loaded, int64(len(chunk)))
+			return nil
+		}
+	}
+	return fmt.Errorf("chunk of %d documents failed after %d retries: %w", len(chunk), l.config.Retries, err)
+}
+
+func (l *dataLoader) reportProgress(total int, start time.Time, done <-chan struct{}) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var previous int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			loaded := atomic.LoadInt64(&l.loaded)
+			logrus.Infof("Loading data: %d/%d documents, %d docs/sec (%.0f docs/sec average)",
+				loaded, total, loaded-previous, rate(loaded, time.Since(start)))
+			previous = loaded
+		}
+	}
+}
+
+func rate(count int64, spent time.Duration) float64 {
+	if spent <= 0 {
+		return 0
+	}
+	return float64(count) / spent.Seconds()
+}
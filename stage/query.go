@@ -0,0 +1,120 @@
+package stage
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+)
+
+const (
+	defaultMinBatchSize = 100
+	defaultMaxBatchSize = 400
+)
+
+// queryShape describes the queries sent by every consumer.
+type queryShape struct {
+	keys           *keyChooser
+	minBatchSize   int
+	maxBatchSize   int
+	options        repositories.QueryOptions
+	contextTimeout time.Duration
+}
+
+func (q *queryShape) batchSize(random *rand.Rand) int {
+	if q.maxBatchSize <= q.minBatchSize {
+		return q.minBatchSize
+	}
+	return random.Intn(q.maxBatchSize-q.minBatchSize) + q.minBatchSize
+}
+
+func (q *queryShape) ids(random *rand.Rand) []string {
+	return q.keys.choose(random, q.batchSize(random))
+}
+
+type resultStats struct {
+	queries int64
+	docs    int64
+	bytes   int64
+	maxDocs int64
+	maxSize int64
+}
+
+func (r *resultStats) add(result repositories.QueryResult) {
+	docs := int64(result.Docs)
+	atomic.AddInt64(&r.queries, 1)
+	atomic.AddInt64(&r.docs, docs)
+	atomic.AddInt64(&r.bytes, result.Bytes)
+	storeMax(&r.maxDocs, docs)
+	storeMax(&r.maxSize, result.Bytes)
+}
+
+func storeMax(address *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(address)
+		if value <= current || atomic.CompareAndSwapInt64(address, current, value) {
+			return
+		}
+	}
+}
+
+func (r *resultStats) String() string {
+	queries := atomic.LoadInt64(&r.queries)
+	if queries == 0 {
+		return "no results returned"
+	}
+	return fmt.Sprintf("docs per query: avg=%d max=%d, bytes per query: avg=%d max=%d",
+		atomic.LoadInt64(&r.docs)/queries, atomic.LoadInt64(&r.maxDocs),
+		atomic.LoadInt64(&r.bytes)/queries, atomic.LoadInt64(&r.maxSize))
+}
+
+func (r *resultStats) fill(result *Result) {
+	queries := atomic.LoadInt64(&r.queries)
+	if queries == 0 {
+		return
+	}
+	result.AvgDocs = atomic.LoadInt64(&r.docs) / queries
+	result.MaxDocs = atomic.LoadInt64(&r.maxDocs)
+	result.AvgBytes = atomic.LoadInt64(&r.bytes) / queries
+	result.MaxBytes = atomic.LoadInt64(&r.maxSize)
+}
+
+type errorStats struct {
+	mutex  sync.Mutex
+	byKind map[repositories.ErrorKind]int64
+}
+
+func (e *errorStats) add(kind repositories.ErrorKind) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.byKind == nil {
+		e.byKind = make(map[repositories.ErrorKind]int64)
+	}
+	e.byKind[kind]++
+}
+
+func (e *errorStats) String() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var kinds []string
+	for kind, count := range e.byKind {
+		kinds = append(kinds, fmt.Sprintf("%s=%d", kind, count))
+	}
+	sort.Strings(kinds)
+	return "{" + strings.Join(kinds, ", ") + "}"
+}
+
+func (e *errorStats) snapshot() map[repositories.ErrorKind]int64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	byKind := make(map[repositories.ErrorKind]int64, len(e.byKind))
+	for kind, count := range e.byKind {
+		byKind[kind] = count
+	}
+	return byKind
+}
@@ -9,13 +9,32 @@ const idLength = 32
 const charset = "abcdefghijklmnopqrstuvwxyz" +
 	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
-var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+// seeds hands out the seeds of every random source used by a stage. Sources must be
+// requested always in the same order so the same seed repeats the same workload.
+type seeds struct {
+	seed   int64
+	random *rand.Rand
+}
+
+func newSeeds(seed int64) *seeds {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &seeds{
+		seed:   seed,
+		random: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (s *seeds) newRand() *rand.Rand {
+	return rand.New(rand.NewSource(s.random.Int63()))
+}
 
-func GenerateId() string {
+func GenerateId(random *rand.Rand) string {
 	b := make([]byte, idLength)
 
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		b[i] = charset[random.Intn(len(charset))]
 	}
 
 	return string(b)
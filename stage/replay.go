@@ -0,0 +1,206 @@
+package stage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/replay"
+)
+
+// ReplayConfig replays the traffic captured in Path, or a recording, instead of
+// generating queries.
+// TimeScale divides the original inter-arrival times, 2 replays twice as fast.
+type ReplayConfig struct {
+	Path      string
+	Namespace string
+	TimeScale float64
+}
+
+// RecordConfig writes the queries generated by the stage to Path, which can be
+// replayed later with the same keys, timing and workers.
+type RecordConfig struct {
+	Path string
+}
+
+// task is what producers ask the consumers to run, generated queries have no
+// operation and were meant to start at intended.
+type task struct {
+	operation *replay.Operation
+	intended  time.Time
+}
+
+// recording writes the generated queries with their offset from the start of the
+// stage, its methods do nothing on a nil recording.
+type recording struct {
+	recorder *replay.Recorder
+	started  time.Time
+}
+
+func newRecording(recorder *replay.Recorder, started time.Time) *recording {
+	if recorder == nil {
+		return nil
+	}
+	return &recording{recorder: recorder, started: started}
+}
+
+func (r *recording) query(intended time.Time, ids []string, worker int) {
+	if r == nil {
+		return
+	}
+	r.recorder.Write(replay.Recorded{AtNs: int64(intended.Sub(r.started)), Op: replay.RecordedFind,
+		Keys: ids, Worker: worker})
+}
+
+func (r *recording) workersAdded(count int) {
+	if r == nil || count == 0 {
+		return
+	}
+	r.recorder.Write(replay.Recorded{AtNs: int64(time.Since(r.started)), Op: replay.RecordedAddWorkers,
+		Workers: count})
+}
+
+// workerQueues hold the recorded operations of every worker, so the consumer with
+// the same id runs them in the order the recorded worker did.
+type workerQueues struct {
+	mutex  sync.RWMutex
+	queues map[int]chan task
+}
+
+const workerQueueSize = 100
+
+func newWorkerQueues() *workerQueues {
+	return &workerQueues{queues: make(map[int]chan task)}
+}
+
+// add creates the queue of worker, a nil workerQueues has none.
+func (w *workerQueues) add(worker int) <-chan task {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	queue := make(chan task, workerQueueSize)
+	w.queues[worker] = queue
+	return queue
+}
+
+func (w *workerQueues) queue(worker int) (chan<- task, bool) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	queue, ok := w.queues[worker]
+	return queue, ok
+}
+
+// replayStep sends an operation or adds workers.
+type replayStep struct {
+	at        time.Duration
+	operation *replay.Operation
+	workers   int
+}
+
+// replayer sends the operations of a workload to the consumers at their offsets,
+// adding the workers of a recorded workload on the way. Recorded queries go to the
+// worker that ran them when it exists, the others to any free consumer.
+type replayer struct {
+	steps      []replayStep
+	queues     *workerQueues
+	addWorkers func(int)
+	timeScale  float64
+	stopped    chan struct{}
+	done       chan struct{}
+}
+
+func startReplayer(ctx context.Context, workload *replay.Workload, timeScale float64, eventChannel chan<- task,
+	queues *workerQueues, wg *sync.WaitGroup, addWorkers func(int)) *replayer {
+	if timeScale <= 0 {
+		timeScale = 1
+	}
+	r := &replayer{
+		steps:      replaySteps(workload),
+		queues:     queues,
+		addWorkers: addWorkers,
+		timeScale:  timeScale,
+		stopped:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(r.done)
+		r.run(ctx, time.Now(), eventChannel)
+	}()
+	return r
+}
+
+func (r *replayer) run(ctx context.Context, start time.Time, eventChannel chan<- task) {
+	for _, step := range r.steps {
+		at := start.Add(time.Duration(float64(step.at) / r.timeScale))
+		if wait := time.Until(at); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-r.stopped:
+				timer.Stop()
+				return
+			}
+		}
+		if step.workers > 0 {
+			r.addWorkers(step.workers)
+			continue
+		}
+		channel := eventChannel
+		if len(step.operation.Keys) > 0 {
+			if queue, ok := r.queues.queue(step.operation.Worker); ok {
+				channel = queue
+			}
+		}
+		select {
+		case channel <- task{operation: step.operation}:
+		case <-ctx.Done():
+			return
+		case <-r.stopped:
+			return
+		}
+	}
+}
+
+// replaySteps merges the operations and the worker changes of workload by offset,
+// adding workers before the operations sent at the same time.
+func replaySteps(workload *replay.Workload) []replayStep {
+	steps := make([]replayStep, 0, len(workload.Operations)+len(workload.Workers))
+	next := 0
+	for i := range workload.Operations {
+		for ; next < len(workload.Workers) && workload.Workers[next].At <= workload.Operations[i].At; next++ {
+			steps = append(steps, replayStep{at: workload.Workers[next].At, workers: workload.Workers[next].Count})
+		}
+		steps = append(steps, replayStep{at: workload.Operations[i].At, operation: &workload.Operations[i]})
+	}
+	for ; next < len(workload.Workers); next++ {
+		steps = append(steps, replayStep{at: workload.Workers[next].At, workers: workload.Workers[next].Count})
+	}
+	return steps
+}
+
+// wait calls tick every second until every operation was sent or ctx is done.
+func (r *replayer) wait(ctx context.Context, tick func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
+
+func (r *replayer) stop() {
+	close(r.stopped)
+}
@@ -0,0 +1,90 @@
+package stage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/replay"
+)
+
+// TestReplayerSendsToRecordedWorkers replays a recording of two workers, each query
+// going to the queue of its worker in order, captured operations to any consumer.
+func TestReplayerSendsToRecordedWorkers(t *testing.T) {
+	workload := &replay.Workload{
+		Operations: []replay.Operation{
+			{At: 0, Kind: replay.KindFind, Keys: []string{"a"}, Worker: 1},
+			{At: time.Millisecond, Kind: replay.KindFind, Keys: []string{"b"}, Worker: 0},
+			{At: 2 * time.Millisecond, Kind: replay.KindFind, Keys: []string{"c"}, Worker: 1},
+			{At: 3 * time.Millisecond, Kind: replay.KindFind, Keys: []string{"d"}, Worker: 7},
+			{At: 4 * time.Millisecond, Kind: replay.KindFind},
+		},
+		Workers: []replay.WorkersChange{{At: 0, Count: 2}},
+	}
+	queues := newWorkerQueues()
+	workers := make([]<-chan task, 0, 2)
+	eventChannel := make(chan task, 10)
+	wg := &sync.WaitGroup{}
+	replayer := startReplayer(context.Background(), workload, 1, eventChannel, queues, wg, func(count int) {
+		for i := 0; i < count; i++ {
+			workers = append(workers, queues.add(len(workers)))
+		}
+	})
+	wg.Wait()
+	replayer.stop()
+	close(eventChannel)
+
+	if len(workers) != 2 {
+		t.Fatalf("expected 2 workers, got %d", len(workers))
+	}
+	expected := [][]string{{"b"}, {"a", "c"}}
+	for worker, keys := range expected {
+		for _, key := range keys {
+			select {
+			case next := <-workers[worker]:
+				if next.operation.Keys[0] != key {
+					t.Errorf("expected worker %d to run %s, got %v", worker, key, next.operation.Keys)
+				}
+			default:
+				t.Fatalf("expected worker %d to run %s", worker, key)
+			}
+		}
+		if len(workers[worker]) != 0 {
+			t.Errorf("expected worker %d to run only %v", worker, keys)
+		}
+	}
+
+	var shared []replay.Operation
+	for next := range eventChannel {
+		shared = append(shared, *next.operation)
+	}
+	if len(shared) != 2 || shared[0].Worker != 7 || len(shared[1].Keys) != 0 {
+		t.Errorf("expected the query of a missing worker and the captured operation to be shared, got %+v", shared)
+	}
+}
+
+// TestConsumerRunsItsTasksAfterClose checks a consumer still runs the tasks of its
+// queue once the shared channel is closed.
+func TestConsumerRunsItsTasksAfterClose(t *testing.T) {
+	shared := make(chan task, 1)
+	queues := newWorkerQueues()
+	own := queues.add(0)
+	queue, _ := queues.queue(0)
+	queue <- task{operation: &replay.Operation{Keys: []string{"a"}}}
+	queue <- task{operation: &replay.Operation{Keys: []string{"b"}}}
+	close(shared)
+
+	c := &consumer{eventChannel: shared, tasks: own}
+	var keys []string
+	for {
+		next, ok := c.next()
+		if !ok {
+			break
+		}
+		keys = append(keys, next.operation.Keys[0])
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected a and b, got %v", keys)
+	}
+}
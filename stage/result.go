@@ -0,0 +1,136 @@
+package stage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"github.com/n4d13/mongo_driver_test/stats"
+)
+
+// Result summarizes a finished stage.
+type Result struct {
+	Seed         int64                            `json:"seed"`
+	Started      time.Time                        `json:"started"`
+	DurationSecs float64                          `json:"duration_secs"`
+	Canceled     bool                             `json:"canceled"`
+	AbortReason  string                           `json:"abort_reason,omitempty"`
+	Error        string                           `json:"error,omitempty"`
+	Queries      int64                            `json:"queries"`
+	Errors       int64                            `json:"errors"`
+	ErrorRate    float64                          `json:"error_rate"`
+	ErrorsByKind map[repositories.ErrorKind]int64 `json:"errors_by_kind,omitempty"`
+	Throughput   float64                          `json:"throughput"`
+	Latency      LatencySummary                   `json:"latency_ms"`
+	AvgDocs      int64                            `json:"avg_docs"`
+	MaxDocs      int64                            `json:"max_docs"`
+	AvgBytes     int64                            `json:"avg_bytes"`
+	MaxBytes     int64                            `json:"max_bytes"`
+	Pool         stats.PoolSnapshot               `json:"pool"`
+	Verdict      string                           `json:"verdict,omitempty"`
+	Breaches     []string                         `json:"breaches,omitempty"`
+	// ViolatingWindows are the seconds, from the start of the stage, of the windows
+	// breaking any threshold.
+	ViolatingWindows []int         `json:"violating_windows,omitempty"`
+	Phases           []PhaseResult `json:"phases,omitempty"`
+	Timeline         []Window      `json:"timeline,omitempty"`
+	Events           []Event       `json:"events,omitempty"`
+}
+
+// Passed tells whether the stage stayed within its thresholds.
+func (r *Result) Passed() bool {
+	return r.Verdict != VerdictFail
+}
+
+// LatencySummary holds query latencies in milliseconds.
+type LatencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (l LatencySummary) String() string {
+	return fmt.Sprintf("min=%.1f mean=%.1f p50=%.1f p90=%.1f p95=%.1f p99=%.1f max=%.1f",
+		l.Min, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+}
+
+// latencyRecorder keeps every query latency of the stage.
+type latencyRecorder struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+}
+
+func (l *latencyRecorder) add(spent time.Duration) {
+	l.mutex.Lock()
+	l.samples = append(l.samples, spent)
+	l.mutex.Unlock()
+}
+
+func (l *latencyRecorder) count() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(len(l.samples))
+}
+
+// since copies the samples recorded after the first from.
+func (l *latencyRecorder) since(from int) []time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	samples := make([]time.Duration, len(l.samples)-from)
+	copy(samples, l.samples[from:])
+	return samples
+}
+
+func (l *latencyRecorder) summary() LatencySummary {
+	return summarize(l.snapshot())
+}
+
+// snapshot copies the samples in the order they were recorded.
+func (l *latencyRecorder) snapshot() []time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	samples := make([]time.Duration, len(l.samples))
+	copy(samples, l.samples)
+	return samples
+}
+
+// summarize sorts samples in place.
+func summarize(samples []time.Duration) LatencySummary {
+	if len(samples) == 0 {
+		return LatencySummary{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var total time.Duration
+	for _, sample := range samples {
+		total += sample
+	}
+	return LatencySummary{
+		Min:  milliseconds(samples[0]),
+		Mean: milliseconds(total / time.Duration(len(samples))),
+		P50:  milliseconds(percentile(samples, 50)),
+		P90:  milliseconds(percentile(samples, 90)),
+		P95:  milliseconds(percentile(samples, 95)),
+		P99:  milliseconds(percentile(samples, 99)),
+		Max:  milliseconds(samples[len(samples)-1]),
+	}
+}
+
+// percentile uses the nearest rank method over sorted samples.
+func percentile(sorted []time.Duration, pct float64) time.Duration {
+	rank := int(math.Ceil(pct / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
@@ -0,0 +1,126 @@
+package stage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/faults"
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"github.com/sirupsen/logrus"
+)
+
+// scheduledAction runs at a given offset from the moment the stage starts its load.
+type scheduledAction struct {
+	at   time.Duration
+	name string
+	run  func()
+}
+
+type schedule struct {
+	actions []scheduledAction
+	events  *eventLog
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+// startSchedule records an event before running every action.
+func startSchedule(actions []scheduledAction, events *eventLog) *schedule {
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].at < actions[j].at
+	})
+	s := &schedule{
+		actions: actions,
+		events:  events,
+		stopped: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run(time.Now())
+	return s
+}
+
+func (s *schedule) run(start time.Time) {
+	defer s.wg.Done()
+	for _, action := range s.actions {
+		timer := time.NewTimer(time.Until(start.Add(action.at)))
+		select {
+		case <-s.stopped:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.events.record("Scheduled action: %s", action.name)
+			action.run()
+		}
+	}
+}
+
+// stop cancels the pending actions and waits for the running one to finish.
+func (s *schedule) stop() {
+	close(s.stopped)
+	s.wg.Wait()
+}
+
+func faultActions(proxy *faults.Proxy, configured []faults.Fault) []scheduledAction {
+	var actions []scheduledAction
+	for i, fault := range configured {
+		id, fault := i, fault
+		actions = append(actions, scheduledAction{
+			at:   time.Duration(fault.StartSecs) * time.Second,
+			name: "activate " + fault.Type + " fault",
+			run:  func() { proxy.Activate(id, fault) },
+		})
+		if fault.DurationSecs > 0 {
+			actions = append(actions, scheduledAction{
+				at:   time.Duration(fault.StartSecs+fault.DurationSecs) * time.Second,
+				name: "deactivate " + fault.Type + " fault",
+				run:  func() { proxy.Deactivate(id, fault) },
+			})
+		}
+	}
+	return actions
+}
+
+func failPointActions(client *repositories.FailPointClient, configured []ScheduledFailPoint) []scheduledAction {
+	var actions []scheduledAction
+	for _, scheduled := range configured {
+		failPoint := scheduled.FailPoint
+		actions = append(actions, scheduledAction{
+			at:   time.Duration(scheduled.AtSecs) * time.Second,
+			name: "configure fail point " + failPoint.Name,
+			run: func() {
+				if err := client.Configure(failPoint); err != nil {
+					logrus.Errorf("Fail point %s can't be configured: %v", failPoint.Name, err)
+					return
+				}
+				logrus.Infof("Fail point %s configured with mode %v", failPoint.Name, failPoint.Mode)
+			},
+		})
+		if scheduled.DurationSecs > 0 {
+			actions = append(actions, scheduledAction{
+				at:   time.Duration(scheduled.AtSecs+scheduled.DurationSecs) * time.Second,
+				name: "turn off fail point " + failPoint.Name,
+				run:  func() { turnOffFailPoint(client, failPoint.Name) },
+			})
+		}
+	}
+	return actions
+}
+
+func turnOffFailPoints(client *repositories.FailPointClient, configured []ScheduledFailPoint) {
+	done := make(map[string]struct{})
+	for _, scheduled := range configured {
+		if _, ok := done[scheduled.FailPoint.Name]; ok {
+			continue
+		}
+		done[scheduled.FailPoint.Name] = struct{}{}
+		turnOffFailPoint(client, scheduled.FailPoint.Name)
+	}
+}
+
+func turnOffFailPoint(client *repositories.FailPointClient, name string) {
+	if err := client.Off(name); err != nil {
+		logrus.Errorf("Fail point %s can't be turned off: %v", name, err)
+		return
+	}
+	logrus.Infof("Fail point %s turned off", name)
+}
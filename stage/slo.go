@@ -0,0 +1,191 @@
+package stage
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	VerdictPass = "pass"
+	VerdictFail = "fail"
+)
+
+// Thresholds are the SLO assertions of a stage, zero values are not checked.
+type Thresholds struct {
+	MaxErrorRate float64
+	MaxP99Ms     float64
+	// NoPoolTimeouts fails the stage on any pool checkout timing out.
+	NoPoolTimeouts bool
+	// InUseWithinPool fails the stage when more connections than the max pool size are in use.
+	InUseWithinPool bool
+	// MinThroughputPct is the percentage of the target queries per second the stage must achieve.
+	MinThroughputPct float64
+}
+
+func (t Thresholds) enabled() bool {
+	return t.MaxErrorRate > 0 || t.MaxP99Ms > 0 || t.NoPoolTimeouts || t.InUseWithinPool || t.MinThroughputPct > 0
+}
+
+// PhaseResult summarizes the windows of one phase of the stage.
+type PhaseResult struct {
+	Name         string         `json:"name"`
+	FromSecond   int            `json:"from_second"`
+	ToSecond     int            `json:"to_second"`
+	Queries      int64          `json:"queries"`
+	Errors       int64          `json:"errors"`
+	ErrorRate    float64        `json:"error_rate"`
+	Throughput   float64        `json:"throughput"`
+	Latency      LatencySummary `json:"latency_ms"`
+	PoolTimeouts int64          `json:"pool_timeouts"`
+	PeakInUse    int64          `json:"peak_in_use"`
+	Violations   []string       `json:"violations,omitempty"`
+}
+
+// measurement is what the assertions are checked against, for the whole run, a
+// phase or a window.
+type measurement struct {
+	errorRate     float64
+	p99Ms         float64
+	poolTimeouts  int64
+	peakInUse     int64
+	throughput    float64
+	hasThroughput bool
+}
+
+// sloLimits are the stage settings some assertions depend on.
+type sloLimits struct {
+	maxPool   int64
+	targetRPS float64
+}
+
+func (t Thresholds) check(m measurement, limits sloLimits) []string {
+	var violations []string
+	if t.MaxErrorRate > 0 && m.errorRate > t.MaxErrorRate {
+		violations = append(violations, fmt.Sprintf("error rate %.4f above %.4f", m.errorRate, t.MaxErrorRate))
+	}
+	if t.MaxP99Ms > 0 && m.p99Ms > t.MaxP99Ms {
+		violations = append(violations, fmt.Sprintf("p99 latency %.1fms above %.1fms", m.p99Ms, t.MaxP99Ms))
+	}
+	if t.NoPoolTimeouts && m.poolTimeouts > 0 {
+		violations = append(violations, fmt.Sprintf("%d pool checkouts timed out", m.poolTimeouts))
+	}
+	if t.InUseWithinPool && limits.maxPool > 0 && m.peakInUse > limits.maxPool {
+		violations = append(violations, fmt.Sprintf("%d connections in use above max pool %d", m.peakInUse, limits.maxPool))
+	}
+	if t.MinThroughputPct > 0 && m.hasThroughput && limits.targetRPS > 0 {
+		if achieved := m.throughput / limits.targetRPS * 100; achieved < t.MinThroughputPct {
+			violations = append(violations, fmt.Sprintf("throughput %.1f/s is %.1f%% of target %.1f/s, below %.1f%%",
+				m.throughput, achieved, limits.targetRPS, t.MinThroughputPct))
+		}
+	}
+	return violations
+}
+
+// evaluate checks the assertions over the whole run, every phase and every window,
+// filling the verdict of the result. Throughput is not checked while draining nor
+// in windows shorter than half a second. An aborted stage always fails.
+func (t Thresholds) evaluate(result *Result, windows []Window, samples []time.Duration, limits sloLimits) {
+	result.Timeline = windows
+	result.Phases = phases(windows, samples)
+	if result.AbortReason != "" {
+		result.Breaches = append(result.Breaches, "aborted: "+result.AbortReason)
+		result.Verdict = VerdictFail
+	}
+	if !t.enabled() {
+		return
+	}
+
+	var loadQueries int64
+	var loadSecs float64
+	for i := range windows {
+		window := &windows[i]
+		window.Violations = t.check(measurement{
+			errorRate:     window.ErrorRate,
+			p99Ms:         window.P99Ms,
+			poolTimeouts:  window.PoolTimeouts,
+			peakInUse:     window.PeakInUse,
+			throughput:    window.Throughput,
+			hasThroughput: window.Phase != phaseDrain && window.DurationSecs >= 0.5,
+		}, limits)
+		if len(window.Violations) > 0 {
+			result.ViolatingWindows = append(result.ViolatingWindows, window.Second)
+		}
+		if window.Phase != phaseDrain {
+			loadQueries += window.Queries
+			loadSecs += window.DurationSecs
+		}
+	}
+
+	for i := range result.Phases {
+		phase := &result.Phases[i]
+		phase.Violations = t.check(measurement{
+			errorRate:     phase.ErrorRate,
+			p99Ms:         phase.Latency.P99,
+			poolTimeouts:  phase.PoolTimeouts,
+			peakInUse:     phase.PeakInUse,
+			throughput:    phase.Throughput,
+			hasThroughput: phase.Name != phaseDrain,
+		}, limits)
+		for _, violation := range phase.Violations {
+			result.Breaches = append(result.Breaches, phase.Name+": "+violation)
+		}
+	}
+
+	run := measurement{
+		errorRate:     result.ErrorRate,
+		p99Ms:         result.Latency.P99,
+		poolTimeouts:  result.Pool.Reasons[event.ReasonTimedOut],
+		peakInUse:     result.Pool.PeakInUse,
+		hasThroughput: loadSecs > 0,
+	}
+	if loadSecs > 0 {
+		run.throughput = float64(loadQueries) / loadSecs
+	}
+	for _, violation := range t.check(run, limits) {
+		result.Breaches = append(result.Breaches, "run: "+violation)
+	}
+
+	result.Verdict = VerdictPass
+	if len(result.Breaches) > 0 {
+		result.Verdict = VerdictFail
+	}
+}
+
+// phases groups consecutive windows of the same phase.
+func phases(windows []Window, samples []time.Duration) []PhaseResult {
+	var result []PhaseResult
+	for from := 0; from < len(windows); {
+		to := from
+		for to+1 < len(windows) && windows[to+1].Phase == windows[from].Phase {
+			to++
+		}
+		phase := PhaseResult{
+			Name:       windows[from].Phase,
+			FromSecond: windows[from].Second,
+			ToSecond:   windows[to].Second,
+		}
+		var secs float64
+		for _, window := range windows[from : to+1] {
+			phase.Queries += window.Queries
+			phase.Errors += window.Errors
+			phase.PoolTimeouts += window.PoolTimeouts
+			if window.PeakInUse > phase.PeakInUse {
+				phase.PeakInUse = window.PeakInUse
+			}
+			secs += window.DurationSecs
+		}
+		if phase.Queries > 0 {
+			phase.ErrorRate = float64(phase.Errors) / float64(phase.Queries)
+		}
+		if secs > 0 {
+			phase.Throughput = float64(phase.Queries) / secs
+		}
+		phase.Latency = summarize(append([]time.Duration(nil),
+			samples[windows[from].firstSample:windows[to].lastSample]...))
+		result = append(result, phase)
+		from = to + 1
+	}
+	return result
+}
@@ -1,16 +1,21 @@
 package stage
 
 import (
-	"math"
+	"context"
+	"fmt"
 	"math/rand"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/n4d13/mongo_driver_test/fakemongo"
+	"github.com/n4d13/mongo_driver_test/faults"
+	"github.com/n4d13/mongo_driver_test/journal"
+	"github.com/n4d13/mongo_driver_test/replay"
 	"github.com/n4d13/mongo_driver_test/repositories"
 	"github.com/n4d13/mongo_driver_test/stats"
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
 )
 
 type Config struct {
@@ -23,27 +28,134 @@ type Config struct {
 	TimeToFinishSecs uint
 	ContextTimeMs    uint
 	QueryTimeoutMs   uint
+	DataMode         string
+	DatasetSize      uint
+	Loader           LoaderConfig
+	KeyDistribution  KeyDistributionConfig
+	Seed             int64
+	MinBatchSize     uint
+	MaxBatchSize     uint
+	CursorBatchSize  uint
+	Limit            uint
+	Projection       []string
+	Faults           []faults.Fault
+	FakeServer       *fakemongo.Options
+	FailPoints       []ScheduledFailPoint
+	Memory           *repositories.MemoryConfiguration
+	Thresholds       Thresholds
+	Abort            AbortRules
+	Journal          JournalConfig
+	Replay           *ReplayConfig
+	Record           RecordConfig
+}
+
+// JournalConfig records every pool, command and operation event of the stage to an
+// NDJSON file at Path, compressed with gzip when Gzip is set.
+type JournalConfig struct {
+	Path string
+	Gzip bool
+}
+
+// ScheduledFailPoint configures FailPoint AtSecs after the load starts and turns it
+// off DurationSecs later. Fail points are always turned off when the stage ends.
+type ScheduledFailPoint struct {
+	AtSecs       uint
+	DurationSecs uint
+	FailPoint    repositories.FailPoint
 }
 
 type Stage struct {
-	dbConfig      repositories.MongoDBConfiguration
-	stageConfig   Config
-	timeSpentByOp []int64
-	errorCount    int64
+	dbConfig    repositories.MongoDBConfiguration
+	stageConfig Config
+	latencies   latencyRecorder
+	errorCount  int64
+	results     resultStats
+	errors      errorStats
+	events      eventLog
 }
 
+const closeTimeout = 10 * time.Second
+
 func New(
 	dbConfig repositories.MongoDBConfiguration,
 	stageConfig Config) *Stage {
+	if stageConfig.DataMode == "" {
+		stageConfig.DataMode = DataModeRegenerate
+	}
+	if stageConfig.DatasetSize == 0 {
+		stageConfig.DatasetSize = defaultDatasetSize
+	}
+	if stageConfig.MinBatchSize == 0 {
+		stageConfig.MinBatchSize = defaultMinBatchSize
+	}
+	if stageConfig.MaxBatchSize == 0 {
+		stageConfig.MaxBatchSize = defaultMaxBatchSize
+	}
 	return &Stage{
 		dbConfig:    dbConfig,
 		stageConfig: stageConfig,
 	}
 }
 
-func (s *Stage) Run() {
+// SetJournalPath records the journal of the stage to path.
+func (s *Stage) SetJournalPath(path string) {
+	s.stageConfig.Journal.Path = path
+}
+
+// SetRecordingPath records the generated queries of the stage to path.
+func (s *Stage) SetRecordingPath(path string) {
+	s.stageConfig.Record.Path = path
+}
+
+// Run executes the stage until it finishes or ctx is canceled. A canceled stage
+// still returns the result of the queries executed so far.
+func (s *Stage) Run(ctx context.Context) (*Result, error) {
 
+	seeds := newSeeds(s.stageConfig.Seed)
+	// The data source comes first so PrepareData generates the same store ids.
+	dataRandom := seeds.newRand()
 	statsMonitor := stats.NewPoolStats()
+	poolMonitor := statsMonitor.MonitorFunc
+
+	var err error
+	var workload *replay.Workload
+	if s.stageConfig.Replay != nil {
+		workload, err = replay.Load(s.stageConfig.Replay.Path, s.stageConfig.Replay.Namespace)
+		if err != nil {
+			return s.failed(ctx, seeds.seed, err)
+		}
+	}
+
+	var stageJournal *journal.Writer
+	if s.stageConfig.Journal.Path != "" {
+		stageJournal, err = journal.Create(s.stageConfig.Journal.Path, s.stageConfig.Journal.Gzip)
+		if err != nil {
+			return s.failed(ctx, seeds.seed, err)
+		}
+		defer func() {
+			if err := stageJournal.Close(); err != nil {
+				logrus.Errorf("Journal %s can't be written: %v", s.stageConfig.Journal.Path, err)
+			}
+		}()
+		s.events.journal = stageJournal
+		poolMonitor = func(poolEvent *event.PoolEvent) {
+			statsMonitor.MonitorFunc(poolEvent)
+			stageJournal.Pool(poolEvent)
+		}
+	}
+
+	var recorder *replay.Recorder
+	if s.stageConfig.Record.Path != "" {
+		recorder, err = replay.NewRecorder(s.stageConfig.Record.Path)
+		if err != nil {
+			return s.failed(ctx, seeds.seed, err)
+		}
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				logrus.Errorf("Recording %s can't be written: %v", s.stageConfig.Record.Path, err)
+			}
+		}()
+	}
 
 	config := &repositories.MongoDBConfiguration{
 		DbName:         s.dbConfig.DbName,
@@ -54,117 +166,282 @@ func (s *Stage) Run() {
 		IdleTimeout:    s.dbConfig.IdleTimeout,
 		SocketTimeout:  s.dbConfig.SocketTimeout,
 	}
-	repo, err := repositories.NewMongodbRepository(config, statsMonitor.MonitorFunc)
-	if err != nil {
-		logrus.Fatal(err)
+
+	if s.stageConfig.FakeServer != nil {
+		server, err := fakemongo.NewServer(*s.stageConfig.FakeServer)
+		if err != nil {
+			return s.failed(ctx, seeds.seed, err)
+		}
+		defer server.Close()
+		config.ConnString = server.ConnString(config.DbName)
 	}
 
-	spentFunc := func(timeSpent int64) {
-		s.timeSpentByOp = append(s.timeSpentByOp, timeSpent)
+	var failPoints *repositories.FailPointClient
+	if len(s.stageConfig.FailPoints) > 0 {
+		failPoints, err = repositories.NewFailPointClient(config)
+		if err != nil {
+			return s.failed(ctx, seeds.seed, err)
+		}
+		defer failPoints.Close()
+	}
+
+	var proxy *faults.Proxy
+	if len(s.stageConfig.Faults) > 0 {
+		faultsRandom := seeds.newRand()
+		config.ConnString, err = faults.Redirect(config.ConnString, func(upstream string) (string, error) {
+			proxy, err = faults.NewProxy(upstream, faultsRandom)
+			if err != nil {
+				return "", err
+			}
+			return proxy.Addr(), nil
+		})
+		if err != nil {
+			return s.failed(ctx, seeds.seed, err)
+		}
+		defer proxy.Close()
 	}
 
-	errorFunc := func() {
+	if stageJournal != nil {
+		config.CommandMonitor = stageJournal.CommandMonitor()
+	}
+
+	var repo repositories.TestRepository
+	if s.stageConfig.Memory != nil {
+		memoryConfig := *s.stageConfig.Memory
+		memoryConfig.MaxPool = config.MaxPool
+		repo = repositories.NewMemoryRepository(memoryConfig, seeds.newRand(), poolMonitor)
+	} else {
+		repo, err = repositories.NewMongodbRepository(config, poolMonitor)
+		if err != nil {
+			return s.failed(ctx, seeds.seed, fmt.Errorf("can't connect to %s: %w", config.DbName, err))
+		}
+	}
+
+	spentFunc := s.latencies.add
+
+	errorFunc := func(err error) {
 		atomic.AddInt64(&s.errorCount, 1)
+		s.errors.add(repositories.KindOf(err))
 	}
 
-	storeIds, err := ensureData(repo)
-	if err != nil {
-		return
+	s.events.record("Running stage with seed %d", seeds.seed)
+	result := &Result{Seed: seeds.seed}
+
+	shape := &queryShape{
+		minBatchSize: int(s.stageConfig.MinBatchSize),
+		maxBatchSize: int(s.stageConfig.MaxBatchSize),
+		options: repositories.QueryOptions{
+			QueryTimeoutMs:  s.stageConfig.QueryTimeoutMs,
+			CursorBatchSize: s.stageConfig.CursorBatchSize,
+			Limit:           s.stageConfig.Limit,
+			Projection:      s.stageConfig.Projection,
+		},
+		contextTimeout: time.Duration(s.stageConfig.ContextTimeMs) * time.Millisecond,
 	}
 
-	repo.SetValidIds(storeIds)
+	// A replay runs the captured operations on the data already in the collection.
+	if workload == nil {
+		storeIds, err := ensureData(ctx, repo, s.stageConfig.DataMode, int(s.stageConfig.DatasetSize),
+			s.stageConfig.Loader, dataRandom)
+		if err != nil {
+			closeRepository(repo)
+			return s.failed(ctx, seeds.seed, fmt.Errorf("data can't be prepared: %w", err))
+		}
 
-	eventChannel := make(chan struct{}, 1000)
+		s.events.record("Data ready: %d store ids", len(storeIds))
+
+		distribution, err := newKeyDistribution(s.stageConfig.KeyDistribution, len(storeIds))
+		if err != nil {
+			closeRepository(repo)
+			return s.failed(ctx, seeds.seed, err)
+		}
+		shape.keys = &keyChooser{
+			storeIds:     storeIds,
+			distribution: distribution,
+		}
+	} else {
+		s.events.record("Replaying %d operations captured over %v, %d entries skipped",
+			len(workload.Operations), workload.Span(), workload.Skipped)
+	}
+
+	// A recorded workload adds its workers when the recording stage did.
+	workersCount := int(s.stageConfig.WorkersCount)
+	if workload != nil && len(workload.Workers) > 0 {
+		workersCount = 0
+	}
+
+	eventChannel := make(chan task, 1000)
+	result.Started = time.Now()
+	stageRecording := newRecording(recorder, result.Started)
+	stageRecording.workersAdded(workersCount)
+	runCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	stageAborter := newAborter(s.stageConfig.Abort, abort)
+	stageTimeline := startTimeline(&s.latencies, &s.errorCount, statsMonitor, phaseSteady, stageAborter.observe)
+	stageJournal.Phase(phaseSteady)
+	setPhase := func(phase string) {
+		stageTimeline.setPhase(phase)
+		stageJournal.Phase(phase)
+	}
 
 	wgP := &sync.WaitGroup{}
+	wgC := &sync.WaitGroup{}
 
-	producers := addProducers(int(s.stageConfig.ProducersCount), eventChannel, int(s.stageConfig.MsgBySec), wgP)
+	faultSchedule := startSchedule(append(faultActions(proxy, s.stageConfig.Faults),
+		failPointActions(failPoints, s.stageConfig.FailPoints)...), &s.events)
 
-	workers := addWorkers(int(s.stageConfig.WorkersCount), repo, eventChannel,
-		s.stageConfig.QueryTimeoutMs, s.stageConfig.ContextTimeMs, spentFunc, errorFunc)
+	var queues *workerQueues
+	if workload != nil {
+		queues = newWorkerQueues()
+	}
+	workers := addWorkers(ctx, runCtx.Done(), wgC, 0, workersCount, repo, shape, seeds, eventChannel, queues,
+		spentFunc, errorFunc, s.results.add, stageJournal, stageRecording)
 
-	intLoad := int(s.stageConfig.IncrementLoad)
-	intTimeToSleep := int(s.stageConfig.TimeToSleepSecs)
-	for n := 0; n < intLoad; n++ {
-		logrus.Printf("Waiting %d seconds to add %d workers. Current count: %d",
-			s.stageConfig.TimeToSleepSecs, s.stageConfig.WorkersToAdd, len(workers))
-		for i := 0; i < intTimeToSleep; i++ {
-			logrus.WithField("executed", repo.QueryCount()).Infof("%v", statsMonitor)
-			time.Sleep(1 * time.Second)
-		}
-		workers = append(workers, addWorkers(int(s.stageConfig.WorkersToAdd), repo, eventChannel,
-			s.stageConfig.QueryTimeoutMs, s.stageConfig.ContextTimeMs, spentFunc, errorFunc)...)
-		logrus.Printf("%d workers added. Using %d in total", s.stageConfig.WorkersToAdd, len(workers))
+	var producers []*producer
+	var stageReplayer *replayer
+	if workload != nil {
+		replayedWorkers := len(workers)
+		stageReplayer = startReplayer(runCtx, workload, s.stageConfig.Replay.TimeScale, eventChannel, queues, wgP,
+			func(count int) {
+				addWorkers(ctx, runCtx.Done(), wgC, replayedWorkers, count, repo, shape, seeds, eventChannel, queues,
+					spentFunc, errorFunc, s.results.add, stageJournal, stageRecording)
+				replayedWorkers += count
+				s.events.record("%d workers added. Using %d in total", count, replayedWorkers)
+			})
+	} else {
+		producers = addProducers(runCtx, int(s.stageConfig.ProducersCount), eventChannel, int(s.stageConfig.MsgBySec), wgP)
 	}
 
-	logrus.Printf("Waiting %d seconds to finish", s.stageConfig.TimeToFinishSecs)
-	intTimeToFinish := int(s.stageConfig.TimeToFinishSecs)
-	for i := 0; i < intTimeToFinish; i++ {
+	logStats := func() {
 		logrus.WithField("executed", repo.QueryCount()).Infof("%+v", statsMonitor)
-		time.Sleep(1 * time.Second)
+	}
+
+	if stageReplayer != nil {
+		stageReplayer.wait(runCtx, logStats)
+		stageReplayer.stop()
+	} else {
+		intLoad := int(s.stageConfig.IncrementLoad)
+		for n := 0; n < intLoad && runCtx.Err() == nil; n++ {
+			setPhase(fmt.Sprintf("ramp-%d", n+1))
+			logrus.Printf("Waiting %d seconds to add %d workers. Current count: %d",
+				s.stageConfig.TimeToSleepSecs, s.stageConfig.WorkersToAdd, len(workers))
+			if !waitSeconds(runCtx, s.stageConfig.TimeToSleepSecs, logStats) {
+				break
+			}
+			workers = append(workers, addWorkers(ctx, runCtx.Done(), wgC, len(workers), int(s.stageConfig.WorkersToAdd), repo,
+				shape, seeds, eventChannel, nil, spentFunc, errorFunc, s.results.add, stageJournal, stageRecording)...)
+			stageRecording.workersAdded(int(s.stageConfig.WorkersToAdd))
+			s.events.record("%d workers added. Using %d in total", s.stageConfig.WorkersToAdd, len(workers))
+		}
+
+		if runCtx.Err() == nil {
+			setPhase(phaseSteady)
+			s.events.record("Waiting %d seconds to finish", s.stageConfig.TimeToFinishSecs)
+			waitSeconds(runCtx, s.stageConfig.TimeToFinishSecs, logStats)
+		}
 	}
 
 	for _, producer := range producers {
 		producer.stop()
 	}
 	wgP.Wait()
-	logrus.Println("Producers stopped.")
-
-	for len(eventChannel) > 0 {
-		logrus.WithField("executed", repo.QueryCount()).Infof("%+v", statsMonitor)
-		time.Sleep(1 * time.Second)
+	close(eventChannel)
+	setPhase(phaseDrain)
+	s.events.record("Producers stopped")
+	faultSchedule.stop()
+	turnOffFailPoints(failPoints, s.stageConfig.FailPoints)
+
+	for len(eventChannel) > 0 && runCtx.Err() == nil {
+		logStats()
+		waitSeconds(runCtx, 1, func() {})
+	}
+	if result.AbortReason = stageAborter.abortReason(); result.AbortReason != "" {
+		s.events.record("Stage aborted: %s", result.AbortReason)
+	} else if ctx.Err() != nil {
+		s.events.record("Stage canceled: %v", ctx.Err())
+		result.Canceled = true
 	}
+	wgC.Wait()
+	windows := stageTimeline.stop()
+	result.DurationSecs = time.Since(result.Started).Seconds()
 
-	repo.Close()
+	closeRepository(repo)
 
 	time.Sleep(1 * time.Second)
 	logrus.Printf("Total query count: %d", repo.QueryCount())
 	logrus.Printf("%+v", statsMonitor)
 
-	var total int64
-	var max int64
-	var min int64 = math.MaxInt64
-	for _, spent := range s.timeSpentByOp {
-		total += spent
-		if spent > max {
-			max = spent
-		} else {
-			if spent < min {
-				min = spent
-			}
-		}
+	result.Queries = s.latencies.count()
+	result.Errors = atomic.LoadInt64(&s.errorCount)
+	if result.Queries > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(result.Queries)
+	}
+	if result.DurationSecs > 0 {
+		result.Throughput = float64(result.Queries) / result.DurationSecs
+	}
+	result.ErrorsByKind = s.errors.snapshot()
+	result.Latency = s.latencies.summary()
+	result.Pool = statsMonitor.Snapshot()
+	s.results.fill(result)
+	limits := sloLimits{maxPool: int64(config.MaxPool)}
+	if workload == nil {
+		limits.targetRPS = targetRPS(s.stageConfig.ProducersCount, s.stageConfig.MsgBySec)
 	}
+	s.stageConfig.Thresholds.evaluate(result, windows, s.latencies.snapshot(), limits)
 
-	logrus.Printf("Errors = %d. Median = %d, min = %d, max = %d", s.errorCount, total/int64(len(s.timeSpentByOp)), min, max)
+	logrus.Printf("Errors = %d %v. Latency: %v", result.Errors, &s.errors, result.Latency)
+	logrus.Printf("Results: %v", &s.results)
+	for _, breach := range result.Breaches {
+		logrus.Warnf("Threshold breached: %s", breach)
+	}
+	if result.Verdict != "" {
+		s.events.record("Verdict: %s", result.Verdict)
+	}
+	result.Events = s.events.snapshot()
 
+	return result, nil
 }
 
 func addWorkers(
+	ctx context.Context,
+	stopped <-chan struct{},
+	wg *sync.WaitGroup,
+	firstId int,
 	workersCount int,
 	repo repositories.TestRepository,
-	evChan chan struct{},
-	queryTimeout uint,
-	contextTimeout uint,
-	spentFunc func(int64),
-	errorFunc func(),
+	shape *queryShape,
+	seeds *seeds,
+	evChan chan task,
+	queues *workerQueues,
+	spentFunc func(time.Duration),
+	errorFunc func(error),
+	resultFunc func(repositories.QueryResult),
+	stageJournal *journal.Writer,
+	stageRecording *recording,
 ) []*consumer {
 	var consumers []*consumer
 	for i := 0; i < workersCount; i++ {
 		consumer := &consumer{
-			repository:     repo,
-			eventChannel:   evChan,
-			queryTimeout:   queryTimeout,
-			contextTimeout: contextTimeout,
-			spentFunc:      spentFunc,
-			errorFunc:      errorFunc,
+			id:           firstId + i,
+			repository:   repo,
+			shape:        shape,
+			random:       seeds.newRand(),
+			eventChannel: evChan,
+			tasks:        queues.add(firstId + i),
+			spentFunc:    spentFunc,
+			errorFunc:    errorFunc,
+			resultFunc:   resultFunc,
+			journal:      stageJournal,
+			recording:    stageRecording,
 		}
 		consumers = append(consumers, consumer)
-		go consumer.start()
+		wg.Add(1)
+		go consumer.start(ctx, stopped, wg)
 	}
 	return consumers
 }
 
-func addProducers(producersCount int, eventChannel chan struct{}, msgBySec int, wg *sync.WaitGroup) []*producer {
+func addProducers(ctx context.Context, producersCount int, eventChannel chan task, msgBySec int, wg *sync.WaitGroup) []*producer {
 	var producers []*producer
 
 	wg.Add(producersCount)
@@ -172,90 +449,194 @@ func addProducers(producersCount int, eventChannel chan struct{}, msgBySec int,
 	for i := 0; i < producersCount; i++ {
 		producer := &producer{
 			eventChannel: eventChannel,
+			tm:           time.NewTicker(producerInterval(uint(msgBySec))),
+			stopped:      make(chan struct{}),
 			wg:           wg,
 		}
 		producers = append(producers, producer)
 
-		go producer.start(time.Duration(1000/msgBySec) * time.Millisecond)
+		go producer.start(ctx)
 	}
 
 	return producers
 }
 
 type producer struct {
-	eventChannel chan<- struct{}
+	eventChannel chan<- task
 	tm           *time.Ticker
+	stopped      chan struct{}
 	wg           *sync.WaitGroup
 }
 
-func (p *producer) start(sendEvery time.Duration) {
-	p.tm = time.NewTicker(sendEvery)
-	for range p.tm.C {
-		p.eventChannel <- struct{}{}
+func (p *producer) start(ctx context.Context) {
+	defer p.wg.Done()
+	var intended time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stopped:
+			return
+		case intended = <-p.tm.C:
+		}
+		select {
+		case p.eventChannel <- task{intended: intended}:
+		case <-ctx.Done():
+			return
+		case <-p.stopped:
+			return
+		}
 	}
 }
 
 func (p *producer) stop() {
 	p.tm.Stop()
-	time.Sleep(100 * time.Millisecond)
-	p.wg.Done()
+	close(p.stopped)
 }
 
 type consumer struct {
-	repository     repositories.TestRepository
-	queryTimeout   uint
-	contextTimeout uint
-	eventChannel   <-chan struct{}
-	spentFunc      func(int64)
-	errorFunc      func()
+	id           int
+	repository   repositories.TestRepository
+	shape        *queryShape
+	random       *rand.Rand
+	eventChannel <-chan task
+	// tasks are the operations recorded by the worker this consumer replays.
+	tasks      <-chan task
+	spentFunc  func(time.Duration)
+	errorFunc  func(error)
+	resultFunc func(repositories.QueryResult)
+	journal    *journal.Writer
+	recording  *recording
 }
 
-func (c *consumer) start() {
+// start queries until the event channel is closed or stopped is, in flight queries
+// are only interrupted by ctx.
+func (c *consumer) start(ctx context.Context, stopped <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	for range c.eventChannel {
-		size := rand.Intn(400-100) + 100 //pseudo random it's ok
+	for {
+		next, ok := c.next()
+		if !ok {
+			return
+		}
+		select {
+		case <-stopped:
+			return
+		default:
+		}
+		var ids []string
+		if next.operation == nil {
+			ids = c.shape.ids(c.random)
+			c.recording.query(next.intended, ids, c.id)
+		}
 		start := time.Now()
-		_, err := c.repository.GetStores(uint(size), c.queryTimeout, c.contextTimeout)
-		spent := time.Since(start).Milliseconds()
+		result, err := c.run(ctx, next, ids)
+		spent := time.Since(start)
 		c.spentFunc(spent)
 		if err != nil {
-			c.errorFunc()
+			c.errorFunc(err)
+			c.journal.Operation(spent, 0, 0, string(repositories.KindOf(err)), err.Error())
 			logrus.Error(err)
+			continue
 		}
+		c.journal.Operation(spent, result.Docs, result.Bytes, "", "")
+		c.resultFunc(result)
 	}
 }
 
-const loremp = "Lorem ipsum dolor sit amet, consectetur adipiscing elit. " +
-	"Praesent in lacinia magna. Aenean vitae maximus sem. " +
-	"Quisque pharetra augue et mollis sollicitudin. " +
-	"Mauris vehicula eros lorem. Donec non sodales neque. " +
-	"Nullam malesuada ligula vel enim mattis tincidunt. " +
-	"Praesent non ornare nunc, at vehicula leo. " +
-	"Aenean et placerat orci. Nullam faucibus sodales diam vel volutpat. " +
-	"Nulla tempor quis quam in ullamcorper."
+// next takes a task from the shared channel or from the tasks of the consumer. Once
+// the shared channel is closed nothing is sent anymore, the remaining tasks are run.
+func (c *consumer) next() (task, bool) {
+	for c.eventChannel != nil {
+		select {
+		case next, ok := <-c.eventChannel:
+			if ok {
+				return next, true
+			}
+			c.eventChannel = nil
+		case next := <-c.tasks:
+			return next, true
+		}
+	}
+	select {
+	case next := <-c.tasks:
+		return next, true
+	default:
+		return task{}, false
+	}
+}
 
-func ensureData(repository repositories.TestRepository) ([]string, error) {
+// run replays the operation of next, or queries ids when it has none.
+func (c *consumer) run(ctx context.Context, next task, ids []string) (repositories.QueryResult, error) {
+	if next.operation == nil {
+		return c.query(ctx, ids)
+	}
+	if len(next.operation.Keys) > 0 {
+		return c.query(ctx, next.operation.Keys)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.shape.contextTimeout)
+	defer cancel()
+	info, err := c.repository.Replay(ctx, *next.operation, c.shape.options)
+	return repositories.QueryResult{OperationInfo: info}, err
+}
 
-	count, err := repository.Count()
-	if err != nil {
-		return nil, err
+func (c *consumer) query(ctx context.Context, ids []string) (repositories.QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.shape.contextTimeout)
+	defer cancel()
+	return c.repository.GetStores(ctx, ids, c.shape.options)
+}
+
+// waitSeconds calls tick every second until secs have passed, returning false if ctx is done before.
+func waitSeconds(ctx context.Context, secs uint, tick func()) bool {
+	for i := uint(0); i < secs; i++ {
+		tick()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(1 * time.Second):
+		}
 	}
+	return true
+}
 
-	if count > 0 {
-		repository.Clear()
+// targetRPS is the rate the producers try to reach, using the interval of their tickers.
+func targetRPS(producersCount uint, msgBySec uint) float64 {
+	if msgBySec == 0 {
+		return 0
 	}
+	return float64(producersCount) * float64(time.Second) / float64(producerInterval(msgBySec))
+}
 
-	var storeIds []string
-	var data []repositories.Store
-	for i := 0; i < 10000; i++ {
-		storeId := GenerateId()
-		storeIds = append(storeIds, storeId)
-		data = append(data, repositories.Store{
-			StoreId:   storeId,
-			Name:      "name: " + strconv.Itoa(i),
-			HugeValue: loremp,
-		})
+// producerInterval is the period of the ticker of a producer, sub millisecond for
+// rates above 1000 messages per second.
+func producerInterval(msgBySec uint) time.Duration {
+	if msgBySec == 0 {
+		return time.Second
+	}
+	interval := time.Second / time.Duration(msgBySec)
+	if interval < 1 {
+		return 1
+	}
+	return interval
+}
+
+// failed ends a stage that couldn't start, its result keeping the error and the
+// events recorded so far. A stage canceled while starting is reported as canceled.
+func (s *Stage) failed(ctx context.Context, seed int64, err error) (*Result, error) {
+	if ctx.Err() != nil {
+		logrus.Warnf("Stage canceled before its load: %v", err)
+		s.events.record("Stage canceled: %v", ctx.Err())
+		return &Result{Seed: seed, Canceled: true, Events: s.events.snapshot()}, nil
+	}
+	logrus.Error(err)
+	s.events.record("Stage failed: %v", err)
+	return &Result{Seed: seed, Error: err.Error(), Verdict: VerdictFail, Events: s.events.snapshot()}, err
+}
+
+func closeRepository(repo repositories.TestRepository) {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := repo.Close(ctx); err != nil {
+		logrus.Error(err)
 	}
-	err = repository.Insert(data)
-	return storeIds, err
 }
@@ -0,0 +1,139 @@
+package stage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/repositories"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// memoryStage builds a one second stage on the memory repository.
+func memoryStage(maxPool uint64, workers uint, memory repositories.MemoryConfiguration) *Stage {
+	return New(repositories.MongoDBConfiguration{
+		DbName:         "stores",
+		CollectionName: "stores",
+		MaxPool:        maxPool,
+	}, Config{
+		WorkersCount:     workers,
+		ProducersCount:   2,
+		MsgBySec:         50,
+		TimeToFinishSecs: 1,
+		ContextTimeMs:    500,
+		QueryTimeoutMs:   500,
+		DatasetSize:      200,
+		MinBatchSize:     5,
+		MaxBatchSize:     10,
+		Seed:             42,
+		Memory:           &memory,
+	})
+}
+
+func TestStageOnMemoryRepository(t *testing.T) {
+	result, err := memoryStage(4, 4, repositories.MemoryConfiguration{
+		Latency:   repositories.LatencyDistribution{Type: repositories.LatencyFixed, Mean: 2 * time.Millisecond},
+		ErrorRate: 0.2,
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Seed != 42 || result.Canceled || result.Error != "" {
+		t.Errorf("unexpected result: seed %d, canceled %v, error %q", result.Seed, result.Canceled, result.Error)
+	}
+	if result.Queries == 0 {
+		t.Fatal("expected the stage to run queries")
+	}
+	if result.Errors == 0 || result.Errors >= result.Queries {
+		t.Errorf("expected about 20%% of %d queries to fail, %d did", result.Queries, result.Errors)
+	}
+	if result.ErrorsByKind[repositories.KindServer] != result.Errors || len(result.ErrorsByKind) != 1 {
+		t.Errorf("expected the %d errors to be injected server errors, got %v", result.Errors, result.ErrorsByKind)
+	}
+	if result.ErrorRate != float64(result.Errors)/float64(result.Queries) {
+		t.Errorf("expected error rate %d/%d, got %f", result.Errors, result.Queries, result.ErrorRate)
+	}
+	if result.AvgDocs < 5 || result.MaxDocs > 10 {
+		t.Errorf("expected batches of 5 to 10 docs, got avg %d and max %d", result.AvgDocs, result.MaxDocs)
+	}
+
+	pool := result.Pool
+	if pool.GetsOK != result.Queries || pool.GetsFailed != 0 || pool.Returned != pool.GetsOK {
+		t.Errorf("expected a check out per query, got %+v for %d queries", pool, result.Queries)
+	}
+	if pool.Created == 0 || pool.Created > 4 || pool.PeakInUse > 4 || pool.InUse != 0 {
+		t.Errorf("expected at most 4 connections, all returned, got %+v", pool)
+	}
+}
+
+// TestStageOnMemoryRepositoryPoolWaits runs more workers than connections, queries
+// waiting longer than the wait queue timeout failing as pool timeouts.
+func TestStageOnMemoryRepositoryPoolWaits(t *testing.T) {
+	result, err := memoryStage(1, 8, repositories.MemoryConfiguration{
+		Latency:          repositories.LatencyDistribution{Type: repositories.LatencyFixed, Mean: 20 * time.Millisecond},
+		WaitQueueTimeout: 5 * time.Millisecond,
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeouts := result.ErrorsByKind[repositories.KindPoolTimeout]
+	if timeouts == 0 || timeouts != result.Errors {
+		t.Errorf("expected only pool timeouts, got %v", result.ErrorsByKind)
+	}
+	pool := result.Pool
+	if pool.Created != 1 || pool.PeakInUse != 1 {
+		t.Errorf("expected a single connection, got %+v", pool)
+	}
+	if pool.GetsFailed != timeouts || pool.Reasons[event.ReasonTimedOut] != timeouts {
+		t.Errorf("expected %d check outs timed out, got %+v", timeouts, pool)
+	}
+	if pool.GetsOK+pool.GetsFailed != result.Queries {
+		t.Errorf("expected a check out per query, got %+v for %d queries", pool, result.Queries)
+	}
+}
+
+func TestStageFailsWithoutStarting(t *testing.T) {
+	stageImpl := New(repositories.MongoDBConfiguration{ConnString: "not a uri", DbName: "stores"}, Config{Seed: 7})
+	result, err := stageImpl.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected an invalid connection string to fail the stage")
+	}
+	if result == nil || result.Error != err.Error() || result.Verdict != VerdictFail || result.Seed != 7 {
+		t.Errorf("expected a failed result keeping the error, got %+v", result)
+	}
+}
+
+func TestStageCanceledWhilePreparingData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := memoryStage(4, 4, repositories.MemoryConfiguration{}).Run(ctx)
+	if err != nil {
+		t.Fatalf("expected a canceled stage not to fail, got %v", err)
+	}
+	if !result.Canceled || result.Verdict == VerdictFail || result.Error != "" {
+		t.Errorf("expected a canceled result, got canceled %t, verdict %q, error %q",
+			result.Canceled, result.Verdict, result.Error)
+	}
+}
+
+func TestProducerInterval(t *testing.T) {
+	tests := []struct {
+		msgBySec uint
+		interval time.Duration
+	}{
+		{1, time.Second},
+		{300, 3333333 * time.Nanosecond},
+		{1000, time.Millisecond},
+		{5000, 200 * time.Microsecond},
+	}
+	for _, test := range tests {
+		if interval := producerInterval(test.msgBySec); interval != test.interval {
+			t.Errorf("%d messages per second: expected %v, got %v", test.msgBySec, test.interval, interval)
+		}
+	}
+	if rps := targetRPS(2, 5000); rps != 10000 {
+		t.Errorf("expected 2 producers at 5000 messages per second to target 10000, got %v", rps)
+	}
+}
@@ -0,0 +1,157 @@
+package stage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/stats"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	phaseSteady = "steady"
+	phaseDrain  = "drain"
+)
+
+// Window holds what happened during one second of the stage. Second is the offset of
+// its start from the start of the stage, a phase change cuts a window shorter than
+// DurationSecs.
+type Window struct {
+	Second       int      `json:"second"`
+	DurationSecs float64  `json:"duration_secs"`
+	Phase        string   `json:"phase"`
+	Queries      int64    `json:"queries"`
+	Errors       int64    `json:"errors"`
+	ErrorRate    float64  `json:"error_rate"`
+	Throughput   float64  `json:"throughput"`
+	P99Ms        float64  `json:"p99_ms"`
+	PoolTimeouts int64    `json:"pool_timeouts"`
+	GetsFailed   int64    `json:"gets_failed"`
+	PeakInUse    int64    `json:"peak_in_use"`
+	Violations   []string `json:"violations,omitempty"`
+	firstSample  int
+	lastSample   int
+}
+
+// timeline samples the stage counters every second. Changing the phase closes the
+// current window, so windows never mix phases.
+type timeline struct {
+	latencies  *latencyRecorder
+	errorCount *int64
+	pool       *stats.PoolStats
+	mutex      sync.Mutex
+	phase      string
+	windows    []Window
+	started    time.Time
+	last       time.Time
+	lastSample int
+	lastErrors int64
+	lastPoolTO int64
+	lastFailed int64
+	observe    func(Window)
+	phases     chan string
+	stopped    chan struct{}
+	done       chan struct{}
+}
+
+// minWindow is the shortest window kept when the phase changes.
+const minWindow = 10 * time.Millisecond
+
+// startTimeline calls observe with every window once it closes.
+func startTimeline(latencies *latencyRecorder, errorCount *int64, pool *stats.PoolStats, phase string,
+	observe func(Window)) *timeline {
+	started := time.Now()
+	t := &timeline{
+		latencies:  latencies,
+		errorCount: errorCount,
+		pool:       pool,
+		phase:      phase,
+		started:    started,
+		last:       started,
+		lastPoolTO: poolTimeouts(pool),
+		lastFailed: atomic.LoadInt64(&pool.GetsFailed),
+		observe:    observe,
+		phases:     make(chan string),
+		stopped:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	pool.TakeWindowPeak()
+	go t.run()
+	return t
+}
+
+func (t *timeline) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(time.Second)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-ticker.C:
+			t.sample()
+		case phase := <-t.phases:
+			if time.Since(t.last) >= minWindow {
+				t.sample()
+			}
+			t.mutex.Lock()
+			t.phase = phase
+			t.mutex.Unlock()
+			ticker.Stop()
+			ticker = time.NewTicker(time.Second)
+		case <-t.stopped:
+			t.sample()
+			return
+		}
+	}
+}
+
+func (t *timeline) setPhase(phase string) {
+	t.phases <- phase
+}
+
+func (t *timeline) sample() {
+	now := time.Now()
+	errors := atomic.LoadInt64(t.errorCount)
+	poolTO := poolTimeouts(t.pool)
+	failed := atomic.LoadInt64(&t.pool.GetsFailed)
+
+	t.mutex.Lock()
+	samples := t.latencies.since(t.lastSample)
+	window := Window{
+		Second:       int(t.last.Sub(t.started).Seconds()),
+		DurationSecs: now.Sub(t.last).Seconds(),
+		Phase:        t.phase,
+		Queries:      int64(len(samples)),
+		Errors:       errors - t.lastErrors,
+		PoolTimeouts: poolTO - t.lastPoolTO,
+		GetsFailed:   failed - t.lastFailed,
+		PeakInUse:    t.pool.TakeWindowPeak(),
+		firstSample:  t.lastSample,
+		lastSample:   t.lastSample + len(samples),
+	}
+	if window.Queries > 0 {
+		window.ErrorRate = float64(window.Errors) / float64(window.Queries)
+		window.P99Ms = summarize(samples).P99
+	}
+	if window.DurationSecs > 0 {
+		window.Throughput = float64(window.Queries) / window.DurationSecs
+	}
+	t.windows = append(t.windows, window)
+	t.last, t.lastSample, t.lastErrors, t.lastPoolTO, t.lastFailed = now, window.lastSample, errors, poolTO, failed
+	t.mutex.Unlock()
+
+	t.observe(window)
+}
+
+// stop takes the last, usually partial, window and returns every window.
+func (t *timeline) stop() []Window {
+	close(t.stopped)
+	<-t.done
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.windows
+}
+
+func poolTimeouts(pool *stats.PoolStats) int64 {
+	return pool.Snapshot().Reasons[event.ReasonTimedOut]
+}
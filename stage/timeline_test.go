@@ -0,0 +1,46 @@
+package stage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/n4d13/mongo_driver_test/stats"
+)
+
+// TestTimelineWindowsKeepElapsedSeconds cuts a window with a phase change, the next
+// windows keeping their offset from the start instead of their index.
+func TestTimelineWindowsKeepElapsedSeconds(t *testing.T) {
+	at := func(secs float64) int64 {
+		return int64(1e9) + int64(secs*float64(time.Second))
+	}
+	rebuilt := &rebuiltTimeline{pool: stats.NewPoolStats()}
+	rebuilt.begin(at(0), "ramp-1")
+	rebuilt.advance(at(1.3))
+	rebuilt.setPhase(at(1.3), phaseSteady)
+	rebuilt.advance(at(3.4))
+	rebuilt.setPhase(at(3.4), phaseDrain)
+
+	expected := []struct {
+		second   int
+		duration float64
+		phase    string
+	}{
+		{0, 1, "ramp-1"},
+		{1, 0.3, "ramp-1"},
+		{1, 1, phaseSteady},
+		{2, 1, phaseSteady},
+		{3, 0.1, phaseSteady},
+	}
+	windows := rebuilt.windows(nil)
+	if len(windows) != len(expected) {
+		t.Fatalf("expected %d windows, got %+v", len(expected), windows)
+	}
+	for i, window := range windows {
+		if window.Second != expected[i].second || window.Phase != expected[i].phase ||
+			math.Abs(window.DurationSecs-expected[i].duration) > 1e-9 {
+			t.Errorf("window %d: expected second %d of %s lasting %.1fs, got second %d of %s lasting %fs", i,
+				expected[i].second, expected[i].phase, expected[i].duration, window.Second, window.Phase, window.DurationSecs)
+		}
+	}
+}
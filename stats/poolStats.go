@@ -16,6 +16,8 @@ type PoolStats struct {
 	GetsOK     int64
 	GetsFailed int64
 	Reasons    map[string]int64
+	PeakInUse  int64
+	windowPeak int64
 	mutex      sync.RWMutex
 }
 
@@ -36,20 +38,31 @@ func (p *PoolStats) MonitorFunc(poolEvent *event.PoolEvent) {
 		atomic.AddInt64(&p.InUse, -1)
 	case event.GetSucceeded:
 		atomic.AddInt64(&p.GetsOK, 1)
-		atomic.AddInt64(&p.InUse, 1)
+		inUse := atomic.AddInt64(&p.InUse, 1)
+		storeMax(&p.PeakInUse, inUse)
+		storeMax(&p.windowPeak, inUse)
 	case event.GetFailed:
 		atomic.AddInt64(&p.GetsFailed, 1)
-		_, ok := p.Reasons[poolEvent.Reason]
 		p.mutex.Lock()
-		if ok {
-			p.Reasons[poolEvent.Reason] = p.Reasons[poolEvent.Reason] + 1
-		} else {
-			p.Reasons[poolEvent.Reason] = 1
-		}
+		p.Reasons[poolEvent.Reason] = p.Reasons[poolEvent.Reason] + 1
 		p.mutex.Unlock()
 	}
 }
 
+// TakeWindowPeak returns the highest InUse since the previous call.
+func (p *PoolStats) TakeWindowPeak() int64 {
+	return atomic.SwapInt64(&p.windowPeak, atomic.LoadInt64(&p.InUse))
+}
+
+func storeMax(address *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(address)
+		if value <= current || atomic.CompareAndSwapInt64(address, current, value) {
+			return
+		}
+	}
+}
+
 func (p *PoolStats) String() string {
 	return fmt.Sprintf("{"+
 		"created=%d, "+
@@ -61,3 +74,34 @@ func (p *PoolStats) String() string {
 		"failures=%v"+
 		"}", p.Created, p.Closed, p.InUse, p.Returned, p.GetsOK, p.GetsFailed, p.Reasons)
 }
+
+// PoolSnapshot is a copy of the pool counters at a given moment.
+type PoolSnapshot struct {
+	Created    int64            `json:"created"`
+	Closed     int64            `json:"closed"`
+	InUse      int64            `json:"in_use"`
+	Returned   int64            `json:"returned"`
+	GetsOK     int64            `json:"gets_ok"`
+	GetsFailed int64            `json:"gets_failed"`
+	Reasons    map[string]int64 `json:"failures,omitempty"`
+	PeakInUse  int64            `json:"peak_in_use"`
+}
+
+func (p *PoolStats) Snapshot() PoolSnapshot {
+	p.mutex.RLock()
+	reasons := make(map[string]int64, len(p.Reasons))
+	for reason, count := range p.Reasons {
+		reasons[reason] = count
+	}
+	p.mutex.RUnlock()
+	return PoolSnapshot{
+		Created:    atomic.LoadInt64(&p.Created),
+		Closed:     atomic.LoadInt64(&p.Closed),
+		InUse:      atomic.LoadInt64(&p.InUse),
+		Returned:   atomic.LoadInt64(&p.Returned),
+		GetsOK:     atomic.LoadInt64(&p.GetsOK),
+		GetsFailed: atomic.LoadInt64(&p.GetsFailed),
+		Reasons:    reasons,
+		PeakInUse:  atomic.LoadInt64(&p.PeakInUse),
+	}
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var ErrNotFound = errors.New("not found")
+
+var validId = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// FileStore keeps every document as a JSON file, in a directory per kind.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) Dir() string {
+	return f.dir
+}
+
+// Save replaces the document atomically, readers see either the old or the new one.
+func (f *FileStore) Save(kind string, id string, value interface{}) error {
+	path, err := f.path(kind, id)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *FileStore) Load(kind string, id string, value interface{}) error {
+	path, err := f.path(kind, id)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, value)
+}
+
+// Delete removes the document, deleting a missing one is not an error.
+func (f *FileStore) Delete(kind string, id string) error {
+	path, err := f.path(kind, id)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Each decodes every document of kind with decode.
+func (f *FileStore) Each(kind string, decode func(content []byte) error) error {
+	files, err := ioutil.ReadDir(filepath.Join(f.dir, kind))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(f.dir, kind, file.Name()))
+		if err != nil {
+			return err
+		}
+		if err = decode(content); err != nil {
+			return fmt.Errorf("%s: %w", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (f *FileStore) path(kind string, id string) (string, error) {
+	if !validId.MatchString(id) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(f.dir, kind, id+".json"), nil
+}